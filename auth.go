@@ -0,0 +1,221 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"time"
+)
+
+// ErrPermissionDenied is returned when an operation is not covered by the
+// token it is made with.
+var ErrPermissionDenied = errors.New("permission denied")
+
+// Permission is a set of operations a Capability allows.
+type Permission uint8
+
+const (
+	// PermRead allows reading files, their metadata and their history.
+	PermRead Permission = 1 << iota
+	// PermWrite allows storing files.
+	PermWrite
+	// PermDelete allows deleting files.
+	PermDelete
+
+	// PermAll allows every operation.
+	PermAll = PermRead | PermWrite | PermDelete
+)
+
+// String implements fmt.Stringer.
+func (p Permission) String() string {
+	var names []string
+	for _, perm := range []struct {
+		p    Permission
+		name string
+	}{{PermRead, "read"}, {PermWrite, "write"}, {PermDelete, "delete"}} {
+		if p&perm.p != 0 {
+			names = append(names, perm.name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, "|")
+}
+
+// AnyNamespace is the Namespace of a Capability that covers every namespace,
+// as held by the nodes of the cluster.
+const AnyNamespace = "*"
+
+// Capability is what a token allows its holder to do. Tokens are signed by
+// IssueToken with the AuthKey shared by the nodes of the cluster, so any node
+// can check them without asking anyone.
+type Capability struct {
+	// Subject names the holder, for the logs.
+	Subject string
+	// Namespace is the namespace the capability covers, or AnyNamespace.
+	Namespace string
+	// Permissions are the operations allowed in the namespace.
+	Permissions Permission
+	// ExpiresAt is when the capability expires. The zero time never
+	// expires.
+	ExpiresAt time.Time
+}
+
+// Allows reports whether the capability allows the given permissions in the
+// namespace ns at the given time. Only capabilities covering every namespace
+// allow an ns of AnyNamespace.
+func (c Capability) Allows(ns string, perm Permission, now time.Time) bool {
+	if !c.ExpiresAt.IsZero() && !now.Before(c.ExpiresAt) {
+		return false
+	}
+	if c.Namespace != AnyNamespace && c.Namespace != ns {
+		return false
+	}
+	return c.Permissions&perm == perm
+}
+
+// IssueToken returns a token granting c, signed with authKey.
+func IssueToken(authKey []byte, c Capability) (string, error) {
+	if len(authKey) == 0 {
+		return "", errors.New("auth key is empty")
+	}
+	b, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+
+	payload := base64.RawURLEncoding.EncodeToString(b)
+	return payload + "." + base64.RawURLEncoding.EncodeToString(tokenSignature(authKey, payload)), nil
+}
+
+// parseToken checks the signature of token against authKey and returns the
+// capability it grants.
+func parseToken(authKey []byte, token string) (Capability, error) {
+	var c Capability
+
+	payload, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return c, fmt.Errorf("%w: malformed token", ErrPermissionDenied)
+	}
+	want, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(want, tokenSignature(authKey, payload)) {
+		return c, fmt.Errorf("%w: invalid token signature", ErrPermissionDenied)
+	}
+	b, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return c, fmt.Errorf("%w: malformed token", ErrPermissionDenied)
+	}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return c, fmt.Errorf("%w: malformed token", ErrPermissionDenied)
+	}
+
+	return c, nil
+}
+
+// tokenSignature returns the signature of the token payload.
+func tokenSignature(authKey []byte, payload string) []byte {
+	mac := hmac.New(sha256.New, authKey)
+	mac.Write([]byte("token/" + payload))
+	return mac.Sum(nil)
+}
+
+// authorize checks that token allows the given permissions in the namespace
+// ns. An empty token stands for the Token of the server. Everything is
+// allowed when no AuthKey is configured.
+func (s *FileServer) authorize(token string, ns string, perm Permission) error {
+	if len(s.AuthKey) == 0 {
+		return nil
+	}
+	if len(token) == 0 {
+		token = s.Token
+	}
+	if len(token) == 0 {
+		return fmt.Errorf("%w: no token", ErrPermissionDenied)
+	}
+
+	c, err := parseToken(s.AuthKey, token)
+	if err != nil {
+		return err
+	}
+	if !c.Allows(ns, perm, time.Now()) {
+		return fmt.Errorf("%w: token of (%s) does not allow %s in namespace (%s)", ErrPermissionDenied, c.Subject, perm, ns)
+	}
+	return nil
+}
+
+// authorizeMessage checks that the token a peer sent a message with allows
+// it. Requests concerning a namespace need the matching permission in it;
+// responses and requests about the node itself only need a valid token.
+func (s *FileServer) authorizeMessage(msg *Message) error {
+	if len(s.AuthKey) == 0 {
+		return nil
+	}
+	if len(msg.Token) == 0 {
+		return fmt.Errorf("%w: no token", ErrPermissionDenied)
+	}
+
+	var (
+		ns   string
+		perm Permission
+	)
+	switch v := msg.Payload.(type) {
+	case MessageStoreFile:
+		ns, perm = v.Namespace, PermWrite
+	case MessageGetFile:
+		ns, perm = v.Namespace, PermRead
+	case MessageDeleteFile:
+		ns, perm = v.Namespace, PermDelete
+	case MessageStat:
+		ns, perm = v.Namespace, PermRead
+	case MessageMerkleNodes:
+		ns, perm = v.Namespace, PermRead
+	case MessageMerkleLeaves:
+		ns, perm = v.Namespace, PermRead
+	case MessageRewrapKey:
+		ns, perm = v.Namespace, PermWrite
+	default:
+		_, err := parseToken(s.AuthKey, msg.Token)
+		return err
+	}
+
+	return s.authorize(msg.Token, ns, perm)
+}
+
+// MessageDenied answers a request the sender is not authorized to make.
+type MessageDenied struct {
+	Reason string
+}
+
+// deny refuses a message from a peer that failed authorization. The stream
+// following a MessageStoreFile is discarded, and requests, MessageGetFile
+// included, are answered with a MessageDenied.
+func (s *FileServer) deny(from string, msg *Message, err error) error {
+	s.peerLock.Lock()
+	peer, ok := s.peers[from]
+	s.peerLock.Unlock()
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+
+	switch v := msg.Payload.(type) {
+	case MessageStoreFile:
+		if waitErr := peer.WaitStream(requestTimeout); waitErr == nil {
+			io.Copy(io.Discard, io.LimitReader(peer, v.Size-v.Offset))
+			peer.CloseStream()
+		}
+	}
+	if len(msg.RequestID) > 0 && !msg.Response {
+		if replyErr := s.reply(from, msg.RequestID, MessageDenied{Reason: err.Error()}); replyErr != nil {
+			log.Println("deny error: ", replyErr)
+		}
+	}
+
+	return fmt.Errorf("[%s] denied %T from %s: %w", s.Transport.Addr(), msg.Payload, from, err)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// issueTestToken issues a token for c, failing the test if it cannot.
+func issueTestToken(t *testing.T, authKey []byte, c Capability) string {
+	t.Helper()
+	token, err := IssueToken(authKey, c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestTokens(t *testing.T) {
+	authKey := newEncryptionKey()
+	c := Capability{Subject: "uploader", Namespace: "photos", Permissions: PermRead | PermWrite}
+	token := issueTestToken(t, authKey, c)
+
+	have, err := parseToken(authKey, token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have != c {
+		t.Errorf("expected %+v, have %+v", c, have)
+	}
+
+	if _, err := parseToken(newEncryptionKey(), token); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("expected token signed with another key to fail with %s, have %v", ErrPermissionDenied, err)
+	}
+
+	// Widening the capability invalidates the signature.
+	forged := issueTestToken(t, authKey, Capability{Subject: "uploader", Namespace: AnyNamespace, Permissions: PermAll})
+	payload, _, _ := strings.Cut(forged, ".")
+	_, sig, _ := strings.Cut(token, ".")
+	if _, err := parseToken(authKey, payload+"."+sig); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("expected tampered token to fail with %s, have %v", ErrPermissionDenied, err)
+	}
+
+	if _, err := parseToken(authKey, "garbage"); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("expected malformed token to fail with %s, have %v", ErrPermissionDenied, err)
+	}
+}
+
+func TestCapabilityAllows(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		c    Capability
+		ns   string
+		perm Permission
+		want bool
+	}{
+		{Capability{Namespace: "photos", Permissions: PermRead}, "photos", PermRead, true},
+		{Capability{Namespace: "photos", Permissions: PermRead}, "photos", PermWrite, false},
+		{Capability{Namespace: "photos", Permissions: PermRead}, "invoices", PermRead, false},
+		{Capability{Namespace: "photos", Permissions: PermWrite}, "photos", PermRead | PermWrite, false},
+		{Capability{Namespace: "photos", Permissions: PermAll}, AnyNamespace, PermRead, false},
+		{Capability{Namespace: AnyNamespace, Permissions: PermDelete}, "invoices", PermDelete, true},
+		{Capability{Namespace: "photos", Permissions: PermAll, ExpiresAt: now.Add(time.Minute)}, "photos", PermRead, true},
+		{Capability{Namespace: "photos", Permissions: PermAll, ExpiresAt: now}, "photos", PermRead, false},
+	}
+
+	for _, tt := range tests {
+		if have := tt.c.Allows(tt.ns, tt.perm, now); have != tt.want {
+			t.Errorf("expected %+v to allow %s in (%s): %t, have %t", tt.c, tt.perm, tt.ns, tt.want, have)
+		}
+	}
+}
+
+func TestFileServerAuthorization(t *testing.T) {
+	s := newTestServer(t)
+	s.AuthKey = newEncryptionKey()
+
+	data := []byte("signed and sealed")
+	if err := s.Store(testNamespace, "key", bytes.NewReader(data)); !errors.Is(err, ErrPermissionDenied) {
+		t.Fatalf("expected write without a token to fail with %s, have %v", ErrPermissionDenied, err)
+	}
+
+	s.Token = issueTestToken(t, s.AuthKey, Capability{Subject: "node", Namespace: AnyNamespace, Permissions: PermAll})
+	if err := s.Store(testNamespace, "key", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	reader := issueTestToken(t, s.AuthKey, Capability{Subject: "reader", Namespace: testNamespace, Permissions: PermRead})
+	if _, err := s.GetWithOptions(testNamespace, "key", ReadOptions{Token: reader}); err != nil {
+		t.Errorf("expected read with a read token to succeed: %s", err)
+	}
+	if _, err := s.StoreWithOptions(testNamespace, "key", bytes.NewReader(data), WriteOptions{Token: reader}); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("expected write with a read token to fail with %s, have %v", ErrPermissionDenied, err)
+	}
+	if _, err := s.DeleteWithOptions(testNamespace, "key", WriteOptions{Token: reader}); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("expected delete with a read token to fail with %s, have %v", ErrPermissionDenied, err)
+	}
+
+	other := issueTestToken(t, s.AuthKey, Capability{Subject: "other", Namespace: "other", Permissions: PermAll})
+	if _, err := s.GetWithOptions(testNamespace, "key", ReadOptions{Token: other}); !errors.Is(err, ErrPermissionDenied) {
+		t.Errorf("expected read with a token for another namespace to fail with %s, have %v", ErrPermissionDenied, err)
+	}
+}
+
+func TestAuthorizeMessage(t *testing.T) {
+	s := newTestServer(t)
+	s.AuthKey = newEncryptionKey()
+
+	writer := issueTestToken(t, s.AuthKey, Capability{Subject: "edge", Namespace: testNamespace, Permissions: PermWrite})
+	tests := []struct {
+		msg  Message
+		want bool
+	}{
+		{Message{Payload: MessageStoreFile{Namespace: testNamespace}}, false},
+		{Message{Token: "garbage", Payload: MessageStoreFile{Namespace: testNamespace}}, false},
+		{Message{Token: writer, Payload: MessageStoreFile{Namespace: testNamespace}}, true},
+		{Message{Token: writer, Payload: MessageStoreFile{Namespace: "other"}}, false},
+		{Message{Token: writer, Payload: MessageGetFile{Namespace: testNamespace}}, false},
+		{Message{Token: writer, Payload: MessageDeleteFile{Namespace: testNamespace}}, false},
+		{Message{Token: writer, Payload: MessageNodeInfo{}}, true},
+		{Message{Token: writer, Response: true, Payload: MessageStoreAck{}}, true},
+		{Message{Response: true, Payload: MessageStoreAck{}}, false},
+	}
+
+	for _, tt := range tests {
+		err := s.authorizeMessage(&tt.msg)
+		if have := err == nil; have != tt.want {
+			t.Errorf("expected %T with token %q to be allowed: %t, have %v", tt.msg.Payload, tt.msg.Token, tt.want, err)
+		}
+		if err != nil && !errors.Is(err, ErrPermissionDenied) {
+			t.Errorf("expected %s, have %s", ErrPermissionDenied, err)
+		}
+	}
+}
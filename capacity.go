@@ -0,0 +1,347 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrInsufficientSpace is returned when a write does not fit in the capacity
+// of a node or the quota of a namespace.
+var ErrInsufficientSpace = errors.New("insufficient space")
+
+// Capacity is how much a node can store and how much of it is in use.
+type Capacity struct {
+	// Total is the number of bytes the node may store. Zero is unlimited.
+	Total int64
+	// Used is the number of bytes stored, history included, plus those held
+	// for transfers in progress.
+	Used int64
+}
+
+// Free returns the number of bytes that can still be stored.
+func (c Capacity) Free() int64 {
+	if c.Total == 0 {
+		return math.MaxInt64
+	}
+	return max(c.Total-c.Used, 0)
+}
+
+// Capacity returns the capacity of the store and how much of it is in use.
+func (s *Store) Capacity() (Capacity, error) {
+	used, err := s.meter.usage("")
+	if err != nil {
+		return Capacity{Total: s.StoreOpts.Capacity}, err
+	}
+
+	s.reserveLock.Lock()
+	used += s.reserved[""]
+	s.reserveLock.Unlock()
+
+	return Capacity{Total: s.StoreOpts.Capacity, Used: used}, nil
+}
+
+// NamespaceUsage returns the number of bytes stored under the given id,
+// metadata and history included.
+func (s *Store) NamespaceUsage(id string) (int64, error) {
+	if err := checkNamespace(id); err != nil {
+		return 0, err
+	}
+	return s.meter.usage(id)
+}
+
+// available returns how many more bytes can be stored under the given id
+// before the node runs out of capacity or the namespace exceeds its quota,
+// leaving out the bytes held by reservations.
+func (s *Store) available(id string) (int64, error) {
+	s.reserveLock.Lock()
+	defer s.reserveLock.Unlock()
+
+	return s.unreserved(id)
+}
+
+// unreserved implements available. The caller must hold reserveLock.
+func (s *Store) unreserved(id string) (int64, error) {
+	free := int64(math.MaxInt64)
+	if s.StoreOpts.Capacity > 0 {
+		used, err := s.meter.usage("")
+		if err != nil {
+			return 0, err
+		}
+		free = max(s.StoreOpts.Capacity-used-s.reserved[""], 0)
+	}
+
+	if quota, ok := s.Quotas[id]; ok {
+		used, err := s.meter.usage(id)
+		if err != nil {
+			return 0, err
+		}
+		free = min(free, max(quota-used-s.reserved[id], 0))
+	}
+
+	return free, nil
+}
+
+// free returns how many more bytes can be stored before the node runs out of
+// capacity.
+func (s *Store) free() (int64, error) {
+	return s.available("")
+}
+
+// Reserve holds size bytes under the given id, so concurrent writes cannot
+// take them, until the returned function is called. It fails with
+// ErrInsufficientSpace if the bytes are not available. The reservation has to
+// be released before the bytes are written to the store, which checks the
+// space left without it.
+func (s *Store) Reserve(id string, size int64) (func(), error) {
+	s.reserveLock.Lock()
+	defer s.reserveLock.Unlock()
+
+	free, err := s.unreserved(id)
+	if err != nil {
+		return nil, err
+	}
+	if size > free {
+		return nil, fmt.Errorf("%w: %d bytes needed in namespace (%s), %d available", ErrInsufficientSpace, size, id, free)
+	}
+
+	s.reserved[""] += size
+	s.reserved[id] += size
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			s.reserveLock.Lock()
+			defer s.reserveLock.Unlock()
+
+			s.reserved[""] -= size
+			s.reserved[id] -= size
+		})
+	}, nil
+}
+
+// meteredStorage keeps a running count of the bytes stored per namespace, so
+// the space left can be checked without listing every blob. Blobs under
+// hidden prefixes, such as partial transfers and quarantined blobs, are not
+// counted: they are not part of any namespace, and a transfer holds its bytes
+// with a reservation until it is committed.
+//
+// The count is taken from the wrapped storage the first time it is needed
+// and kept up to date as blobs are written, deleted and renamed through the
+// meteredStorage.
+type meteredStorage struct {
+	Storage
+
+	mu     sync.Mutex
+	loaded bool
+	used   map[string]int64
+}
+
+// newMeteredStorage wraps storage to count the bytes stored in it.
+func newMeteredStorage(storage Storage) *meteredStorage {
+	return &meteredStorage{Storage: storage}
+}
+
+// namespaceOf returns the namespace the blob name belongs to, or false if it
+// is kept under a hidden prefix.
+func namespaceOf(name string) (string, bool) {
+	id, _, _ := strings.Cut(name, "/")
+	return id, !strings.HasPrefix(id, ".")
+}
+
+// load counts the blobs in the storage, unless it has been done already. The
+// caller must hold mu.
+func (m *meteredStorage) load() error {
+	if m.loaded {
+		return nil
+	}
+
+	names, err := m.Storage.List("")
+	if err != nil {
+		return err
+	}
+	used := make(map[string]int64)
+	for _, name := range names {
+		id, ok := namespaceOf(name)
+		if !ok {
+			continue
+		}
+		n, err := m.Storage.Stat(name)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		used[id] += n
+		used[""] += n
+	}
+
+	m.used, m.loaded = used, true
+	return nil
+}
+
+// add counts n more bytes in the namespace of the blob name. The caller must
+// hold mu.
+func (m *meteredStorage) add(name string, n int64) {
+	if id, ok := namespaceOf(name); ok {
+		m.used[id] += n
+		m.used[""] += n
+	}
+}
+
+// size returns the size of the blob name, or zero if there is none.
+func (m *meteredStorage) size(name string) (int64, error) {
+	n, err := m.Storage.Stat(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	return n, err
+}
+
+// usage returns the number of bytes stored under the given namespace, or in
+// every namespace if id is empty.
+func (m *meteredStorage) usage(id string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.load(); err != nil {
+		return 0, err
+	}
+	return m.used[id], nil
+}
+
+// Write implements Storage.
+func (m *meteredStorage) Write(name string, r io.Reader) (int64, error) {
+	if _, ok := namespaceOf(name); !ok {
+		return m.Storage.Write(name, r)
+	}
+
+	m.mu.Lock()
+	err := m.load()
+	m.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+
+	old, err := m.size(name)
+	if err != nil {
+		return 0, err
+	}
+	n, err := m.Storage.Write(name, r)
+	if err != nil {
+		return n, err
+	}
+
+	m.mu.Lock()
+	m.add(name, n-old)
+	m.mu.Unlock()
+
+	return n, nil
+}
+
+// Delete implements Storage.
+func (m *meteredStorage) Delete(name string) error {
+	if _, ok := namespaceOf(name); !ok {
+		return m.Storage.Delete(name)
+	}
+
+	m.mu.Lock()
+	err := m.load()
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	old, err := m.size(name)
+	if err != nil {
+		return err
+	}
+	if err := m.Storage.Delete(name); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.add(name, -old)
+	m.mu.Unlock()
+
+	return nil
+}
+
+// Rename implements Storage.
+func (m *meteredStorage) Rename(from string, to string) error {
+	m.mu.Lock()
+	err := m.load()
+	m.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	n, err := m.size(from)
+	if err != nil {
+		return err
+	}
+	replaced, err := m.size(to)
+	if err != nil {
+		return err
+	}
+	if err := m.Storage.Rename(from, to); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	m.add(from, -n)
+	m.add(to, n-replaced)
+	m.mu.Unlock()
+
+	return nil
+}
+
+// Clear implements Storage.
+func (m *meteredStorage) Clear() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.Storage.Clear(); err != nil {
+		m.loaded = false
+		return err
+	}
+	m.used, m.loaded = make(map[string]int64), true
+	return nil
+}
+
+// garbage implements garbageCollector for the wrapped storage, if it does.
+func (m *meteredStorage) garbage(before time.Time) ([]GCItem, error) {
+	if gc, ok := m.Storage.(garbageCollector); ok {
+		return gc.garbage(before)
+	}
+	return nil, nil
+}
+
+// limitedWriter fails with ErrInsufficientSpace instead of writing past
+// limit bytes.
+type limitedWriter struct {
+	w     io.Writer
+	limit int64
+	n     int64
+}
+
+// Write implements io.Writer.
+func (l *limitedWriter) Write(b []byte) (int, error) {
+	if l.n+int64(len(b)) > l.limit {
+		return 0, fmt.Errorf("%w: write exceeds the %d bytes available", ErrInsufficientSpace, l.limit)
+	}
+	n, err := l.w.Write(b)
+	l.n += int64(n)
+	return n, err
+}
+
+// Capacity returns the capacity of this node and how much of it is in use.
+func (s *FileServer) Capacity() (Capacity, error) {
+	return s.store.Capacity()
+}
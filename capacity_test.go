@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestStoreQuota(t *testing.T) {
+	id := generateID()
+	s := NewStore(StoreOpts{
+		PathTransformFunc: CASPathTransformFunc,
+		Quotas:            map[string]int64{id: 1000},
+	})
+	defer teardown(t, s)
+
+	data := bytes.Repeat([]byte("a"), 600)
+	meta := func(wall int64) ObjectMeta {
+		return ObjectMeta{Version: Version{WallTime: wall, NodeID: "a"}}
+	}
+
+	if _, err := s.WriteWithMeta(id, "first", bytes.NewReader(data), meta(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.WriteWithMeta(id, "second", bytes.NewReader(data), meta(2)); !errors.Is(err, ErrInsufficientSpace) {
+		t.Fatalf("expected write over quota to fail with %s, have %v", ErrInsufficientSpace, err)
+	}
+	if s.Has(id, "second") {
+		t.Errorf("expected refused write to leave nothing behind")
+	}
+
+	// A refused overwrite keeps the current version in place.
+	if _, err := s.WriteWithMeta(id, "first", bytes.NewReader(data), meta(3)); !errors.Is(err, ErrInsufficientSpace) {
+		t.Fatalf("expected overwrite over quota to fail with %s, have %v", ErrInsufficientSpace, err)
+	}
+	_, r, err := s.Read(id, "first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Errorf("expected the original version to be restored")
+	}
+
+	// Other namespaces are not affected by the quota.
+	if _, err := s.WriteWithMeta(generateID(), "first", bytes.NewReader(data), meta(1)); err != nil {
+		t.Errorf("expected write to namespace without quota to succeed: %s", err)
+	}
+}
+
+func TestStoreCapacity(t *testing.T) {
+	s := NewStore(StoreOpts{
+		PathTransformFunc: CASPathTransformFunc,
+		Capacity:          1000,
+	})
+	id := generateID()
+	defer teardown(t, s)
+
+	if _, err := s.Write(id, "foo", bytes.NewReader(make([]byte, 500))); err != nil {
+		t.Fatal(err)
+	}
+
+	capacity, err := s.Capacity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if capacity.Used <= 500 || capacity.Free() != capacity.Total-capacity.Used {
+		t.Errorf("unexpected capacity %+v", capacity)
+	}
+
+	if _, err := s.Reserve(generateID(), capacity.Free()+1); !errors.Is(err, ErrInsufficientSpace) {
+		t.Errorf("expected reservation beyond capacity to fail with %s, have %v", ErrInsufficientSpace, err)
+	}
+	if _, err := s.Write(generateID(), "bar", bytes.NewReader(make([]byte, 500))); !errors.Is(err, ErrInsufficientSpace) {
+		t.Errorf("expected write beyond capacity to fail with %s, have %v", ErrInsufficientSpace, err)
+	}
+}
+
+func TestReserveHoldsSpace(t *testing.T) {
+	s := NewStore(StoreOpts{
+		PathTransformFunc: CASPathTransformFunc,
+		Capacity:          1000,
+	})
+	id := generateID()
+	defer teardown(t, s)
+
+	release, err := s.Reserve(id, 600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Reserve(id, 600); !errors.Is(err, ErrInsufficientSpace) {
+		t.Errorf("expected second reservation to fail with %s while the first is held, have %v", ErrInsufficientSpace, err)
+	}
+	if capacity, _ := s.Capacity(); capacity.Used != 600 {
+		t.Errorf("expected held bytes to count as used, have %+v", capacity)
+	}
+
+	// The staged bytes of the transfer do not count against the space it
+	// reserved, and committing it fits once the reservation is released.
+	tr, err := s.OpenTransfer(TransferState{ID: generateID(), Namespace: id, Key: "replica", Total: 600})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tr.Write(bytes.NewReader(make([]byte, 600))); err != nil {
+		t.Fatal(err)
+	}
+	release()
+	if _, err := tr.Commit(ObjectMeta{}); err != nil {
+		t.Fatalf("expected transfer to commit within its reservation: %s", err)
+	}
+
+	used, err := s.NamespaceUsage(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	capacity, err := s.Capacity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if used <= 600 || capacity.Used != used {
+		t.Errorf("expected only the committed object to be counted, have %d in the namespace and %+v", used, capacity)
+	}
+
+	if err := s.Delete(id, "replica"); err != nil {
+		t.Fatal(err)
+	}
+	if used, _ := s.NamespaceUsage(id); used >= 600 {
+		t.Errorf("expected deleted bytes to be released, have %d in use", used)
+	}
+}
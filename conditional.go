@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sync"
+)
+
+// ErrPreconditionFailed is returned when a conditional write is refused
+// because the current version of the file does not match its preconditions.
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// keyLockStripes is the number of locks writes are spread over by key.
+const keyLockStripes = 64
+
+// keyLocks serializes writes to the same key, given with its namespace, so a precondition cannot be
+// invalidated between being checked and the write it guards.
+type keyLocks [keyLockStripes]sync.Mutex
+
+// lock locks the stripe key belongs to and returns the function unlocking it.
+func (l *keyLocks) lock(key string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+
+	mu := &l[h.Sum32()%keyLockStripes]
+	mu.Lock()
+
+	return mu.Unlock
+}
+
+// ErrNotOwner is returned when a conditional write is sent to a node that
+// does not own its key.
+var ErrNotOwner = errors.New("not the owner of the key")
+
+// checkPreconditions checks the preconditions of a write against the current
+// version of the file with the given key in namespace ns held by this node,
+// which must own the key. Conditional writes to a key all have to go through
+// its owner, since that is the only node whose copy they are checked against;
+// elsewhere they fail with ErrNotOwner. The caller must hold the key's lock
+// until the write is done.
+func (s *FileServer) checkPreconditions(ns namespace, key string, opts WriteOptions) error {
+	if !opts.IfNoneMatch && opts.IfMatch.IsZero() {
+		return nil
+	}
+	if owner := s.keyOwner(ns, key); owner.ID != s.ID {
+		return fmt.Errorf("%w: (%s) is owned by node %s at %s", ErrNotOwner, key, owner.ID, owner.Addr)
+	}
+
+	current, exists := s.localVersion(ns.name, key)
+	exists = exists && !current.Deleted
+
+	if opts.IfNoneMatch && exists {
+		return fmt.Errorf("%w: (%s) already exists at version %s", ErrPreconditionFailed, key, current.Version)
+	}
+	if !opts.IfMatch.IsZero() {
+		if !exists {
+			return fmt.Errorf("%w: (%s) does not exist, want version %s", ErrPreconditionFailed, key, opts.IfMatch)
+		}
+		if current.Version != opts.IfMatch {
+			return fmt.Errorf("%w: (%s) is at version %s, want %s", ErrPreconditionFailed, key, current.Version, opts.IfMatch)
+		}
+	}
+
+	return nil
+}
+
+// localVersion returns the newest version of the file with the given key in
+// namespace ns held by this node, either as its own copy or as a replica of
+// a write made on another node. Tombstones are returned as well.
+func (s *FileServer) localVersion(ns string, key string) (ObjectMeta, bool) {
+	current, found := s.store.head(ns, key)
+	if replica, ok := s.store.head(ns, hashKey(key)); ok && (!found || newer(replica, current)) {
+		return replica, true
+	}
+	return current, found
+}
+
+// keyOwner returns the node owning the given key in namespace ns: out of this
+// node and the peers that are not draining, the one ranked first for the key
+// by unweighted rendezvous hashing, so every node agrees on it from the same
+// view of the cluster and it only moves when nodes join or leave.
+func (s *FileServer) keyOwner(ns namespace, key string) NodeInfo {
+	var (
+		owner NodeInfo
+		best  = -1.0
+	)
+	consider := func(info NodeInfo) {
+		if info.Draining {
+			return
+		}
+		if score := rendezvousScore(ns.name+"/"+key, info.ID, 1); score > best {
+			owner, best = info, score
+		}
+	}
+
+	consider(s.localInfo())
+	for _, peer := range s.peerList() {
+		consider(s.peerInfo(peer))
+	}
+	if best < 0 {
+		// Every node is draining, this one included.
+		return s.localInfo()
+	}
+	return owner
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/Dhruv-mak/godiststore/p2p"
+)
+
+// testNamespace is the namespace newTestServer is configured with.
+const testNamespace = "test"
+
+// newTestServer creates a FileServer with no peers whose transport is never
+// started, configured with testNamespace.
+func newTestServer(t *testing.T) *FileServer {
+	tr := p2p.NewTCPTransport(p2p.TCPTransportOpts{
+		ListenAddr:    ":0",
+		HandshakeFunc: p2p.NOPHandshakeFunc,
+		Decoder:       p2p.DefaultDecoder{},
+	})
+
+	return NewFileServer(FileServerOpts{
+		KeyProvider:       NewKeyring(newEncryptionKey()),
+		StorageRoot:       t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+		Transport:         tr,
+		Namespaces:        map[string]NamespaceOpts{testNamespace: {}},
+	})
+}
+
+func TestConditionalWrites(t *testing.T) {
+	s := newTestServer(t)
+	key := "lease"
+	createOnly := WriteOptions{IfNoneMatch: true}
+
+	first, err := s.StoreWithOptions(testNamespace, key, bytes.NewReader([]byte("owner a")), createOnly)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.StoreWithOptions(testNamespace, key, bytes.NewReader([]byte("owner b")), createOnly); !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("expected create-only write of existing key to fail, have %v", err)
+	}
+
+	second, err := s.StoreWithOptions(testNamespace, key, bytes.NewReader([]byte("owner a, renewed")), WriteOptions{IfMatch: first.Version})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !second.Version.After(first.Version) {
+		t.Errorf("expected %s to be after %s", second.Version, first.Version)
+	}
+
+	// The first version is stale now.
+	if _, err := s.StoreWithOptions(testNamespace, key, bytes.NewReader([]byte("owner c")), WriteOptions{IfMatch: first.Version}); !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("expected write against stale version to fail, have %v", err)
+	}
+
+	if _, err := s.StoreWithOptions(testNamespace, "missing", bytes.NewReader([]byte("x")), WriteOptions{IfMatch: first.Version}); !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("expected conditional write of missing key to fail, have %v", err)
+	}
+
+	meta, err := s.store.Stat(testNamespace, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.Version != second.Version {
+		t.Errorf("expected head at %s, have %s", second.Version, meta.Version)
+	}
+}
+
+func TestConditionalWritesGoThroughOwner(t *testing.T) {
+	servers := newTestCluster(t, 2)
+	a, b := servers[0], servers[1]
+	ns, _ := a.namespace(testNamespace)
+
+	// Find a key owned by b.
+	var key string
+	for i := 0; ; i++ {
+		key = fmt.Sprintf("lease-%d", i)
+		if a.keyOwner(ns, key).ID == b.ID {
+			break
+		}
+	}
+	if owner := b.keyOwner(ns, key); owner.ID != b.ID {
+		t.Fatalf("expected nodes to agree on the owner of (%s), b picked %s", key, owner.ID)
+	}
+
+	if _, err := a.StoreWithOptions(testNamespace, key, bytes.NewReader([]byte("a")), WriteOptions{IfNoneMatch: true}); !errors.Is(err, ErrNotOwner) {
+		t.Errorf("expected conditional write on a non-owner to fail with %s, have %v", ErrNotOwner, err)
+	}
+
+	// An unconditional write made on another node counts on the owner.
+	first, err := a.StoreWithOptions(testNamespace, key, bytes.NewReader([]byte("a")), WriteOptions{Consistency: ConsistencyAll})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.StoreWithOptions(testNamespace, key, bytes.NewReader([]byte("b")), WriteOptions{IfNoneMatch: true}); !errors.Is(err, ErrPreconditionFailed) {
+		t.Errorf("expected create-only write of a key written elsewhere to fail, have %v", err)
+	}
+	if _, err := b.StoreWithOptions(testNamespace, key, bytes.NewReader([]byte("b")), WriteOptions{IfMatch: first.Version}); err != nil {
+		t.Errorf("expected write against the version written elsewhere to succeed: %s", err)
+	}
+}
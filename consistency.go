@@ -0,0 +1,374 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/Dhruv-mak/godiststore/p2p"
+)
+
+// ConsistencyLevel is how many replicas have to take part in an operation
+// before it is considered successful.
+type ConsistencyLevel int
+
+const (
+	// ConsistencyOne is satisfied by a single replica.
+	ConsistencyOne ConsistencyLevel = iota
+	// ConsistencyQuorum is satisfied by a majority of the replicas.
+	ConsistencyQuorum
+	// ConsistencyAll requires every replica.
+	ConsistencyAll
+)
+
+// String implements fmt.Stringer.
+func (c ConsistencyLevel) String() string {
+	switch c {
+	case ConsistencyOne:
+		return "one"
+	case ConsistencyQuorum:
+		return "quorum"
+	case ConsistencyAll:
+		return "all"
+	}
+	return fmt.Sprintf("ConsistencyLevel(%d)", int(c))
+}
+
+// Required returns how many of n replicas satisfy the consistency level.
+func (c ConsistencyLevel) Required(n int) int {
+	switch c {
+	case ConsistencyAll:
+		return n
+	case ConsistencyQuorum:
+		return n/2 + 1
+	}
+	return 1
+}
+
+// ErrQuorumNotMet is returned when fewer replicas than the requested
+// consistency level requires acknowledged an operation.
+var ErrQuorumNotMet = errors.New("quorum not met")
+
+// WriteOptions holds the options of a single write.
+type WriteOptions struct {
+	// Consistency is how many replicas, the local copy included, have to
+	// durably persist the file before the write returns.
+	Consistency ConsistencyLevel
+	// IfMatch makes the write conditional on the current version of the
+	// file being exactly this one, for compare-and-swap updates.
+	IfMatch Version
+	// IfNoneMatch makes the write conditional on the file not existing yet,
+	// for create-only writes.
+	IfNoneMatch bool
+	// ExpiresAt makes the file expire at the given time, after which reads
+	// treat it as deleted and it is reaped. The zero time never expires.
+	ExpiresAt time.Time
+	// Token is the token the write is authorized with. It defaults to the
+	// Token of the server.
+	Token string
+}
+
+// ReplicaResult is the outcome of a write on a single replica.
+type ReplicaResult struct {
+	// Addr is the address of the replica, or the local listen address for
+	// the local copy.
+	Addr string
+	// Acked is set once the replica has confirmed the file is on disk.
+	Acked bool
+	// Err is set when the replica failed to store the file. Replicas that
+	// are neither acked nor failed were still in flight when the write
+	// returned.
+	Err error
+}
+
+// StoreResult describes which replicas persisted a write.
+type StoreResult struct {
+	// Version is the version the write created, to be used as the IfMatch
+	// precondition of the next conditional write.
+	Version  Version
+	Replicas []ReplicaResult
+	// Required is the number of acknowledgements the write waited for.
+	Required int
+}
+
+// Acked returns the number of replicas that acknowledged the write.
+func (r StoreResult) Acked() int {
+	n := 0
+	for _, replica := range r.Replicas {
+		if replica.Acked {
+			n++
+		}
+	}
+	return n
+}
+
+// ReadOptions holds the options of a single read.
+type ReadOptions struct {
+	// Consistency is how many replicas, the local copy included, are asked
+	// for their version of the file before the newest one is returned.
+	Consistency ConsistencyLevel
+	// Token is the token the read is authorized with. It defaults to the
+	// Token of the server.
+	Token string
+}
+
+// MessageStat asks a peer for the metadata of a file.
+type MessageStat struct {
+	Namespace string
+	Key       string
+}
+
+// MessageStatResponse answers MessageStat. Found is also set for a tombstone,
+// whose Meta is marked Deleted.
+type MessageStatResponse struct {
+	Found bool
+	Meta  ObjectMeta
+}
+
+// replicaVersion is the version of a file held by a single replica. A nil
+// peer stands for the local copy.
+type replicaVersion struct {
+	peer  p2p.Peer
+	found bool
+	meta  ObjectMeta
+}
+
+// newer reports whether a is a newer version of a file than b.
+func newer(a, b ObjectMeta) bool {
+	return a.Version.After(b.Version)
+}
+
+// sameVersion reports whether a and b are the same version of a file.
+func sameVersion(a, b ObjectMeta) bool {
+	return a.Version == b.Version && a.ContentHash == b.ContentHash
+}
+
+// GetWithOptions retrieves a file from namespace ns at the given read
+// consistency level.
+//
+// At ConsistencyOne the local copy is served whenever there is one. At higher
+// levels enough replicas to satisfy the level are asked for the version they
+// hold and the newest one is returned, fetching it from a peer if the local
+// copy is stale or missing. Replicas found to be stale or missing the file are
+// repaired in the background. If the newest version is a tombstone the read
+// fails with ErrDeleted and the tombstone is spread to the stale replicas
+// instead. Expired files fail with ErrDeleted as well.
+func (s *FileServer) GetWithOptions(ns string, key string, opts ReadOptions) (io.Reader, error) {
+	if err := s.authorize(opts.Token, ns, PermRead); err != nil {
+		return nil, err
+	}
+	namespace, err := s.namespace(ns)
+	if err != nil {
+		return nil, err
+	}
+	if opts.Consistency == ConsistencyOne {
+		return s.getOne(namespace, key)
+	}
+
+	versions, err := s.collectVersions(namespace, key, opts.Consistency)
+	if err != nil {
+		return nil, err
+	}
+
+	var newest *replicaVersion
+	for i := range versions {
+		v := &versions[i]
+		if v.found && (newest == nil || newer(v.meta, newest.meta)) {
+			newest = v
+		}
+	}
+	if newest == nil {
+		return nil, fmt.Errorf("file (%s) not found on any replica", key)
+	}
+
+	local := versions[0]
+	if newest.meta.Deleted {
+		return nil, s.repairDeletion(ns, key, newest.meta.Version, versions)
+	}
+	if newest.meta.Expired(time.Now()) {
+		return nil, fmt.Errorf("%w: (%s) expired at %s", ErrDeleted, key, newest.meta.ExpiresAt)
+	}
+	if !local.found || !sameVersion(local.meta, newest.meta) || s.store.Verify(ns, key) != nil {
+		if err := s.fetchVersion(namespace, key, newest.meta, versions); err != nil {
+			return nil, err
+		}
+	}
+
+	var stale []p2p.Peer
+	for _, v := range versions[1:] {
+		if !v.found || !sameVersion(v.meta, newest.meta) {
+			stale = append(stale, v.peer)
+		}
+	}
+	if len(stale) > 0 {
+		go s.readRepair(namespace, key, stale)
+	}
+
+	fmt.Printf("[%s] serving file (%s) read at consistency %s\n", s.Transport.Addr(), key, opts.Consistency)
+
+	_, r, err := s.store.Read(ns, key)
+	return r, err
+}
+
+// collectVersions asks replicas for the version of a file they hold until
+// enough of them, the local copy included, have answered to satisfy level.
+// The local version always comes first.
+//
+// Replicas are placed relative to the node that wrote the file, which this
+// node cannot tell from its own view of the cluster, so every peer is asked.
+// Without a ReplicationFactor, or with one that covers the whole cluster,
+// every node holds the file and every answer counts. Otherwise only the
+// nodes that report holding a version of the file count towards the
+// ReplicationFactor, and the others are left out of the result so read
+// repair does not send them copies. The node that wrote the file keeps it in
+// plaintext, which its peers cannot ask for by the hashed key, so a node
+// without a plaintext copy can reach one holder fewer.
+func (s *FileServer) collectVersions(ns namespace, key string, level ConsistencyLevel) ([]replicaVersion, error) {
+	local := replicaVersion{}
+	local.meta, local.found = s.store.head(ns.name, key)
+	versions := []replicaVersion{local}
+
+	peers := s.peerList()
+	everyNodeHolds := ns.ReplicationFactor <= 0 || ns.ReplicationFactor >= 1+len(peers)
+
+	var required, counted int
+	if everyNodeHolds {
+		required = level.Required(1 + len(peers))
+		counted = 1
+	} else {
+		reachable := ns.ReplicationFactor
+		if !local.found {
+			reachable--
+		}
+		required = min(level.Required(ns.ReplicationFactor), max(reachable, 1))
+		if _, holdsReplica := s.store.head(ns.name, hashKey(key)); local.found || holdsReplica {
+			counted = 1
+		}
+	}
+
+	type answer struct {
+		version replicaVersion
+		err     error
+	}
+	answers := make(chan answer, len(peers))
+	for _, peer := range peers {
+		go func(peer p2p.Peer) {
+			resp, err := s.request(peer, MessageStat{Namespace: ns.name, Key: hashKey(key)})
+			if err != nil {
+				answers <- answer{err: err}
+				return
+			}
+			stat, ok := resp.(MessageStatResponse)
+			if !ok {
+				answers <- answer{err: fmt.Errorf("unexpected response %T to stat request", resp)}
+				return
+			}
+			answers <- answer{version: replicaVersion{peer: peer, found: stat.Found, meta: stat.Meta}}
+		}(peer)
+	}
+
+	failed := 0
+	for outstanding := len(peers); outstanding > 0 && counted < required; outstanding-- {
+		a := <-answers
+		if a.err != nil {
+			log.Printf("[%s] stat of (%s) failed: %s", s.Transport.Addr(), key, a.err)
+			failed++
+			continue
+		}
+		if a.version.found || everyNodeHolds {
+			versions = append(versions, a.version)
+			counted++
+		}
+	}
+
+	// A file that no node reports holding is left for the caller to report
+	// as missing, unless nodes that failed to answer may hold it.
+	if counted < required && (everyNodeHolds || failed > 0 || counted > 0) {
+		return nil, fmt.Errorf("%w: %d of %d replicas answered for (%s) at consistency %s", ErrQuorumNotMet, counted, required, key, level)
+	}
+
+	return versions, nil
+}
+
+// fetchVersion replaces the local copy of a file with the given version from
+// one of the peers that reported holding it.
+func (s *FileServer) fetchVersion(ns namespace, key string, want ObjectMeta, versions []replicaVersion) error {
+	var candidates []p2p.Peer
+	for _, v := range versions[1:] {
+		if v.found && sameVersion(v.meta, want) {
+			candidates = append(candidates, v.peer)
+		}
+	}
+
+	lastErr := fmt.Errorf("no replica holds the newest version of (%s)", key)
+	for _, peer := range candidates {
+		n, err := s.fetchFile(peer, ns, key)
+		if err != nil {
+			log.Printf("[%s] fetching (%s) from %s failed: %s", s.Transport.Addr(), key, peer.RemoteAddr(), err)
+			lastErr = err
+			continue
+		}
+
+		fmt.Printf("[%s] received newest version of (%s), (%d) bytes from (%s)\n", s.Transport.Addr(), key, n, peer.RemoteAddr())
+		return nil
+	}
+
+	return lastErr
+}
+
+// readRepair sends the local copy of a file, which must be the newest
+// version, to replicas that were found holding a stale copy or none at all.
+func (s *FileServer) readRepair(ns namespace, key string, peers []p2p.Peer) {
+	u, err := s.newUpload(ns, key)
+	if err != nil {
+		log.Printf("[%s] read repair of (%s) failed: %s", s.Transport.Addr(), key, err)
+		return
+	}
+
+	for _, peer := range peers {
+		if err := s.sendUpload(peer, u); err != nil {
+			log.Printf("[%s] read repair of (%s) on %s failed: %s", s.Transport.Addr(), key, peer.RemoteAddr(), err)
+			continue
+		}
+		fmt.Printf("[%s] repaired stale replica of (%s) on %s\n", s.Transport.Addr(), key, peer.RemoteAddr())
+	}
+}
+
+// repairDeletion brings the local copy and the replicas that missed the
+// deletion of a file up to its tombstone, and returns the error reporting the
+// file as deleted.
+func (s *FileServer) repairDeletion(ns string, key string, version Version, versions []replicaVersion) error {
+	if local := versions[0]; !local.found || local.meta.Version != version {
+		if err := s.store.Tombstone(ns, key, version); err != nil {
+			return err
+		}
+	}
+
+	var stale []p2p.Peer
+	for _, v := range versions[1:] {
+		if !v.found || v.meta.Version != version {
+			stale = append(stale, v.peer)
+		}
+	}
+	if len(stale) > 0 {
+		go func() {
+			for _, peer := range stale {
+				if err := s.sendTombstone(peer, ns, key, version); err != nil {
+					log.Printf("[%s] spreading tombstone of (%s) to %s failed: %s", s.Transport.Addr(), key, peer.RemoteAddr(), err)
+				}
+			}
+		}()
+	}
+
+	return fmt.Errorf("%w: (%s) at version %s", ErrDeleted, key, version)
+}
+
+// handleMessageStat answers a request for the metadata of a file.
+func (s *FileServer) handleMessageStat(from string, requestID string, msg MessageStat) error {
+	var resp MessageStatResponse
+	resp.Meta, resp.Found = s.store.head(msg.Namespace, msg.Key)
+
+	return s.reply(from, requestID, resp)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestConsistencyLevelRequired(t *testing.T) {
+	tests := []struct {
+		level ConsistencyLevel
+		n     int
+		want  int
+	}{
+		{ConsistencyOne, 3, 1},
+		{ConsistencyQuorum, 1, 1},
+		{ConsistencyQuorum, 2, 2},
+		{ConsistencyQuorum, 3, 2},
+		{ConsistencyQuorum, 4, 3},
+		{ConsistencyQuorum, 5, 3},
+		{ConsistencyAll, 3, 3},
+	}
+
+	for _, tt := range tests {
+		if have := tt.level.Required(tt.n); have != tt.want {
+			t.Errorf("%s of %d: have %d want %d", tt.level, tt.n, have, tt.want)
+		}
+	}
+}
+
+func TestQuorumReadReturnsNewest(t *testing.T) {
+	servers := newTestCluster(t, 3)
+	a, b := servers[0], servers[1]
+	write := WriteOptions{Consistency: ConsistencyAll}
+
+	if _, err := a.StoreWithOptions(testNamespace, "key", bytes.NewReader([]byte("first")), write); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.StoreWithOptions(testNamespace, "key", bytes.NewReader([]byte("second")), write); err != nil {
+		t.Fatal(err)
+	}
+
+	// The plaintext copy a wrote is stale; the newest version is fetched
+	// from a replica.
+	r, err := a.GetWithOptions(testNamespace, "key", ReadOptions{Consistency: ConsistencyAll})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := io.ReadAll(r); string(data) != "second" {
+		t.Errorf("expected the newest version to be read, have %s", data)
+	}
+}
+
+func TestReadRepair(t *testing.T) {
+	servers := newTestCluster(t, 3)
+	a, b, c := servers[0], servers[1], servers[2]
+
+	if _, err := a.StoreWithOptions(testNamespace, "key", bytes.NewReader([]byte("first")), WriteOptions{Consistency: ConsistencyAll}); err != nil {
+		t.Fatal(err)
+	}
+	// c refuses the second version while it is draining.
+	c.draining.Store(true)
+	result, err := a.StoreWithOptions(testNamespace, "key", bytes.NewReader([]byte("second")), WriteOptions{Consistency: ConsistencyAll})
+	if !errors.Is(err, ErrQuorumNotMet) {
+		t.Fatalf("expected write to fail with %s, have %v", ErrQuorumNotMet, err)
+	}
+	c.draining.Store(false)
+	waitFor(t, "b to acknowledge the second version", func() bool {
+		meta, _ := b.store.head(testNamespace, hashKey("key"))
+		return meta.Version == result.Version
+	})
+	if meta, _ := c.store.head(testNamespace, hashKey("key")); meta.Version == result.Version {
+		t.Fatalf("expected c to hold a stale replica")
+	}
+
+	r, err := a.GetWithOptions(testNamespace, "key", ReadOptions{Consistency: ConsistencyAll})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := io.ReadAll(r); string(data) != "second" {
+		t.Errorf("expected the newest version to be read, have %s", data)
+	}
+	waitFor(t, "the stale replica to be repaired", func() bool {
+		meta, _ := c.store.head(testNamespace, hashKey("key"))
+		return meta.Version == result.Version
+	})
+}
+
+func TestRepairDeletion(t *testing.T) {
+	servers := newTestCluster(t, 3)
+	a, b, c := servers[0], servers[1], servers[2]
+
+	result, err := a.StoreWithOptions(testNamespace, "key", bytes.NewReader([]byte("data")), WriteOptions{Consistency: ConsistencyAll})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The deletion reached a and b but not c.
+	deleted := Version{WallTime: result.Version.WallTime + 1, NodeID: a.ID}
+	if err := a.store.Tombstone(testNamespace, "key", deleted); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.store.Tombstone(testNamespace, hashKey("key"), deleted); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := a.GetWithOptions(testNamespace, "key", ReadOptions{Consistency: ConsistencyAll}); !errors.Is(err, ErrDeleted) {
+		t.Fatalf("expected read to fail with %s, have %v", ErrDeleted, err)
+	}
+	waitFor(t, "the tombstone to reach c", func() bool {
+		meta, _ := c.store.head(testNamespace, hashKey("key"))
+		return meta.Deleted && meta.Version == deleted
+	})
+}
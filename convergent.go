@@ -0,0 +1,44 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// errNoConvergenceSecret is returned when a file of a namespace using
+// convergent encryption is replicated by a node without a ConvergenceSecret.
+var errNoConvergenceSecret = errors.New("convergent encryption needs a convergence secret")
+
+// Replicas are normally encrypted under a random data key and IV, so the same
+// file stored twice gives two different ciphertexts. Namespaces whose policy
+// asks for convergent encryption derive both from the content hash of the
+// file and the ConvergenceSecret of the cluster instead, so identical files
+// in the namespace encrypt to identical replicas.
+//
+// That is all it does: the store still keeps a replica per key, so identical
+// files under different keys take as much space as different ones. The
+// identical ciphertexts only pay off below the store, in a filesystem or
+// backup that deduplicates by content.
+//
+// The price is that anyone holding the secret can tell which replicas hold
+// the same file, and confirm a guess of what a replica holds. The secret is
+// mixed with the namespace name, so equal files in different namespaces
+// still encrypt differently.
+
+// convergentKey returns the data key and IV of a replica of a file with the
+// given content hash in namespace ns under convergent encryption.
+func convergentKey(secret []byte, ns string, contentHash string) ([]byte, []byte, error) {
+	if len(secret) == 0 {
+		return nil, nil, fmt.Errorf("%w: namespace (%s)", errNoConvergenceSecret, ns)
+	}
+
+	derive := func(purpose string) []byte {
+		mac := hmac.New(sha256.New, secret)
+		mac.Write([]byte("convergent/" + purpose + "/" + ns + "/" + contentHash))
+		return mac.Sum(nil)
+	}
+
+	return derive("key"), derive("iv")[:aesBlockSize], nil
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestConvergentEncryption(t *testing.T) {
+	keys := NewKeyring(newEncryptionKey())
+	namespaces := map[string]NamespaceOpts{
+		"convergent": {Policy: &NamespacePolicy{Convergent: true}},
+		"random":     {},
+	}
+	writer := newNamespaceServer(t, keys, namespaces)
+	reader := newNamespaceServer(t, keys, namespaces)
+	writer.ConvergenceSecret = newEncryptionKey()
+
+	data := []byte("the same attachment, sent twice")
+	for _, ns := range []string{"convergent", "random"} {
+		for _, key := range []string{"first", "second"} {
+			if err := writer.Store(ns, key, bytes.NewReader(data)); err != nil {
+				t.Fatal(err)
+			}
+			handReplica(t, writer, reader, ns, key)
+		}
+	}
+	if err := writer.Store("convergent", "other", bytes.NewReader([]byte("another attachment"))); err != nil {
+		t.Fatal(err)
+	}
+	handReplica(t, writer, reader, "convergent", "other")
+
+	checksum := func(ns string, key string) string {
+		meta, ok := reader.store.head(ns, hashKey(key))
+		if !ok {
+			t.Fatalf("expected reader to hold a replica of (%s) in %s", key, ns)
+		}
+		return meta.Checksum
+	}
+	if checksum("convergent", "first") != checksum("convergent", "second") {
+		t.Errorf("expected identical files to give identical replicas")
+	}
+	if checksum("convergent", "first") == checksum("convergent", "other") {
+		t.Errorf("expected different files to give different replicas")
+	}
+	if checksum("random", "first") == checksum("random", "second") {
+		t.Errorf("expected replicas to differ without convergent encryption")
+	}
+
+	got, err := reader.Get("convergent", "second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(got); !bytes.Equal(b, data) {
+		t.Errorf("expected %s, have %s", data, b)
+	}
+}
+
+func TestConvergentKey(t *testing.T) {
+	secret := newEncryptionKey()
+
+	key, iv, err := convergentKey(secret, "convergent", "hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(key) != 32 || len(iv) != aesBlockSize {
+		t.Errorf("expected a 32 byte key and a %d byte IV, have %d and %d", aesBlockSize, len(key), len(iv))
+	}
+
+	otherKey, _, _ := convergentKey(secret, "other", "hash")
+	if bytes.Equal(key, otherKey) {
+		t.Errorf("expected keys to differ between namespaces")
+	}
+	otherKey, _, _ = convergentKey(newEncryptionKey(), "convergent", "hash")
+	if bytes.Equal(key, otherKey) {
+		t.Errorf("expected keys to differ between secrets")
+	}
+
+	if _, _, err := convergentKey(nil, "convergent", "hash"); !errors.Is(err, errNoConvergenceSecret) {
+		t.Errorf("expected derivation without a secret to fail with %s, have %v", errNoConvergenceSecret, err)
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"crypto/aes"
 	"crypto/cipher"
 	"crypto/md5"
@@ -9,6 +10,9 @@ import (
 	"io"
 )
 
+// aesBlockSize is the size of the IV prepended to every encrypted stream.
+const aesBlockSize = aes.BlockSize
+
 // generateID generates a random 32-byte ID and returns it as a hex-encoded string.
 func generateID() string {
 	buf := make([]byte, 32)
@@ -107,3 +111,74 @@ func copyEncrypt(key []byte, src io.Reader, dst io.Writer) (int, error) {
 	stream := cipher.NewCTR(block, iv)
 	return copyStream(stream, block.BlockSize(), src, dst)
 }
+
+// newCTRAt returns an AES-CTR stream positioned offset bytes into the
+// keystream that starts at iv. Since every block of CTR mode is encrypted
+// independently, this lets a slice of a file be decrypted without reading
+// anything that comes before it.
+func newCTRAt(block cipher.Block, iv []byte, offset int64) cipher.Stream {
+	var (
+		blockSize = int64(block.BlockSize())
+		counter   = make([]byte, len(iv))
+		carry     = uint64(offset / blockSize)
+	)
+	copy(counter, iv)
+
+	// The IV is a big endian counter, advance it by the number of whole
+	// blocks being skipped.
+	for i := len(counter) - 1; i >= 0 && carry > 0; i-- {
+		sum := uint64(counter[i]) + carry&0xff
+		counter[i] = byte(sum)
+		carry = carry>>8 + sum>>8
+	}
+
+	stream := cipher.NewCTR(block, counter)
+	if skip := offset % blockSize; skip > 0 {
+		discard := make([]byte, skip)
+		stream.XORKeyStream(discard, discard)
+	}
+
+	return stream
+}
+
+// copyDecryptAt decrypts data from the src reader, which must start offset
+// bytes into the plaintext of a stream encrypted by copyEncrypt with the given
+// iv, and writes the decrypted data to the dst writer.
+func copyDecryptAt(key []byte, iv []byte, offset int64, src io.Reader, dst io.Writer) (int, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return 0, err
+	}
+
+	stream := newCTRAt(block, iv, offset)
+	return copyStream(stream, 0, src, dst)
+}
+
+// newEncryptReaderAt returns a reader of the stream copyEncrypt would produce
+// for the size bytes of src with the given iv, starting offset bytes into it.
+// Offsets below the IV size start within the IV itself.
+func newEncryptReaderAt(key []byte, iv []byte, src io.ReaderAt, size int64, offset int64) (io.Reader, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		readers []io.Reader
+		start   = offset - int64(len(iv))
+	)
+	if start < 0 {
+		readers = append(readers, bytes.NewReader(iv[offset:]))
+		start = 0
+	}
+	if start > size {
+		start = size
+	}
+
+	readers = append(readers, cipher.StreamReader{
+		S: newCTRAt(block, iv, start),
+		R: io.NewSectionReader(src, start, size-start),
+	})
+
+	return io.MultiReader(readers...), nil
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"io"
 	"testing"
 )
 
@@ -33,3 +34,63 @@ func TestCopyEncryptDecrypt(t *testing.T) {
 		t.Errorf("decryption failed!!!")
 	}
 }
+
+func TestCopyDecryptAt(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 1100)
+	key := newEncryptionKey()
+	dst := new(bytes.Buffer)
+	if _, err := copyEncrypt(key, bytes.NewReader(payload), dst); err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		encrypted  = dst.Bytes()
+		iv         = encrypted[:aesBlockSize]
+		ciphertext = encrypted[aesBlockSize:]
+	)
+
+	ranges := [][2]int{{0, 10}, {37, 20}, {16, 16}, {4095, 300}, {len(payload) - 5, 5}}
+	for _, r := range ranges {
+		offset, length := r[0], r[1]
+		out := new(bytes.Buffer)
+		src := bytes.NewReader(ciphertext[offset : offset+length])
+		if _, err := copyDecryptAt(key, iv, int64(offset), src, out); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(out.Bytes(), payload[offset:offset+length]) {
+			t.Errorf("decrypting range [%d, %d) failed", offset, offset+length)
+		}
+	}
+}
+
+func TestEncryptReaderAt(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 100)
+	key := newEncryptionKey()
+	iv := make([]byte, aesBlockSize)
+	copy(iv, "sixteen byte iv!")
+
+	r, err := newEncryptReaderAt(key, iv, bytes.NewReader(payload), int64(len(payload)), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	full, _ := io.ReadAll(r)
+
+	out := new(bytes.Buffer)
+	if _, err := copyDecrypt(key, bytes.NewReader(full), out); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out.Bytes(), payload) {
+		t.Fatalf("decrypting encrypted reader failed")
+	}
+
+	for _, offset := range []int{5, 16, 100, len(full)} {
+		r, err := newEncryptReaderAt(key, iv, bytes.NewReader(payload), int64(len(payload)), int64(offset))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(r)
+		if !bytes.Equal(b, full[offset:]) {
+			t.Errorf("encrypted stream from offset %d does not match", offset)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/Dhruv-mak/godiststore/p2p"
+)
+
+// Replicas are encrypted with envelope encryption: every file gets a random
+// data key of its own, which is wrapped with the master key of its namespace
+// and recorded in the metadata of the replica, along with the ID of the
+// master key. Rotating the master key then only takes re-wrapping the data
+// keys, while the bodies of the replicas stay as they are.
+
+// wrapKey encrypts dataKey with kek using AES-GCM, which authenticates it
+// along with context, so a data key unwrapped with the wrong master key or
+// for another context is caught rather than used. The random nonce is
+// prepended to the result.
+func wrapKey(kek []byte, dataKey []byte, context string) ([]byte, error) {
+	gcm, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, dataKey, []byte(context)), nil
+}
+
+// unwrapKey decrypts a data key wrapped by wrapKey.
+func unwrapKey(kek []byte, wrapped []byte, context string) ([]byte, error) {
+	gcm, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < gcm.NonceSize() {
+		return nil, errors.New("wrapped data key is too short")
+	}
+
+	nonce, sealed := wrapped[:gcm.NonceSize()], wrapped[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, sealed, []byte(context))
+}
+
+// newGCM returns AES-GCM with the given key.
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// RewrapStats counts the replicas RewrapKeys looked at.
+type RewrapStats struct {
+	Checked   int
+	Rewrapped int
+	Failed    int
+}
+
+// RewrapKeys re-wraps the data keys that were wrapped with a retired master
+// key with the current master key of their namespace, for every namespace
+// this node is configured with. That covers the replicas this node holds,
+// their history included, and the replicas held by its peers of the files it
+// holds in plaintext. The replicas themselves are not re-encrypted.
+//
+// A retired key can be dropped from the KeyProvider once every node serving
+// its namespace has re-wrapped its keys.
+func (s *FileServer) RewrapKeys() (RewrapStats, error) {
+	var stats RewrapStats
+	for _, name := range s.namespaceNames() {
+		ns, err := s.namespace(name)
+		if err != nil {
+			return stats, err
+		}
+		current, err := ns.currentKeyID()
+		if err != nil {
+			return stats, err
+		}
+
+		heads, err := s.store.heads(name)
+		if err != nil {
+			return stats, err
+		}
+		for _, head := range heads {
+			if head.Deleted {
+				continue
+			}
+			if !head.Replica {
+				s.rewrapRemote(&stats, ns, current, head.Key)
+				continue
+			}
+
+			versions, err := s.store.ListVersions(name, head.Key)
+			if err != nil {
+				log.Printf("[%s] listing versions of (%s) failed: %s", s.Transport.Addr(), head.Key, err)
+				stats.Failed++
+				continue
+			}
+			for _, meta := range versions {
+				if meta.Deleted {
+					continue
+				}
+				stats.Checked++
+				if meta.KeyID == current {
+					continue
+				}
+				if err := s.rewrapLocal(ns, meta); err != nil {
+					log.Printf("[%s] re-wrapping data key of (%s) failed: %s", s.Transport.Addr(), meta.Key, err)
+					stats.Failed++
+					continue
+				}
+				stats.Rewrapped++
+			}
+		}
+	}
+
+	fmt.Printf("[%s] re-wrapped data keys: %+v\n", s.Transport.Addr(), stats)
+
+	return stats, nil
+}
+
+// rewrapLocal re-wraps the data key of the version of a replica held on this
+// node described by meta.
+func (s *FileServer) rewrapLocal(ns namespace, meta ObjectMeta) error {
+	dataKey, err := ns.unwrapKey(meta.KeyID, meta.WrappedKey)
+	if err != nil {
+		return err
+	}
+	id, wrapped, err := ns.wrapKey(dataKey)
+	if err != nil {
+		return err
+	}
+	return s.store.rewrapKey(ns.name, meta.Key, meta.Version, id, wrapped)
+}
+
+// rewrapRemote re-wraps the data keys of the replicas of the file with the
+// given key in namespace ns held by peers, unless they are wrapped with the
+// master key with the current ID already. The replicas were placed by the
+// node that wrote the file, from its view of the cluster at the time, so
+// every peer is asked whether it holds one. Peers may not hold the master
+// keys of the namespace, which is why this node re-wraps for them.
+func (s *FileServer) rewrapRemote(stats *RewrapStats, ns namespace, current string, key string) {
+	for _, peer := range s.peerList() {
+		resp, err := s.request(peer, MessageStat{Namespace: ns.name, Key: hashKey(key)})
+		if err != nil {
+			log.Printf("[%s] checking (%s) on %s failed: %s", s.Transport.Addr(), key, peer.RemoteAddr(), err)
+			stats.Failed++
+			continue
+		}
+		stat, ok := resp.(MessageStatResponse)
+		if !ok || !stat.Found || stat.Meta.Deleted {
+			continue
+		}
+		stats.Checked++
+		if stat.Meta.KeyID == current {
+			continue
+		}
+
+		if err := s.sendRewrap(peer, ns, stat.Meta); err != nil {
+			log.Printf("[%s] re-wrapping data key of (%s) on %s failed: %s", s.Transport.Addr(), key, peer.RemoteAddr(), err)
+			stats.Failed++
+			continue
+		}
+		stats.Rewrapped++
+	}
+}
+
+// sendRewrap re-wraps the data key of the replica described by meta and
+// sends it to the peer holding the replica.
+func (s *FileServer) sendRewrap(peer p2p.Peer, ns namespace, meta ObjectMeta) error {
+	dataKey, err := ns.unwrapKey(meta.KeyID, meta.WrappedKey)
+	if err != nil {
+		return err
+	}
+	id, wrapped, err := ns.wrapKey(dataKey)
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.request(peer, MessageRewrapKey{
+		Namespace:  ns.name,
+		Key:        meta.Key,
+		Version:    meta.Version,
+		KeyID:      id,
+		WrappedKey: wrapped,
+	})
+	if err != nil {
+		return err
+	}
+	ack, ok := resp.(MessageRewrapKeyResponse)
+	if !ok {
+		return fmt.Errorf("unexpected response %T to rewrap request", resp)
+	}
+	if len(ack.Err) > 0 {
+		return errors.New(ack.Err)
+	}
+	return nil
+}
+
+// MessageRewrapKey replaces the wrapped data key of a version of a replica
+// held by the receiver.
+type MessageRewrapKey struct {
+	Namespace  string
+	Key        string
+	Version    Version
+	KeyID      string
+	WrappedKey []byte
+}
+
+// MessageRewrapKeyResponse answers MessageRewrapKey.
+type MessageRewrapKeyResponse struct {
+	Err string
+}
+
+// handleMessageRewrapKey handles a request to replace the wrapped data key of
+// a replica. The receiver cannot check the new wrapping, since it may not
+// hold the master keys of the namespace.
+func (s *FileServer) handleMessageRewrapKey(from string, requestID string, msg MessageRewrapKey) error {
+	var resp MessageRewrapKeyResponse
+	if err := s.store.rewrapKey(msg.Namespace, msg.Key, msg.Version, msg.KeyID, msg.WrappedKey); err != nil {
+		resp.Err = err.Error()
+	}
+	return s.reply(from, requestID, resp)
+}
+
+// rewrapKey replaces the wrapped data key recorded for the given version of
+// the replica with the given key, leaving the replica itself untouched.
+func (s *Store) rewrapKey(id string, key string, version Version, keyID string, wrapped []byte) error {
+	if err := s.checkKey(id, key); err != nil {
+		return err
+	}
+	defer s.markBusy(s.objectName(id, key))()
+
+	name := s.objectName(id, key)
+	if head, ok := s.head(id, key); !ok || head.Version != version {
+		name = s.versionName(id, key, version)
+	}
+
+	meta, err := s.readMetaBlob(name + metaSuffix)
+	if err != nil {
+		return err
+	}
+	if !meta.Replica || meta.Version != version {
+		return fmt.Errorf("no replica of (%s) at version %s", key, version)
+	}
+
+	meta.KeyID, meta.WrappedKey = keyID, wrapped
+	return s.writeMetaBlob(name+metaSuffix, meta)
+}
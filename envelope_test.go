@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestWrapKey(t *testing.T) {
+	kek, dataKey := newEncryptionKey(), newEncryptionKey()
+
+	wrapped, err := wrapKey(kek, dataKey, "photos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(wrapped, dataKey) {
+		t.Errorf("expected wrapped data key not to contain the data key")
+	}
+
+	have, err := unwrapKey(kek, wrapped, "photos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, dataKey) {
+		t.Errorf("expected unwrapped key to equal the data key")
+	}
+
+	if _, err := unwrapKey(newEncryptionKey(), wrapped, "photos"); err == nil {
+		t.Errorf("expected unwrap with the wrong key to fail")
+	}
+	if _, err := unwrapKey(kek, wrapped, "invoices"); err == nil {
+		t.Errorf("expected unwrap for another namespace to fail")
+	}
+}
+
+func TestRewrapKeys(t *testing.T) {
+	oldMaster, newMaster := newEncryptionKey(), newEncryptionKey()
+	namespaces := map[string]NamespaceOpts{"shared": {}}
+	writer := newNamespaceServer(t, NewKeyring(oldMaster), namespaces)
+	reader := newNamespaceServer(t, NewKeyring(oldMaster), namespaces)
+
+	data := []byte("outlives its master key")
+	if err := writer.Store("shared", "key", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	handReplica(t, writer, reader, "shared", "key")
+	before, _ := reader.store.head("shared", hashKey("key"))
+
+	// Rotate the master key of the reader.
+	reader.KeyProvider = NewKeyring(newMaster, oldMaster)
+
+	stats, err := reader.RewrapKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != (RewrapStats{Checked: 1, Rewrapped: 1}) {
+		t.Errorf("expected one data key to be re-wrapped, have %+v", stats)
+	}
+
+	after, _ := reader.store.head("shared", hashKey("key"))
+	if after.KeyID != keyID(newMaster) {
+		t.Errorf("expected data key to be wrapped with the new master key, have %s", after.KeyID)
+	}
+	if after.Checksum != before.Checksum || after.Version != before.Version {
+		t.Errorf("expected replica to be left as it was, have %+v, want %+v", after, before)
+	}
+
+	// The retired key is no longer needed to read the replica.
+	reader.KeyProvider = NewKeyring(newMaster)
+	got, err := reader.Get("shared", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(got); !bytes.Equal(b, data) {
+		t.Errorf("expected %s, have %s", data, b)
+	}
+}
+
+func TestReplicaNeedsItsMasterKey(t *testing.T) {
+	namespaces := map[string]NamespaceOpts{"shared": {}}
+	writer := newNamespaceServer(t, NewKeyring(newEncryptionKey()), namespaces)
+	reader := newNamespaceServer(t, NewKeyring(newEncryptionKey()), namespaces)
+
+	if err := writer.Store("shared", "key", bytes.NewReader([]byte("data"))); err != nil {
+		t.Fatal(err)
+	}
+	handReplica(t, writer, reader, "shared", "key")
+
+	meta, _ := reader.store.head("shared", hashKey("key"))
+	ns, _ := reader.namespace("shared")
+	if _, err := reader.decryptReplica(ns, "key", meta); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("expected replica wrapped with another master key to fail with %s, have %v", ErrUnknownKey, err)
+	}
+}
+
+func TestRewrapKeysAsksEveryPeer(t *testing.T) {
+	servers := newTestCluster(t, 3)
+	writer := servers[0]
+
+	keyring := writer.KeyProvider.(*Keyring)
+	oldMaster := keyring.keys[keyring.current]
+	if _, err := writer.StoreWithOptions(testNamespace, "key", bytes.NewReader([]byte("data")), WriteOptions{Consistency: ConsistencyAll}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The cluster has shrunk the replication factor since the file was
+	// written, so one of the replicas is no longer placed on its holder.
+	writer.ReplicationFactor = 2
+	ns, err := writer.namespace(testNamespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(writer.replicaPeers(ns, "key")) != 1 {
+		t.Fatalf("expected the file to be placed on one peer")
+	}
+
+	newMaster := newEncryptionKey()
+	writer.KeyProvider = NewKeyring(newMaster, oldMaster)
+	stats, err := writer.RewrapKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != (RewrapStats{Checked: 2, Rewrapped: 2}) {
+		t.Errorf("expected the data keys of both replicas to be re-wrapped, have %+v", stats)
+	}
+	for _, s := range servers[1:] {
+		if meta, _ := s.store.head(testNamespace, hashKey("key")); meta.KeyID != keyID(newMaster) {
+			t.Errorf("expected the replica on %s to be wrapped with the new master key, have %s", s.Transport.Addr(), meta.KeyID)
+		}
+	}
+}
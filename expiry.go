@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// defaultReapInterval is how often expired objects are reaped by default.
+const defaultReapInterval = time.Minute
+
+// expiredObject is an object found to have expired by Store.expiredObjects.
+type expiredObject struct {
+	id   string
+	meta ObjectMeta
+}
+
+// expiredObjects returns the objects of every namespace that have expired at
+// the given time and have not been reaped yet.
+func (s *Store) expiredObjects(now time.Time) ([]expiredObject, error) {
+	ids, err := s.Namespaces()
+	if err != nil {
+		return nil, err
+	}
+
+	var expired []expiredObject
+	for _, id := range ids {
+		err := s.walk(id, func(name string, base string) error {
+			meta, err := s.readMetaBlob(name + metaSuffix)
+			if err == nil && !meta.Deleted && meta.Expired(now) {
+				expired = append(expired, expiredObject{id: id, meta: meta})
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return expired, nil
+}
+
+// expiryVersion returns the version of the tombstone that replaces an object
+// at the given version once it expires. It sorts right after that version and
+// before any later write, and every node derives the same one, so replicas
+// reaped independently end up with the same tombstone.
+func expiryVersion(v Version) Version {
+	v.NodeID += expirySuffix
+	return v
+}
+
+// expirySuffix marks the versions returned by expiryVersion.
+const expirySuffix = ".expired"
+
+// isExpiryVersion reports whether v is the version of a tombstone written by
+// reaping an expired object.
+func isExpiryVersion(v Version) bool {
+	return strings.HasSuffix(v.NodeID, expirySuffix)
+}
+
+// reapExpired replaces every object that has expired with a tombstone and
+// drops its history, so no version of it can be read back. Every node reaps
+// the replicas it holds on its own; a node holding a plaintext copy of a file
+// also sends the tombstone to its peers, so nodes that missed the write
+// setting the expiry still learn about it.
+func (s *FileServer) reapExpired(now time.Time) error {
+	expired, err := s.store.expiredObjects(now)
+	if err != nil {
+		return err
+	}
+
+	for _, obj := range expired {
+		version := expiryVersion(obj.meta.Version)
+
+		unlock := s.keyLocks.lock(obj.id + "/" + obj.meta.Key)
+		err := s.store.Tombstone(obj.id, obj.meta.Key, version)
+		if err == nil {
+			err = s.store.purgeHistory(obj.id, obj.meta.Key)
+		}
+		unlock()
+		if err != nil {
+			log.Printf("[%s] reaping (%s) failed: %s", s.Transport.Addr(), obj.meta.Key, err)
+			continue
+		}
+
+		fmt.Printf("[%s] reaped file (%s) expired at %s\n", s.Transport.Addr(), obj.meta.Key, obj.meta.ExpiresAt)
+
+		if obj.meta.Replica {
+			continue
+		}
+		for _, peer := range s.peerList() {
+			msg := MessageDeleteFile{Namespace: obj.id, Key: hashKey(obj.meta.Key), Version: version}
+			go func() {
+				if err := s.sendDelete(peer, msg); err != nil {
+					log.Printf("[%s] sending tombstone of (%s) to %s failed, will retry on reconnect: %s", s.Transport.Addr(), obj.meta.Key, peer.RemoteAddr(), err)
+					s.deferDelete(peer.RemoteAddr().String(), msg)
+				}
+			}()
+		}
+	}
+
+	return nil
+}
+
+// reap reaps expired objects every ReapInterval until the server is stopped.
+func (s *FileServer) reap() {
+	ticker := time.NewTicker(s.ReapInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			if err := s.reapExpired(now); err != nil {
+				log.Println("reap error: ", err)
+			}
+
+		case <-s.quitch:
+			return
+		}
+	}
+}
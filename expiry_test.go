@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestFileServerExpiry(t *testing.T) {
+	s := newTestServer(t)
+	key := "artifact"
+	expiresAt := time.Now().Add(time.Hour)
+
+	res, err := s.StoreWithOptions(testNamespace, key, bytes.NewReader([]byte("build output")), WriteOptions{ExpiresAt: expiresAt})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(testNamespace, key); err != nil {
+		t.Fatalf("expected file to be readable before it expires: %s", err)
+	}
+
+	// Nothing has expired yet.
+	if err := s.reapExpired(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if !s.store.Has(testNamespace, key) {
+		t.Fatalf("expected file to survive reaping before it expires")
+	}
+
+	if err := s.reapExpired(expiresAt); err != nil {
+		t.Fatal(err)
+	}
+	head, ok := s.store.head(testNamespace, key)
+	if !ok || !head.Deleted {
+		t.Fatalf("expected expired file to be replaced with a tombstone, have %+v", head)
+	}
+	if head.Version != expiryVersion(res.Version) || !head.Version.After(res.Version) {
+		t.Errorf("expected tombstone right after %s, have %s", res.Version, head.Version)
+	}
+	if _, err := s.Get(testNamespace, key); !errors.Is(err, ErrDeleted) {
+		t.Errorf("expected get of reaped file to fail with %s, have %v", ErrDeleted, err)
+	}
+	if versions, _ := s.store.ListVersions(testNamespace, key); len(versions) != 1 {
+		t.Errorf("expected the history of the reaped file to be dropped, have %d versions", len(versions))
+	}
+	if _, _, err := s.store.ReadVersion(testNamespace, key, res.Version); !errors.Is(err, ErrVersionNotFound) {
+		t.Errorf("expected the expired version to be gone, have %v", err)
+	}
+}
+
+func TestGetTreatsExpiredFilesAsDeleted(t *testing.T) {
+	s := newTestServer(t)
+	key := "artifact"
+
+	opts := WriteOptions{ExpiresAt: time.Now().Add(-time.Second)}
+	if _, err := s.StoreWithOptions(testNamespace, key, bytes.NewReader([]byte("stale output")), opts); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(testNamespace, key); !errors.Is(err, ErrDeleted) {
+		t.Errorf("expected get of expired file to fail with %s, have %v", ErrDeleted, err)
+	}
+
+	if err := s.Store(testNamespace, key, bytes.NewReader([]byte("fresh output"))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(testNamespace, key); err != nil {
+		t.Errorf("expected file written without expiry to be readable: %s", err)
+	}
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// defaultTransferTTL is how long a partial transfer is kept without progress
+// by default.
+const defaultTransferTTL = 24 * time.Hour
+
+// GCOptions holds the options of a garbage collection.
+type GCOptions struct {
+	// DryRun reports what would be removed without removing anything.
+	DryRun bool
+	// TransferTTL is how long a partial transfer is kept without progress
+	// before it is considered abandoned. Temporary files of the storage are
+	// kept as long.
+	TransferTTL time.Duration
+	// LiveNamespaces lists the namespaces in use in the cluster. Together
+	// with OrphanNamespaceAge it enables the removal of other namespaces.
+	LiveNamespaces []string
+	// OrphanNamespaceAge is how long a namespace that is not in
+	// LiveNamespaces must have gone without a write before it is removed.
+	// Zero keeps such namespaces.
+	OrphanNamespaceAge time.Duration
+}
+
+// GCItem is a piece of data found by the garbage collector.
+type GCItem struct {
+	// Name is the name of the blob, or of whatever else is removed.
+	Name string
+	// Size is the number of bytes removing it reclaims.
+	Size int64
+	// Reason tells why it is garbage.
+	Reason string
+
+	// object is the head of the object the item belongs to. The item is
+	// left alone while the object is being changed.
+	object string
+	// stillGarbage checks right before removal that the item is still
+	// garbage.
+	stillGarbage func() bool
+	// remove removes the item. It defaults to deleting the blob Name.
+	remove func() error
+}
+
+// GCReport describes what a garbage collection found and reclaimed.
+type GCReport struct {
+	// Items is the garbage found, in the order it is removed in.
+	Items []GCItem
+	// Removed is the number of items removed and Reclaimed the bytes they
+	// took up. Both are zero in a dry run.
+	Removed   int
+	Reclaimed int64
+}
+
+// garbageCollector is implemented by storages that accumulate garbage of
+// their own, beyond blobs the store no longer references.
+type garbageCollector interface {
+	// garbage returns the garbage of the storage, counting temporary data
+	// last touched before the given time as abandoned.
+	garbage(before time.Time) ([]GCItem, error)
+}
+
+// CollectGarbage finds data the store no longer references and, unless
+// opts.DryRun is set, removes it:
+//   - metadata and history of objects whose head is gone,
+//   - partial transfers that made no progress for opts.TransferTTL,
+//   - namespaces no longer in use in the cluster, if enabled in opts,
+//   - whatever the storage accumulates, such as abandoned temporary files
+//     and empty directories of a DiskStorage or the overwritten data in the
+//     segments of a LogStorage.
+//
+// Every item is checked again right before it is removed, and objects that
+// are being written are skipped, so it is safe to run next to client
+// traffic.
+func (s *Store) CollectGarbage(opts GCOptions) (GCReport, error) {
+	if opts.TransferTTL == 0 {
+		opts.TransferTTL = defaultTransferTTL
+	}
+
+	var (
+		report GCReport
+		now    = time.Now()
+	)
+
+	ids, err := s.Namespaces()
+	if err != nil {
+		return report, err
+	}
+	for _, id := range ids {
+		var items []GCItem
+		if opts.OrphanNamespaceAge > 0 && opts.LiveNamespaces != nil && !slices.Contains(opts.LiveNamespaces, id) {
+			items, err = s.orphanedNamespace(id, now.Add(-opts.OrphanNamespaceAge))
+			if err != nil {
+				return report, err
+			}
+		}
+		if len(items) == 0 {
+			items, err = s.orphanedBlobs(id)
+			if err != nil {
+				return report, err
+			}
+		}
+		report.Items = append(report.Items, items...)
+	}
+
+	items, err := s.abandonedTransfers(now.Add(-opts.TransferTTL))
+	if err != nil {
+		return report, err
+	}
+	report.Items = append(report.Items, items...)
+
+	if gc, ok := s.Storage.(garbageCollector); ok {
+		items, err := gc.garbage(now.Add(-opts.TransferTTL))
+		if err != nil {
+			return report, err
+		}
+		report.Items = append(report.Items, items...)
+	}
+
+	if opts.DryRun {
+		return report, nil
+	}
+
+	for _, item := range report.Items {
+		removed, err := s.collect(item)
+		if err != nil {
+			return report, fmt.Errorf("removing %s: %w", item.Name, err)
+		}
+		if removed {
+			report.Removed++
+			report.Reclaimed += item.Size
+		}
+	}
+
+	return report, nil
+}
+
+// collect removes item unless it is no longer garbage, and reports whether
+// it did.
+func (s *Store) collect(item GCItem) (bool, error) {
+	if len(item.object) > 0 {
+		done, ok := s.markCollecting(item.object)
+		if !ok {
+			return false, nil
+		}
+		defer done()
+	}
+	if item.stillGarbage != nil && !item.stillGarbage() {
+		return false, nil
+	}
+
+	if item.remove != nil {
+		return true, item.remove()
+	}
+	return true, s.Storage.Delete(item.Name)
+}
+
+// objectOf returns the head name of the object the blob name belongs to: the
+// name itself for a head, or the head its metadata or history belongs to.
+func objectOf(name string) string {
+	if i := strings.Index(name, versionsDirSuffix+"/"); i >= 0 {
+		return name[:i]
+	}
+	return strings.TrimSuffix(name, metaSuffix)
+}
+
+// gcItem returns the item for the blob name of the object with the given
+// head name.
+func (s *Store) gcItem(name string, object string, reason string, stillGarbage func() bool) GCItem {
+	size, _ := s.Storage.Stat(name)
+	return GCItem{
+		Name:         name,
+		Size:         size,
+		Reason:       reason,
+		object:       object,
+		stillGarbage: stillGarbage,
+	}
+}
+
+// orphanedBlobs returns the metadata and history blobs under the given id
+// that belong to no object: those of objects whose head is gone, and the
+// halves of versions missing their data or metadata.
+func (s *Store) orphanedBlobs(id string) ([]GCItem, error) {
+	names, err := s.Storage.List(id)
+	if err != nil {
+		return nil, err
+	}
+	have := make(map[string]bool, len(names))
+	for _, name := range names {
+		have[name] = true
+	}
+
+	var items []GCItem
+	for _, name := range names {
+		object := objectOf(name)
+		if name == object {
+			continue
+		}
+
+		switch {
+		case name == object+metaSuffix && !have[object]:
+			items = append(items, s.gcItem(name, object, "metadata of missing object", func() bool {
+				return !s.Storage.Has(object)
+			}))
+		case !have[object]:
+			items = append(items, s.gcItem(name, object, "history of missing object", func() bool {
+				return !s.Storage.Has(object)
+			}))
+		case name != object+metaSuffix:
+			// A version, which is incomplete without its counterpart.
+			other := name + metaSuffix
+			if isMetaFile(name) {
+				other = strings.TrimSuffix(name, metaSuffix)
+			}
+			if !have[other] {
+				items = append(items, s.gcItem(name, object, "incomplete version", func() bool {
+					return !s.Storage.Has(other)
+				}))
+			}
+		}
+	}
+
+	return items, nil
+}
+
+// orphanedNamespace returns every blob under the given id if the newest
+// object in it was written before cutoff. Objects written since the
+// namespace was looked at are kept.
+func (s *Store) orphanedNamespace(id string, cutoff time.Time) ([]GCItem, error) {
+	heads, err := s.heads(id)
+	if err != nil {
+		return nil, err
+	}
+	for _, meta := range heads {
+		if meta.Version.WallTime >= cutoff.UnixNano() {
+			return nil, nil
+		}
+	}
+
+	names, err := s.Storage.List(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []GCItem
+	for _, name := range names {
+		object := objectOf(name)
+		items = append(items, s.gcItem(name, object, "namespace no longer in use", func() bool {
+			meta, err := s.readMetaBlob(object + metaSuffix)
+			return err != nil || meta.Version.WallTime < cutoff.UnixNano()
+		}))
+	}
+
+	return items, nil
+}
+
+// abandonedTransfers returns the blobs of the partial transfers that were
+// last checkpointed before cutoff, and of those without a checkpoint.
+func (s *Store) abandonedTransfers(cutoff time.Time) ([]GCItem, error) {
+	names, err := s.Storage.List(transfersDirName)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []GCItem
+	for _, name := range names {
+		transferID := strings.TrimSuffix(strings.TrimPrefix(name, transfersDirName+"/"), metaSuffix)
+		transferID, _, _ = strings.Cut(transferID, "/")
+
+		abandoned := func() bool {
+			b, err := s.readBlob(s.transferName(transferID))
+			if errors.Is(err, os.ErrNotExist) {
+				return true
+			}
+			var state TransferState
+			return err == nil && json.Unmarshal(b, &state) == nil && state.UpdatedAt.Before(cutoff)
+		}
+		if abandoned() {
+			items = append(items, s.gcItem(name, "", "abandoned transfer", abandoned))
+		}
+	}
+
+	// Remove the segments before the checkpoint that describes them.
+	slices.SortStableFunc(items, func(a, b GCItem) int {
+		switch {
+		case isMetaFile(a.Name) == isMetaFile(b.Name):
+			return 0
+		case isMetaFile(a.Name):
+			return 1
+		}
+		return -1
+	})
+
+	return items, nil
+}
+
+// CollectGarbage runs a garbage collection of the store of this node. The
+// namespaces that no node of the cluster is configured with and that have
+// not been written to for OrphanNamespaceAge are collected as well, see
+// liveNamespaces.
+func (s *FileServer) CollectGarbage(dryRun bool) (GCReport, error) {
+	return s.store.CollectGarbage(GCOptions{
+		DryRun:             dryRun,
+		TransferTTL:        s.TransferTTL,
+		LiveNamespaces:     s.liveNamespaces(),
+		OrphanNamespaceAge: s.OrphanNamespaceAge,
+	})
+}
+
+// liveNamespaces returns the namespaces this node and its peers are
+// configured with. A namespace is only orphaned if the nodes of the cluster
+// say they do not use it, so nil, which keeps every namespace, is returned
+// unless this node has heard from at least one peer, and from as many as it
+// was bootstrapped with, and every node it has heard from since it started
+// is still among its peers and has told us its namespaces. A node cut off
+// from the rest of the cluster for longer than OrphanNamespaceAge thus does
+// not take the namespaces of the nodes it cannot reach for orphaned.
+func (s *FileServer) liveNamespaces() []string {
+	live := s.namespaceNames()
+	connected := make(map[string]bool)
+	for _, peer := range s.peerList() {
+		info := s.peerInfo(peer)
+		if info.ID == peer.RemoteAddr().String() {
+			return nil
+		}
+		connected[info.ID] = true
+		live = append(live, info.Namespaces...)
+	}
+
+	bootstrapped := 0
+	for _, addr := range s.BootstrapNodes {
+		if len(addr) > 0 {
+			bootstrapped++
+		}
+	}
+	if len(connected) == 0 || len(connected) < bootstrapped {
+		return nil
+	}
+
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	for _, info := range s.peerInfos {
+		if !connected[info.ID] {
+			return nil
+		}
+	}
+	return live
+}
+
+// collectGarbage runs a garbage collection every GCInterval until the server
+// is stopped.
+func (s *FileServer) collectGarbage() {
+	ticker := time.NewTicker(s.GCInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			report, err := s.CollectGarbage(false)
+			if err != nil {
+				log.Println("gc error: ", err)
+			}
+			if report.Removed > 0 {
+				fmt.Printf("[%s] garbage collected %d items, %d bytes\n", s.Transport.Addr(), report.Removed, report.Reclaimed)
+			}
+
+		case <-s.quitch:
+			return
+		}
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestStoreCollectGarbage(t *testing.T) {
+	s := newStore()
+	id := generateID()
+	defer teardown(t, s)
+
+	for _, data := range []string{"v1", "v2"} {
+		for _, key := range []string{"keep", "gone"} {
+			if _, err := s.writeStream(id, key, bytes.NewReader([]byte(data))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	// Lose the head of one object, leaving its metadata and history behind.
+	if err := s.Storage.Delete(s.objectName(id, "gone")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Leave a transfer, a temporary file and some directories behind.
+	tr, err := s.OpenTransfer(TransferState{ID: generateID(), Namespace: id, Key: "partial", Total: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tr.Write(bytes.NewReader([]byte("half"))); err != nil {
+		t.Fatal(err)
+	}
+	tmp := filepath.Join(s.Root, diskTempDirName, "blob-abandoned")
+	if err := os.WriteFile(tmp, []byte("junk"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(tmp, old, old); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(s.Root, id, "empty", "nested"), os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+
+	time.Sleep(10 * time.Millisecond)
+	opts := GCOptions{DryRun: true, TransferTTL: time.Millisecond}
+
+	report, err := s.CollectGarbage(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reasons := make(map[string]int)
+	for _, item := range report.Items {
+		reasons[item.Reason]++
+	}
+	want := map[string]int{
+		"metadata of missing object": 1,
+		"history of missing object":  2,
+		"abandoned transfer":         2,
+		"abandoned temporary file":   1,
+		"empty directory":            2,
+	}
+	for reason, n := range want {
+		if reasons[reason] != n {
+			t.Errorf("expected %d items for %q, have %d in %+v", n, reason, reasons[reason], reasons)
+		}
+	}
+	if report.Removed != 0 || !s.Storage.Has(s.metaName(id, "gone")) {
+		t.Fatalf("expected dry run to remove nothing")
+	}
+
+	opts.DryRun = false
+	report, err = s.CollectGarbage(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Removed != len(report.Items) || report.Reclaimed == 0 {
+		t.Errorf("expected all %d items to be removed, have %d removed and %d bytes reclaimed", len(report.Items), report.Removed, report.Reclaimed)
+	}
+
+	if versions, _ := s.ListVersions(id, "gone"); len(versions) != 0 {
+		t.Errorf("expected history of lost object to be removed, have %d versions", len(versions))
+	}
+	if _, err := s.TransferStatus(tr.ID); err == nil {
+		t.Errorf("expected abandoned transfer to be removed")
+	}
+	if _, err := os.Stat(filepath.Join(s.Root, id, "empty")); !os.IsNotExist(err) {
+		t.Errorf("expected empty directories to be removed, have %v", err)
+	}
+
+	// The live object is left alone.
+	if versions, _ := s.ListVersions(id, "keep"); len(versions) != 2 {
+		t.Errorf("expected live object to keep 2 versions, have %d", len(versions))
+	}
+	_, r, err := s.Read(id, "keep")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(r); string(b) != "v2" {
+		t.Errorf("expected live object to hold v2, have %s", b)
+	}
+
+	if report, _ := s.CollectGarbage(opts); len(report.Items) != 0 {
+		t.Errorf("expected nothing left to collect, have %+v", report.Items)
+	}
+}
+
+func TestStoreCollectOrphanedNamespaces(t *testing.T) {
+	s := newStore()
+	defer teardown(t, s)
+
+	longAgo := Version{WallTime: time.Now().Add(-48 * time.Hour).UnixNano()}
+	if _, err := s.WriteWithMeta("departed", "key", bytes.NewReader([]byte("data")), ObjectMeta{Version: longAgo}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.WriteWithMeta("offline", "key", bytes.NewReader([]byte("data")), ObjectMeta{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.WriteWithMeta("peer", "key", bytes.NewReader([]byte("data")), ObjectMeta{Version: longAgo}); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := GCOptions{
+		LiveNamespaces:     []string{"peer"},
+		OrphanNamespaceAge: 24 * time.Hour,
+	}
+	if _, err := s.CollectGarbage(opts); err != nil {
+		t.Fatal(err)
+	}
+
+	if s.Has("departed", "key") {
+		t.Errorf("expected namespace of departed node to be removed")
+	}
+	if !s.Has("offline", "key") {
+		t.Errorf("expected recently written namespace to be kept")
+	}
+	if !s.Has("peer", "key") {
+		t.Errorf("expected namespace of live node to be kept")
+	}
+}
+
+func TestStoreCollectLocksObjects(t *testing.T) {
+	s := newStore()
+	defer teardown(t, s)
+
+	name := s.objectName(generateID(), "key")
+	done := s.markBusy(name)
+	if _, ok := s.markCollecting(name); ok {
+		t.Fatalf("expected an object being changed not to be collected")
+	}
+	done()
+
+	collected, ok := s.markCollecting(name)
+	if !ok {
+		t.Fatalf("expected an idle object to be collected")
+	}
+	// Other objects are not held up by the collection.
+	s.markBusy(s.objectName(generateID(), "other"))()
+
+	marked := make(chan struct{})
+	go func() {
+		s.markBusy(name)()
+		close(marked)
+	}()
+	select {
+	case <-marked:
+		t.Fatalf("expected a change to wait for the collection of the object")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	collected()
+	select {
+	case <-marked:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the change to go ahead once the object is collected")
+	}
+}
+
+func TestLiveNamespacesNeedEveryPeer(t *testing.T) {
+	if live := newTestServer(t).liveNamespaces(); live != nil {
+		t.Errorf("expected a node that heard from no peer to keep every namespace, have %v", live)
+	}
+
+	servers := newTestCluster(t, 2)
+	a := servers[0]
+	if live := a.liveNamespaces(); !slices.Contains(live, testNamespace) {
+		t.Fatalf("expected the namespaces of the cluster to be live, have %v", live)
+	}
+
+	// A node that was heard from before but is gone may be the only one
+	// using some namespace.
+	a.peerLock.Lock()
+	a.peerInfos["127.0.0.1:1"] = NodeInfo{ID: "gone", Addr: "127.0.0.1:1"}
+	a.peerLock.Unlock()
+	if live := a.liveNamespaces(); live != nil {
+		t.Errorf("expected namespaces to be kept while a node is missing, have %v", live)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Version identifies a single write of an object. It is a hybrid logical
+// clock timestamp, which stays close to wall clock time but never goes
+// backwards and orders causally related writes correctly even when clocks
+// drift, tagged with the ID of the node that made the write.
+type Version struct {
+	WallTime int64
+	Logical  uint32
+	NodeID   string
+}
+
+// IsZero reports whether v is the zero Version.
+func (v Version) IsZero() bool {
+	return v.WallTime == 0 && v.Logical == 0 && len(v.NodeID) == 0
+}
+
+// Compare returns -1, 0 or +1 depending on whether v is older than, the same
+// as or newer than other. Concurrent writes with the same timestamp are
+// ordered by node ID, so every node resolves conflicts the same way.
+func (v Version) Compare(other Version) int {
+	switch {
+	case v.WallTime != other.WallTime:
+		return cmpInt(v.WallTime, other.WallTime)
+	case v.Logical != other.Logical:
+		return cmpInt(int64(v.Logical), int64(other.Logical))
+	}
+	return strings.Compare(v.NodeID, other.NodeID)
+}
+
+// After reports whether v is newer than other.
+func (v Version) After(other Version) bool {
+	return v.Compare(other) > 0
+}
+
+// String returns a representation of v that sorts in version order and is
+// safe to use as a filename.
+func (v Version) String() string {
+	return fmt.Sprintf("%016x-%08x-%s", v.WallTime, v.Logical, v.NodeID)
+}
+
+// ParseVersion parses the output of Version.String.
+func ParseVersion(s string) (Version, error) {
+	var v Version
+
+	parts := strings.SplitN(s, "-", 3)
+	if len(parts) != 3 {
+		return v, fmt.Errorf("invalid version (%s)", s)
+	}
+	if _, err := fmt.Sscanf(parts[0]+" "+parts[1], "%x %x", &v.WallTime, &v.Logical); err != nil {
+		return v, fmt.Errorf("invalid version (%s): %w", s, err)
+	}
+	v.NodeID = parts[2]
+
+	return v, nil
+}
+
+func cmpInt(a, b int64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// HLC is a hybrid logical clock.
+type HLC struct {
+	mu     sync.Mutex
+	nodeID string
+	last   Version
+	now    func() int64
+}
+
+// NewHLC creates a hybrid logical clock for the node with the given ID.
+func NewHLC(nodeID string) *HLC {
+	return &HLC{
+		nodeID: nodeID,
+		now:    func() int64 { return time.Now().UnixNano() },
+	}
+}
+
+// Now returns a Version newer than every version the clock has produced or
+// observed so far.
+func (c *HLC) Now() Version {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if wall := c.now(); wall > c.last.WallTime {
+		c.last = Version{WallTime: wall}
+	} else {
+		c.last.Logical++
+	}
+	c.last.NodeID = c.nodeID
+
+	return c.last
+}
+
+// Update moves the clock past a version received from another node, so that
+// writes made here afterwards are ordered after it.
+func (c *HLC) Update(remote Version) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	wall := c.now()
+	switch {
+	case wall > c.last.WallTime && wall > remote.WallTime:
+		c.last = Version{WallTime: wall}
+	case remote.WallTime > c.last.WallTime:
+		c.last = Version{WallTime: remote.WallTime, Logical: remote.Logical + 1}
+	case remote.WallTime == c.last.WallTime && remote.Logical >= c.last.Logical:
+		c.last.Logical = remote.Logical + 1
+	}
+	c.last.NodeID = c.nodeID
+}
@@ -0,0 +1,65 @@
+package main
+
+import "testing"
+
+func TestHLCMonotonic(t *testing.T) {
+	clock := NewHLC("a")
+	clock.now = func() int64 { return 100 }
+
+	first := clock.Now()
+	second := clock.Now()
+	if !second.After(first) {
+		t.Errorf("expected %s to be after %s with a stalled wall clock", second, first)
+	}
+
+	// A wall clock that goes backwards must not produce older versions.
+	clock.now = func() int64 { return 50 }
+	if third := clock.Now(); !third.After(second) {
+		t.Errorf("expected %s to be after %s with a wall clock going backwards", third, second)
+	}
+}
+
+func TestHLCUpdate(t *testing.T) {
+	clock := NewHLC("a")
+	clock.now = func() int64 { return 100 }
+
+	remote := Version{WallTime: 500, Logical: 3, NodeID: "b"}
+	clock.Update(remote)
+
+	if v := clock.Now(); !v.After(remote) {
+		t.Errorf("expected %s to be after remote %s", v, remote)
+	}
+}
+
+func TestVersionCompare(t *testing.T) {
+	a := Version{WallTime: 1, Logical: 0, NodeID: "a"}
+	b := Version{WallTime: 1, Logical: 0, NodeID: "b"}
+	c := Version{WallTime: 1, Logical: 1, NodeID: "a"}
+	d := Version{WallTime: 2, Logical: 0, NodeID: "a"}
+
+	ordered := []Version{a, b, c, d}
+	for i := range ordered {
+		for j := range ordered {
+			want := cmpInt(int64(i), int64(j))
+			if have := ordered[i].Compare(ordered[j]); have != want {
+				t.Errorf("compare %s with %s: have %d want %d", ordered[i], ordered[j], have, want)
+			}
+		}
+	}
+}
+
+func TestParseVersion(t *testing.T) {
+	v := Version{WallTime: 1729342000123456789, Logical: 7, NodeID: generateID()}
+
+	parsed, err := ParseVersion(v.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed != v {
+		t.Errorf("have %+v want %+v", parsed, v)
+	}
+
+	if _, err := ParseVersion("garbage"); err == nil {
+		t.Errorf("expected error parsing garbage")
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// ErrUnknownKey is returned when the data key of a replica was wrapped with a
+// master key its KeyProvider does not hold.
+var ErrUnknownKey = errors.New("unknown master key")
+
+// ErrKeyNotExportable is returned by GetKey for master keys that never leave
+// their KeyProvider, as with most external key management services.
+var ErrKeyNotExportable = errors.New("master key cannot be exported")
+
+// KeyProvider holds the master keys the data keys of replicas are wrapped
+// with, so they can be kept in an external key management service. Master
+// keys are known by ID; the ID of the key a data key was wrapped with is
+// recorded next to it, so a provider that still holds a rotated out key can
+// unwrap the data keys it wrapped.
+//
+// The context of WrapKey and UnwrapKey is the namespace the data key belongs
+// to. A data key wrapped for one namespace must not unwrap for another, so
+// a single master key can serve every namespace.
+type KeyProvider interface {
+	// CurrentKeyID returns the ID of the master key WrapKey uses.
+	CurrentKeyID() (string, error)
+	// GetKey returns the master key with the given ID, for keys that are
+	// derived from it locally. Providers may refuse to with
+	// ErrKeyNotExportable.
+	GetKey(id string) ([]byte, error)
+	// WrapKey wraps dataKey with the current master key and returns the ID
+	// of that key along with the wrapped data key.
+	WrapKey(dataKey []byte, context string) (string, []byte, error)
+	// UnwrapKey unwraps a data key wrapped by WrapKey with the master key
+	// with the given ID, failing with ErrUnknownKey if that key is not held.
+	UnwrapKey(id string, wrapped []byte, context string) ([]byte, error)
+}
+
+// Keyring is a KeyProvider holding its master keys in memory. Data keys are
+// wrapped with the current key; the others are retired keys that are only
+// used to unwrap data keys wrapped before a rotation.
+type Keyring struct {
+	current string
+	keys    map[string][]byte
+}
+
+// NewKeyring returns a Keyring that wraps data keys with current and can
+// unwrap those wrapped with any of the retired keys. Keys must be 16, 24 or
+// 32 bytes long.
+func NewKeyring(current []byte, retired ...[]byte) *Keyring {
+	k := &Keyring{
+		current: keyID(current),
+		keys:    make(map[string][]byte, 1+len(retired)),
+	}
+	k.keys[k.current] = current
+	for _, key := range retired {
+		k.keys[keyID(key)] = key
+	}
+	return k
+}
+
+// keyID returns the ID a master key of a Keyring is known by, a fingerprint
+// that identifies the key without revealing it.
+func keyID(key []byte) string {
+	h := sha256.Sum256(append([]byte("key-id/"), key...))
+	return hex.EncodeToString(h[:8])
+}
+
+// CurrentKeyID implements KeyProvider.
+func (k *Keyring) CurrentKeyID() (string, error) {
+	return k.current, nil
+}
+
+// GetKey implements KeyProvider.
+func (k *Keyring) GetKey(id string) ([]byte, error) {
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: (%s)", ErrUnknownKey, id)
+	}
+	return key, nil
+}
+
+// WrapKey implements KeyProvider.
+func (k *Keyring) WrapKey(dataKey []byte, context string) (string, []byte, error) {
+	wrapped, err := wrapKey(k.keys[k.current], dataKey, context)
+	return k.current, wrapped, err
+}
+
+// UnwrapKey implements KeyProvider.
+func (k *Keyring) UnwrapKey(id string, wrapped []byte, context string) ([]byte, error) {
+	kek, err := k.GetKey(id)
+	if err != nil {
+		return nil, err
+	}
+	return unwrapKey(kek, wrapped, context)
+}
+
+// LoadKeyFile reads a Keyring from a file holding one hex encoded master key
+// per line, the current key first and the retired ones after it. Blank lines
+// and lines starting with # are skipped. Rotating the master key is a matter
+// of adding a new first line and restarting the node.
+func LoadKeyFile(path string) (*Keyring, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var keys [][]byte
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if len(text) == 0 || strings.HasPrefix(text, "#") {
+			continue
+		}
+		key, err := hex.DecodeString(text)
+		if err != nil {
+			return nil, fmt.Errorf("key file %s, line %d: %w", path, line, err)
+		}
+		if n := len(key); n != 16 && n != 24 && n != 32 {
+			return nil, fmt.Errorf("key file %s, line %d: key of %d bytes, want 16, 24 or 32", path, line, n)
+		}
+		keys = append(keys, key)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("key file %s holds no keys", path)
+	}
+
+	return NewKeyring(keys[0], keys[1:]...), nil
+}
+
+// passphraseIterations is the number of PBKDF2 iterations master keys are
+// derived from passphrases with.
+const passphraseIterations = 600000
+
+// NewPassphraseKeyring returns a Keyring whose master keys are derived from
+// passphrases, the current one first and the retired ones after it. Every
+// node of a cluster needs the same salt, which does not have to be secret
+// but should not be shared with other clusters.
+func NewPassphraseKeyring(salt string, current string, retired ...string) *Keyring {
+	derive := func(passphrase string) []byte {
+		return pbkdf2SHA256([]byte(passphrase), []byte("godiststore/"+salt), passphraseIterations, 32)
+	}
+
+	keys := make([][]byte, len(retired))
+	for i, passphrase := range retired {
+		keys[i] = derive(passphrase)
+	}
+	return NewKeyring(derive(current), keys...)
+}
+
+// pbkdf2SHA256 derives a key of keyLen bytes from password and salt with
+// PBKDF2, as specified by RFC 8018, using HMAC-SHA256.
+func pbkdf2SHA256(password []byte, salt []byte, iterations int, keyLen int) []byte {
+	var (
+		prf     = hmac.New(sha256.New, password)
+		hashLen = prf.Size()
+		blocks  = (keyLen + hashLen - 1) / hashLen
+		key     = make([]byte, 0, blocks*hashLen)
+		u       = make([]byte, hashLen)
+		counter [4]byte
+	)
+	for block := 1; block <= blocks; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(counter[:], uint32(block))
+		prf.Write(counter[:])
+		key = prf.Sum(key)
+
+		t := key[len(key)-hashLen:]
+		copy(u, t)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range u {
+				t[j] ^= u[j]
+			}
+		}
+	}
+	return key[:keyLen]
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testKMS is a KeyProvider standing in for an external key management
+// service: its master keys never leave it, and it counts how often it was
+// asked to wrap and unwrap data keys.
+type testKMS struct {
+	keys    *Keyring
+	wraps   int
+	unwraps int
+}
+
+func (k *testKMS) CurrentKeyID() (string, error) {
+	return k.keys.CurrentKeyID()
+}
+
+func (k *testKMS) GetKey(id string) ([]byte, error) {
+	return nil, ErrKeyNotExportable
+}
+
+func (k *testKMS) WrapKey(dataKey []byte, context string) (string, []byte, error) {
+	k.wraps++
+	return k.keys.WrapKey(dataKey, context)
+}
+
+func (k *testKMS) UnwrapKey(id string, wrapped []byte, context string) ([]byte, error) {
+	k.unwraps++
+	return k.keys.UnwrapKey(id, wrapped, context)
+}
+
+func TestKeyring(t *testing.T) {
+	current, retired := newEncryptionKey(), newEncryptionKey()
+	k := NewKeyring(current, retired)
+	dataKey := newEncryptionKey()
+
+	id, wrapped, err := k.WrapKey(dataKey, "photos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if currentID, _ := k.CurrentKeyID(); id != currentID || id != keyID(current) {
+		t.Errorf("expected data key to be wrapped with the current key")
+	}
+	if have, err := k.UnwrapKey(id, wrapped, "photos"); err != nil || !bytes.Equal(have, dataKey) {
+		t.Errorf("expected data key to unwrap, have %v", err)
+	}
+
+	// Data keys wrapped with a retired key can still be unwrapped.
+	old, err := wrapKey(retired, dataKey, "photos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, err := k.UnwrapKey(keyID(retired), old, "photos"); err != nil || !bytes.Equal(have, dataKey) {
+		t.Errorf("expected data key wrapped with a retired key to unwrap, have %v", err)
+	}
+	if _, err := NewKeyring(current).UnwrapKey(keyID(retired), old, "photos"); !errors.Is(err, ErrUnknownKey) {
+		t.Errorf("expected unwrap with a dropped key to fail with %s, have %v", ErrUnknownKey, err)
+	}
+
+	if key, err := k.GetKey(keyID(retired)); err != nil || !bytes.Equal(key, retired) {
+		t.Errorf("expected retired key to be returned, have %v", err)
+	}
+}
+
+func TestLoadKeyFile(t *testing.T) {
+	current, retired := newEncryptionKey(), newEncryptionKey()
+	path := filepath.Join(t.TempDir(), "keys")
+	contents := "# rotated on 2026-10-19\n" + hex.EncodeToString(current) + "\n\n" + hex.EncodeToString(retired) + "\n"
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	k, err := LoadKeyFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := k.CurrentKeyID(); id != keyID(current) {
+		t.Errorf("expected the first key to be the current one")
+	}
+	if _, err := k.GetKey(keyID(retired)); err != nil {
+		t.Errorf("expected the second key to be retired: %s", err)
+	}
+
+	for _, contents := range []string{"", "# no keys\n", "not hex\n", "abcd\n"} {
+		if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadKeyFile(path); err == nil {
+			t.Errorf("expected key file %q to be rejected", contents)
+		}
+	}
+}
+
+func TestPassphraseKeyring(t *testing.T) {
+	a := NewPassphraseKeyring("cluster", "correct horse", "battery staple")
+	b := NewPassphraseKeyring("cluster", "correct horse")
+	other := NewPassphraseKeyring("other cluster", "correct horse")
+
+	idA, _ := a.CurrentKeyID()
+	idB, _ := b.CurrentKeyID()
+	idOther, _ := other.CurrentKeyID()
+	if idA != idB {
+		t.Errorf("expected the same passphrase and salt to give the same key")
+	}
+	if idA == idOther {
+		t.Errorf("expected another salt to give another key")
+	}
+
+	old := NewPassphraseKeyring("cluster", "battery staple")
+	id, wrapped, err := old.WrapKey(newEncryptionKey(), "photos")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.UnwrapKey(id, wrapped, "photos"); err != nil {
+		t.Errorf("expected key wrapped with a retired passphrase to unwrap: %s", err)
+	}
+}
+
+func TestPBKDF2(t *testing.T) {
+	// Test vectors for PBKDF2-HMAC-SHA256 from RFC 7914.
+	tests := []struct {
+		iterations int
+		want       string
+	}{
+		{1, "120fb6cffcf8b32c43e7225256c4f837a86548c92ccc35480805987cb70be17b"},
+		{4096, "c5e478d59288c841aa530db6845c4c8d962893a001ce4e11a4963873aa98134a"},
+	}
+
+	for _, tt := range tests {
+		have := hex.EncodeToString(pbkdf2SHA256([]byte("password"), []byte("salt"), tt.iterations, 32))
+		if have != tt.want {
+			t.Errorf("expected %s after %d iterations, have %s", tt.want, tt.iterations, have)
+		}
+	}
+}
+
+func TestFileServerWithExternalKeyProvider(t *testing.T) {
+	kms := &testKMS{keys: NewKeyring(newEncryptionKey())}
+	namespaces := map[string]NamespaceOpts{"shared": {}}
+	writer := newNamespaceServer(t, kms, namespaces)
+	reader := newNamespaceServer(t, kms, namespaces)
+
+	data := []byte("keys never leave the kms")
+	if err := writer.Store("shared", "key", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	handReplica(t, writer, reader, "shared", "key")
+
+	got, err := reader.Get("shared", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(got); !bytes.Equal(b, data) {
+		t.Errorf("expected %s, have %s", data, b)
+	}
+	if kms.wraps == 0 || kms.unwraps != 1 {
+		t.Errorf("expected data keys to be wrapped and unwrapped by the provider, have %d wraps and %d unwraps", kms.wraps, kms.unwraps)
+	}
+}
@@ -19,11 +19,13 @@ func makeServer(listenAddr string, nodes ...string) *FileServer {
 	tcpTransport := p2p.NewTCPTransport(tcptransportOpts)
 
 	fileServerOpts := FileServerOpts{
-		EncKey:            newEncryptionKey(),
+		KeyProvider:       NewKeyring(newEncryptionKey()),
 		StorageRoot:       listenAddr + "_network",
 		PathTransformFunc: CASPathTransformFunc,
 		Transport:         tcpTransport,
 		BootstrapNodes:    nodes,
+		Namespaces:        map[string]NamespaceOpts{"pictures": {}},
+		WriteConsistency:  ConsistencyAll,
 	}
 
 	s := NewFileServer(fileServerOpts)
@@ -50,13 +52,13 @@ func main() {
 	for i := 0; i < 20; i++ {
 		key := fmt.Sprintf("picture_%d.png", i)
 		data := bytes.NewReader([]byte("my big data file here!"))
-		s3.Store(key, data)
+		s3.Store("pictures", key, data)
 
-		if err := s3.store.Delete(s3.ID, key); err != nil {
+		if err := s3.store.Delete("pictures", key); err != nil {
 			log.Fatal(err)
 		}
 
-		r, err := s3.Get(key)
+		r, err := s3.Get("pictures", key)
 		if err != nil {
 			log.Fatal(err)
 		}
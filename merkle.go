@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+	"sync"
+)
+
+const (
+	// merkleDepth is the number of hex digits of a leaf's name hash used to
+	// place it in the tree. Each level fans out to 16 children, so the tree
+	// has 16^merkleDepth buckets at the bottom.
+	merkleDepth = 3
+	hexDigits   = "0123456789abcdef"
+)
+
+// MerkleTree is a fixed-depth hash tree over the objects of a single
+// namespace. Leaves are bucketed by the hex prefix of the hash of their name,
+// so two trees built from the same set of objects always have the same shape
+// and can be compared level by level.
+type MerkleTree struct {
+	mu      sync.RWMutex
+	buckets map[string]map[string][]byte
+	nodes   map[string][]byte
+}
+
+// NewMerkleTree creates an empty MerkleTree.
+func NewMerkleTree() *MerkleTree {
+	return &MerkleTree{
+		buckets: make(map[string]map[string][]byte),
+		nodes:   make(map[string][]byte),
+	}
+}
+
+// merkleBucket returns the prefix of the bottom level bucket name belongs to.
+func merkleBucket(name string) string {
+	hash := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(hash[:])[:merkleDepth]
+}
+
+// Insert adds or replaces the leaf with the given name.
+func (t *MerkleTree) Insert(name string, hash []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	bucket := merkleBucket(name)
+	leaves, ok := t.buckets[bucket]
+	if !ok {
+		leaves = make(map[string][]byte)
+		t.buckets[bucket] = leaves
+	}
+	leaves[name] = hash
+	t.invalidate(bucket)
+}
+
+// Remove deletes the leaf with the given name, if present.
+func (t *MerkleTree) Remove(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	bucket := merkleBucket(name)
+	leaves, ok := t.buckets[bucket]
+	if !ok {
+		return
+	}
+	delete(leaves, name)
+	if len(leaves) == 0 {
+		delete(t.buckets, bucket)
+	}
+	t.invalidate(bucket)
+}
+
+// Len returns the number of leaves in the tree.
+func (t *MerkleTree) Len() int {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	n := 0
+	for _, leaves := range t.buckets {
+		n += len(leaves)
+	}
+	return n
+}
+
+// invalidate drops the cached hashes of bucket and all of its ancestors.
+func (t *MerkleTree) invalidate(bucket string) {
+	for i := 0; i <= len(bucket); i++ {
+		delete(t.nodes, bucket[:i])
+	}
+}
+
+// Root returns the hash of the whole tree. An empty tree has a nil root.
+func (t *MerkleTree) Root() []byte {
+	return t.Hash("")
+}
+
+// Hash returns the hash of the node at the given prefix. Prefixes are hex
+// strings of at most merkleDepth digits; the empty prefix is the root. Empty
+// subtrees hash to nil.
+func (t *MerkleTree) Hash(prefix string) []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.hash(prefix)
+}
+
+func (t *MerkleTree) hash(prefix string) []byte {
+	if h, ok := t.nodes[prefix]; ok {
+		return h
+	}
+
+	var (
+		h     = sha256.New()
+		empty = true
+	)
+	if len(prefix) >= merkleDepth {
+		leaves := t.buckets[prefix]
+		names := make([]string, 0, len(leaves))
+		for name := range leaves {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			h.Write([]byte(name))
+			h.Write(leaves[name])
+			empty = false
+		}
+	} else {
+		for _, c := range hexDigits {
+			child := t.hash(prefix + string(c))
+			if child != nil {
+				empty = false
+			}
+			h.Write(child)
+		}
+	}
+
+	var sum []byte
+	if !empty {
+		sum = h.Sum(nil)
+	}
+	t.nodes[prefix] = sum
+
+	return sum
+}
+
+// Leaves returns a copy of the leaves stored in the bucket at prefix, which
+// must be a full merkleDepth digits long.
+func (t *MerkleTree) Leaves(prefix string) map[string][]byte {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	leaves := make(map[string][]byte, len(t.buckets[prefix]))
+	for name, hash := range t.buckets[prefix] {
+		leaves[name] = hash
+	}
+	return leaves
+}
+
+// merkleChildren returns the prefixes of the children of each given prefix.
+func merkleChildren(prefixes []string) []string {
+	children := make([]string, 0, len(prefixes)*len(hexDigits))
+	for _, prefix := range prefixes {
+		for _, c := range hexDigits {
+			children = append(children, prefix+string(c))
+		}
+	}
+	return children
+}
+
+// diffLeaves returns the names whose hashes differ between two buckets,
+// including names that are only present on one side.
+func diffLeaves(local, remote map[string][]byte) []string {
+	var names []string
+	for name, hash := range local {
+		if other, ok := remote[name]; !ok || !bytes.Equal(hash, other) {
+			names = append(names, name)
+		}
+	}
+	for name := range remote {
+		if _, ok := local[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// DiffMerkleTrees compares two trees held in the same process and returns the
+// names of the leaves that differ. It walks the trees the same way the network
+// sync protocol does and is mostly useful to reason about (and test) it.
+func DiffMerkleTrees(a, b *MerkleTree) []string {
+	prefixes := []string{""}
+	for depth := 0; depth <= merkleDepth && len(prefixes) > 0; depth++ {
+		var differing []string
+		for _, prefix := range prefixes {
+			if !bytes.Equal(a.Hash(prefix), b.Hash(prefix)) {
+				differing = append(differing, prefix)
+			}
+		}
+		if depth == merkleDepth {
+			prefixes = differing
+			break
+		}
+		prefixes = merkleChildren(differing)
+	}
+
+	var names []string
+	for _, prefix := range prefixes {
+		names = append(names, diffLeaves(a.Leaves(prefix), b.Leaves(prefix))...)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMerkleTreeRoot(t *testing.T) {
+	a, b := NewMerkleTree(), NewMerkleTree()
+	if a.Root() != nil {
+		t.Errorf("expected empty tree to have a nil root")
+	}
+
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("object_%d", i)
+		a.Insert(name, []byte(name))
+	}
+	// Insertion order must not matter.
+	for i := 99; i >= 0; i-- {
+		name := fmt.Sprintf("object_%d", i)
+		b.Insert(name, []byte(name))
+	}
+
+	if !bytes.Equal(a.Root(), b.Root()) {
+		t.Errorf("expected trees with the same leaves to have the same root")
+	}
+
+	b.Insert("object_7", []byte("changed"))
+	if bytes.Equal(a.Root(), b.Root()) {
+		t.Errorf("expected changed leaf to change the root")
+	}
+
+	b.Insert("object_7", []byte("object_7"))
+	if !bytes.Equal(a.Root(), b.Root()) {
+		t.Errorf("expected restored leaf to restore the root")
+	}
+}
+
+func TestDiffMerkleTrees(t *testing.T) {
+	a, b := NewMerkleTree(), NewMerkleTree()
+	for i := 0; i < 1000; i++ {
+		name := fmt.Sprintf("object_%d", i)
+		a.Insert(name, []byte(name))
+		b.Insert(name, []byte(name))
+	}
+
+	if diff := DiffMerkleTrees(a, b); len(diff) != 0 {
+		t.Errorf("expected no differences, have %v", diff)
+	}
+
+	a.Insert("only_in_a", []byte("a"))
+	b.Insert("only_in_b", []byte("b"))
+	b.Insert("object_42", []byte("changed"))
+	b.Remove("object_500")
+
+	want := []string{"object_42", "object_500", "only_in_a", "only_in_b"}
+	if diff := DiffMerkleTrees(a, b); !reflect.DeepEqual(diff, want) {
+		t.Errorf("have %v want %v", diff, want)
+	}
+}
+
+func TestStoreTree(t *testing.T) {
+	s := newStore()
+	id := generateID()
+	defer teardown(t, s)
+
+	if _, err := s.writeStream(id, "foo", bytes.NewReader([]byte("foo"))); err != nil {
+		t.Fatal(err)
+	}
+
+	tree, err := s.Tree(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tree.Len() != 1 {
+		t.Errorf("expected tree built from disk to have 1 leaf, have %d", tree.Len())
+	}
+
+	if _, err := s.writeStream(id, "bar", bytes.NewReader([]byte("bar"))); err != nil {
+		t.Fatal(err)
+	}
+	if tree.Len() != 2 {
+		t.Errorf("expected write to add a leaf, have %d", tree.Len())
+	}
+
+	if err := s.Delete(id, "foo"); err != nil {
+		t.Fatal(err)
+	}
+	if tree.Len() != 1 {
+		t.Errorf("expected delete to remove a leaf, have %d", tree.Len())
+	}
+}
+
+func TestSyncNamespaceMatchesReplicas(t *testing.T) {
+	servers := newTestCluster(t, 2)
+	writer, reader := servers[0], servers[1]
+
+	if _, err := writer.StoreWithOptions(testNamespace, "key", bytes.NewReader([]byte("data")), WriteOptions{Consistency: ConsistencyAll}); err != nil {
+		t.Fatal(err)
+	}
+
+	addr := writer.peerList()[0].RemoteAddr().String()
+	diff, err := writer.SyncNamespace(addr, testNamespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(diff) != 0 {
+		t.Errorf("expected the local copy to match its replica, have %v", diff)
+	}
+
+	if err := reader.store.Delete(testNamespace, hashKey("key")); err != nil {
+		t.Fatal(err)
+	}
+	diff, err = writer.SyncNamespace(addr, testNamespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(diff, []string{hashKey("key")}) {
+		t.Errorf("expected the missing replica to be reported, have %v", diff)
+	}
+}
+
+func TestMerkleRequestsAnswerErrors(t *testing.T) {
+	servers := newTestCluster(t, 2)
+	peer := servers[0].peerList()[0]
+
+	// A peer that cannot build the tree says so rather than leaving the
+	// request to time out.
+	start := time.Now()
+	for _, payload := range []any{
+		MessageMerkleNodes{Namespace: "../escape", Prefixes: []string{""}},
+		MessageMerkleLeaves{Namespace: "../escape", Prefixes: []string{""}},
+	} {
+		resp, err := servers[0].request(peer, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch resp := resp.(type) {
+		case MessageMerkleNodesResponse:
+			if len(resp.Err) == 0 {
+				t.Errorf("expected an error for %T, have %+v", payload, resp)
+			}
+		case MessageMerkleLeavesResponse:
+			if len(resp.Err) == 0 {
+				t.Errorf("expected an error for %T, have %+v", payload, resp)
+			}
+		default:
+			t.Errorf("unexpected response %T to %T", resp, payload)
+		}
+	}
+	if elapsed := time.Since(start); elapsed >= requestTimeout {
+		t.Errorf("expected the errors to be answered right away, took %s", elapsed)
+	}
+}
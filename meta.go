@@ -0,0 +1,178 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// metaSuffix is appended to the name of an object to get the name of its metadata.
+const metaSuffix = ".meta"
+
+// ErrCorrupt is returned when the bytes of an object do not match the
+// checksum recorded when it was stored.
+var ErrCorrupt = errors.New("object is corrupt")
+
+// ObjectMeta holds the metadata recorded next to every object in the store.
+type ObjectMeta struct {
+	// Key is the key the object was stored under.
+	Key string
+	// Size is the number of bytes stored on disk.
+	Size int64
+	// Checksum is the hex encoded SHA-256 of the bytes stored on disk.
+	Checksum string
+	// ContentHash is the hex encoded SHA-256 of the plaintext. It equals
+	// Checksum for objects stored unencrypted and is carried along with
+	// encrypted replicas so the node reading them back can verify the
+	// decrypted content end to end.
+	ContentHash string
+	// Version identifies the write that produced the object. It is carried
+	// along to every replica and used to tell which copy is the newest.
+	Version Version
+	// Deleted marks a tombstone, recording that the object was deleted by
+	// the write with this Version. Tombstones hold no data but are ordered
+	// like any other version, so a copy from before the deletion that shows
+	// up later cannot bring the object back.
+	Deleted bool `json:",omitempty"`
+	// ExpiresAt is when the object expires, after which it is treated as
+	// deleted and reaped. The zero time means it never expires.
+	ExpiresAt time.Time
+	// Replica marks an encrypted replica held for the nodes serving the
+	// namespace, stored under the hash of its key, as opposed to a
+	// plaintext copy served to the clients of this node.
+	Replica bool `json:",omitempty"`
+	// KeyID and WrappedKey are the data key of an encrypted replica,
+	// wrapped with the master key of its namespace with that ID.
+	KeyID      string `json:",omitempty"`
+	WrappedKey []byte `json:",omitempty"`
+}
+
+// Expired reports whether the object has expired at the given time.
+func (m ObjectMeta) Expired(now time.Time) bool {
+	return !m.ExpiresAt.IsZero() && !now.Before(m.ExpiresAt)
+}
+
+// isMetaFile reports whether name is the metadata blob of an object.
+func isMetaFile(name string) bool {
+	return strings.HasSuffix(name, metaSuffix)
+}
+
+// metaName returns the name of the metadata blob for the given key.
+func (s *Store) metaName(id string, key string) string {
+	return s.objectName(id, key) + metaSuffix
+}
+
+// Stat returns the metadata recorded for the object with the given key.
+func (s *Store) Stat(id string, key string) (ObjectMeta, error) {
+	if err := s.checkKey(id, key); err != nil {
+		return ObjectMeta{}, err
+	}
+	return s.readMetaBlob(s.metaName(id, key))
+}
+
+// Verify re-reads the object with the given key and checks it against the
+// checksum recorded when it was written. Objects without a recorded checksum
+// are considered valid.
+func (s *Store) Verify(id string, key string) error {
+	meta, err := s.Stat(id, key)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	_, r, err := s.readStream(id, key)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	_, err = io.Copy(io.Discard, newVerifyingReader(r, meta.Checksum))
+	return err
+}
+
+// writeMeta records the metadata of the object with the given key.
+func (s *Store) writeMeta(id string, key string, meta ObjectMeta) error {
+	return s.writeMetaBlob(s.metaName(id, key), meta)
+}
+
+// writeMetaBlob writes meta to the metadata blob name.
+func (s *Store) writeMetaBlob(name string, meta ObjectMeta) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	_, err = s.Storage.Write(name, bytes.NewReader(b))
+	return err
+}
+
+// readMetaBlob reads the metadata blob name.
+func (s *Store) readMetaBlob(name string) (ObjectMeta, error) {
+	var meta ObjectMeta
+
+	b, err := s.readBlob(name)
+	if err != nil {
+		return meta, err
+	}
+	err = json.Unmarshal(b, &meta)
+
+	return meta, err
+}
+
+// readBlob reads all of the blob name.
+func (s *Store) readBlob(name string) ([]byte, error) {
+	blob, err := s.Storage.Read(name)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+
+	return io.ReadAll(blob)
+}
+
+// verifyingReader hashes everything read through it and fails with
+// ErrCorrupt at EOF if the hash does not match the expected checksum.
+type verifyingReader struct {
+	r    io.Reader
+	h    hash.Hash
+	want string
+}
+
+// newVerifyingReader wraps r so that reading it to the end verifies it
+// against the hex encoded SHA-256 checksum want.
+func newVerifyingReader(r io.Reader, want string) *verifyingReader {
+	return &verifyingReader{
+		r:    r,
+		h:    sha256.New(),
+		want: want,
+	}
+}
+
+// Read implements io.Reader.
+func (v *verifyingReader) Read(b []byte) (int, error) {
+	n, err := v.r.Read(b)
+	v.h.Write(b[:n])
+	if err == io.EOF {
+		if have := hex.EncodeToString(v.h.Sum(nil)); have != v.want {
+			return n, fmt.Errorf("%w: checksum %s does not match recorded %s", ErrCorrupt, have, v.want)
+		}
+	}
+	return n, err
+}
+
+// Close closes the underlying reader if it is an io.Closer.
+func (v *verifyingReader) Close() error {
+	if c, ok := v.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
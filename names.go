@@ -0,0 +1,111 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// maxNameComponentLength is the longest path component accepted in a name,
+// the limit of most file systems.
+const maxNameComponentLength = 255
+
+// ErrInvalidName is matched by every InvalidNameError.
+var ErrInvalidName = errors.New("invalid name")
+
+// InvalidNameError is returned for a namespace ID, key or blob name that is
+// rejected because it could refer to something outside its place in the
+// store, such as a key whose path climbs out of its namespace with "..".
+// These come from peers and clients, so they are never trusted.
+type InvalidNameError struct {
+	// Kind is what was rejected: a namespace, a key, a transfer or a blob.
+	Kind string
+	// Name is the rejected value.
+	Name string
+	// Reason tells what is wrong with it.
+	Reason string
+}
+
+// Error implements error.
+func (e *InvalidNameError) Error() string {
+	return fmt.Sprintf("invalid %s %q: %s", e.Kind, e.Name, e.Reason)
+}
+
+// Unwrap returns ErrInvalidName.
+func (e *InvalidNameError) Unwrap() error {
+	return ErrInvalidName
+}
+
+// checkPath checks that name is a relative, slash separated path that stays
+// below the directory it is resolved against.
+func checkPath(kind string, name string) error {
+	if reason := pathProblem(name); len(reason) > 0 {
+		return &InvalidNameError{Kind: kind, Name: name, Reason: reason}
+	}
+	return nil
+}
+
+// pathProblem returns what keeps the path name from being used by checkPath,
+// or nothing if it can be.
+func pathProblem(name string) string {
+	if strings.ContainsAny(name, "\\\x00") {
+		return "contains a backslash or NUL byte"
+	}
+	for _, component := range strings.Split(name, "/") {
+		switch {
+		case len(component) == 0:
+			return "has an empty path component"
+		case component == "." || component == "..":
+			return fmt.Sprintf("has path component %q", component)
+		case len(component) > maxNameComponentLength:
+			return "has a path component that is too long"
+		}
+	}
+	return ""
+}
+
+// checkComponent checks that name can be used as a single path component
+// that is not hidden, since hidden names are kept for the store's own use.
+func checkComponent(kind string, name string) error {
+	if err := checkPath(kind, name); err != nil {
+		return err
+	}
+	if strings.Contains(name, "/") {
+		return &InvalidNameError{Kind: kind, Name: name, Reason: "contains a slash"}
+	}
+	if strings.HasPrefix(name, ".") {
+		return &InvalidNameError{Kind: kind, Name: name, Reason: "starts with a dot"}
+	}
+	return nil
+}
+
+// checkBlobName checks a blob name before a Storage acts on it.
+func checkBlobName(name string) error {
+	return checkPath("blob name", name)
+}
+
+// checkNamespace checks a namespace ID.
+func checkNamespace(id string) error {
+	return checkComponent("namespace", id)
+}
+
+// checkKey checks the namespace ID and key of an object, and the path the
+// PathTransformFunc turns the key into. The path must not use the suffixes
+// the store gives the metadata and history of objects, so no object can
+// pass for part of another one.
+func (s *Store) checkKey(id string, key string) error {
+	if err := checkNamespace(id); err != nil {
+		return err
+	}
+
+	path := s.PathTransformFunc(key).FullPath()
+	if reason := pathProblem(path); len(reason) > 0 {
+		return &InvalidNameError{Kind: "key", Name: key, Reason: fmt.Sprintf("path %q %s", path, reason)}
+	}
+	for _, component := range strings.Split(path, "/") {
+		if isMetaFile(component) || isVersionsDir(component) {
+			return &InvalidNameError{Kind: "key", Name: key, Reason: fmt.Sprintf("path %q uses a reserved suffix", path)}
+		}
+	}
+	return nil
+}
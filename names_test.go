@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStoreRejectsInvalidNames(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "root")
+	s := NewStore(StoreOpts{Root: root})
+	id := generateID()
+
+	tests := []struct {
+		name string
+		id   string
+		key  string
+	}{
+		{name: "climbing key", id: id, key: "../../escaped"},
+		{name: "climbing nested key", id: id, key: "photos/../../../escaped"},
+		{name: "absolute key", id: id, key: "/escaped"},
+		{name: "backslash key", id: id, key: "..\\..\\escaped"},
+		{name: "nul key", id: id, key: "escaped\x00"},
+		{name: "empty key", id: id, key: ""},
+		{name: "long key", id: id, key: strings.Repeat("a", maxNameComponentLength+1)},
+		{name: "reserved suffix", id: id, key: "photos.meta"},
+		{name: "history of another key", id: id, key: "photos.versions/1"},
+		{name: "climbing namespace", id: "..", key: "escaped"},
+		{name: "nested namespace", id: "../escaped", key: "key"},
+		{name: "hidden namespace", id: ".quarantine", key: "key"},
+		{name: "empty namespace", id: "", key: "key"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := s.Write(tt.id, tt.key, bytes.NewReader([]byte("data")))
+			var nameErr *InvalidNameError
+			if !errors.As(err, &nameErr) || !errors.Is(err, ErrInvalidName) {
+				t.Fatalf("expected write to fail with an InvalidNameError, have %v", err)
+			}
+
+			if _, _, err := s.Read(tt.id, tt.key); !errors.Is(err, ErrInvalidName) {
+				t.Errorf("expected read to fail with ErrInvalidName, have %v", err)
+			}
+			if _, _, err := s.ReadRange(tt.id, tt.key, 0, 1); !errors.Is(err, ErrInvalidName) {
+				t.Errorf("expected range read to fail with ErrInvalidName, have %v", err)
+			}
+			if err := s.Delete(tt.id, tt.key); !errors.Is(err, ErrInvalidName) {
+				t.Errorf("expected delete to fail with ErrInvalidName, have %v", err)
+			}
+			if s.Has(tt.id, tt.key) {
+				t.Errorf("expected not to have an invalid key")
+			}
+		})
+	}
+
+	if _, err := s.List("../.."); !errors.Is(err, ErrInvalidName) {
+		t.Errorf("expected listing a climbing namespace to fail with ErrInvalidName, have %v", err)
+	}
+	if _, err := s.OpenTransfer(TransferState{ID: "../escaped", Namespace: id, Key: "key"}); !errors.Is(err, ErrInvalidName) {
+		t.Errorf("expected opening a climbing transfer to fail with ErrInvalidName, have %v", err)
+	}
+
+	// Nothing was written next to the root.
+	entries, err := os.ReadDir(filepath.Dir(root))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.Name() != "root" {
+			t.Errorf("expected nothing outside the root, have %s", entry.Name())
+		}
+	}
+}
+
+func TestDiskStorageRejectsInvalidNames(t *testing.T) {
+	storage := NewDiskStorage(filepath.Join(t.TempDir(), "root"))
+
+	for _, name := range []string{"../escaped", "a/../../escaped", "/escaped", "a//b", "a\\b", ""} {
+		if _, err := storage.Write(name, bytes.NewReader([]byte("data"))); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("expected writing %q to fail with ErrInvalidName, have %v", name, err)
+		}
+		if _, err := storage.Read(name); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("expected reading %q to fail with ErrInvalidName, have %v", name, err)
+		}
+		if err := storage.Rename("a", name); !errors.Is(err, ErrInvalidName) {
+			t.Errorf("expected renaming to %q to fail with ErrInvalidName, have %v", name, err)
+		}
+		if storage.Has(name) {
+			t.Errorf("expected not to have %q", name)
+		}
+	}
+}
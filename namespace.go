@@ -0,0 +1,160 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// ErrUnknownNamespace is returned for an operation on a namespace this node
+// has not been configured with.
+var ErrUnknownNamespace = errors.New("unknown namespace")
+
+// ErrReadOnlyNamespace is returned for a write or delete in a namespace whose
+// policy makes it read-only.
+var ErrReadOnlyNamespace = errors.New("namespace is read-only")
+
+// NamespacePolicy controls how the files of a namespace are replicated and
+// what may be done with them.
+type NamespacePolicy struct {
+	// ReplicationFactor is the number of copies of a file to keep, the
+	// local one included. Zero keeps a copy on every peer.
+	ReplicationFactor int
+	// WriteConsistency is the consistency level Store waits for.
+	WriteConsistency ConsistencyLevel
+	// ReadConsistency is the number of replicas Get consults.
+	ReadConsistency ConsistencyLevel
+	// ReadOnly refuses writes and deletes through this node.
+	ReadOnly bool
+	// Convergent encrypts replicas under a data key and IV derived from
+	// their content and the ConvergenceSecret of the server, so identical
+	// files give identical replicas. It reveals which files are equal. The
+	// store does not deduplicate the replicas itself; each key keeps its
+	// own copy.
+	Convergent bool
+}
+
+// NamespaceOpts configures a namespace: a bucket of files with its own
+// master keys, quota and policy, independent of the nodes that write to it.
+// Every node a namespace is used through needs the same keys, so each of them
+// can read the files the others wrote.
+type NamespaceOpts struct {
+	// KeyProvider holds the master keys that wrap the data keys the
+	// replicas of the files of the namespace are encrypted with. It defaults
+	// to the KeyProvider of the server.
+	KeyProvider KeyProvider
+	// Quota limits the number of bytes this node stores for the namespace,
+	// replicas held for other nodes included. Zero is unlimited.
+	Quota int64
+	// Policy replaces the replication and consistency options of the server
+	// for the namespace. It replaces them as a whole: fields left at their
+	// zero value keep it rather than falling back to the options of the
+	// server, so a policy that only sets Convergent also keeps a copy on
+	// every peer at ConsistencyOne. Without a Policy the options of the
+	// server apply.
+	Policy *NamespacePolicy
+}
+
+// namespace is a namespace as configured on this node, with the defaults of
+// the server filled in.
+type namespace struct {
+	NamespacePolicy
+
+	name string
+	keys KeyProvider
+}
+
+// namespace returns the configuration of the namespace with the given name.
+func (s *FileServer) namespace(name string) (namespace, error) {
+	if err := checkNamespace(name); err != nil {
+		return namespace{}, err
+	}
+	opts, ok := s.Namespaces[name]
+	if !ok {
+		return namespace{}, fmt.Errorf("%w: (%s)", ErrUnknownNamespace, name)
+	}
+
+	ns := namespace{
+		NamespacePolicy: NamespacePolicy{
+			ReplicationFactor: s.ReplicationFactor,
+			WriteConsistency:  s.WriteConsistency,
+			ReadConsistency:   s.ReadConsistency,
+		},
+		name: name,
+		keys: opts.KeyProvider,
+	}
+	if opts.Policy != nil {
+		ns.NamespacePolicy = *opts.Policy
+	}
+	if ns.keys == nil {
+		ns.keys = s.KeyProvider
+	}
+
+	return ns, nil
+}
+
+// errNoKeyProvider is returned when a data key has to be wrapped or unwrapped
+// for a namespace without a KeyProvider.
+var errNoKeyProvider = errors.New("no key provider configured")
+
+// currentKeyID returns the ID of the master key new data keys of the
+// namespace are wrapped with.
+func (ns namespace) currentKeyID() (string, error) {
+	if ns.keys == nil {
+		return "", fmt.Errorf("%w for namespace (%s)", errNoKeyProvider, ns.name)
+	}
+	return ns.keys.CurrentKeyID()
+}
+
+// wrapKey wraps a data key of the namespace with its current master key.
+func (ns namespace) wrapKey(dataKey []byte) (string, []byte, error) {
+	if ns.keys == nil {
+		return "", nil, fmt.Errorf("%w for namespace (%s)", errNoKeyProvider, ns.name)
+	}
+	return ns.keys.WrapKey(dataKey, ns.name)
+}
+
+// unwrapKey unwraps a data key of the namespace wrapped with the master key
+// with the given ID.
+func (ns namespace) unwrapKey(id string, wrapped []byte) ([]byte, error) {
+	if ns.keys == nil {
+		return nil, fmt.Errorf("%w for namespace (%s)", errNoKeyProvider, ns.name)
+	}
+	if len(wrapped) == 0 {
+		return nil, errors.New("replica has no data key")
+	}
+	return ns.keys.UnwrapKey(id, wrapped, ns.name)
+}
+
+// writable returns the namespace with the given name, failing with
+// ErrReadOnlyNamespace if it may not be written to.
+func (s *FileServer) writable(name string) (namespace, error) {
+	ns, err := s.namespace(name)
+	if err == nil && ns.ReadOnly {
+		err = fmt.Errorf("%w: (%s)", ErrReadOnlyNamespace, name)
+	}
+	return ns, err
+}
+
+// namespaceNames returns the names of the namespaces this node is
+// configured with, sorted.
+func (s *FileServer) namespaceNames() []string {
+	names := make([]string, 0, len(s.Namespaces))
+	for name := range s.Namespaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// namespaceQuotas returns the quotas of the configured namespaces that have
+// one, keyed by namespace name.
+func namespaceQuotas(namespaces map[string]NamespaceOpts) map[string]int64 {
+	quotas := make(map[string]int64)
+	for name, opts := range namespaces {
+		if opts.Quota > 0 {
+			quotas[name] = opts.Quota
+		}
+	}
+	return quotas
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/Dhruv-mak/godiststore/p2p"
+)
+
+// newNamespaceServer creates a FileServer like newTestServer, with the given
+// key provider and namespaces.
+func newNamespaceServer(t *testing.T, keys KeyProvider, namespaces map[string]NamespaceOpts) *FileServer {
+	tr := p2p.NewTCPTransport(p2p.TCPTransportOpts{
+		ListenAddr:    ":0",
+		HandshakeFunc: p2p.NOPHandshakeFunc,
+		Decoder:       p2p.DefaultDecoder{},
+	})
+
+	return NewFileServer(FileServerOpts{
+		KeyProvider:       keys,
+		StorageRoot:       t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+		Transport:         tr,
+		Namespaces:        namespaces,
+	})
+}
+
+func TestFileServerNamespaces(t *testing.T) {
+	ownKeys := NewKeyring(newEncryptionKey())
+	s := newNamespaceServer(t, NewKeyring(newEncryptionKey()), map[string]NamespaceOpts{
+		"photos":   {KeyProvider: ownKeys},
+		"invoices": {Quota: 100},
+		"archive":  {Policy: &NamespacePolicy{ReadOnly: true}},
+	})
+
+	// The same key holds different files in different namespaces.
+	for _, ns := range []string{"photos", "invoices"} {
+		if err := s.Store(ns, "key", bytes.NewReader([]byte(ns))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, ns := range []string{"photos", "invoices"} {
+		r, err := s.Get(ns, "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, _ := io.ReadAll(r); string(b) != ns {
+			t.Errorf("expected (key) in %s to hold %s, have %s", ns, ns, b)
+		}
+	}
+
+	// Data keys are wrapped for a single namespace.
+	photos, _ := s.namespace("photos")
+	invoices, _ := s.namespace("invoices")
+	archive, _ := s.namespace("archive")
+	if photos.keys != ownKeys || invoices.keys != s.KeyProvider {
+		t.Errorf("expected namespaces to use their own key provider or that of the server")
+	}
+	id, wrapped, err := invoices.wrapKey(newEncryptionKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := archive.unwrapKey(id, wrapped); err == nil {
+		t.Errorf("expected data key of one namespace not to unwrap for another")
+	}
+
+	if _, err := s.StoreWithOptions("invoices", "large", bytes.NewReader(make([]byte, 200)), WriteOptions{}); !errors.Is(err, ErrInsufficientSpace) {
+		t.Errorf("expected write over the quota of the namespace to fail with %s, have %v", ErrInsufficientSpace, err)
+	}
+	if err := s.Store("photos", "large", bytes.NewReader(make([]byte, 200))); err != nil {
+		t.Errorf("expected quota not to apply to other namespaces: %s", err)
+	}
+
+	if err := s.Store("archive", "key", bytes.NewReader([]byte("data"))); !errors.Is(err, ErrReadOnlyNamespace) {
+		t.Errorf("expected write to read-only namespace to fail with %s, have %v", ErrReadOnlyNamespace, err)
+	}
+	if err := s.Delete("archive", "key"); !errors.Is(err, ErrReadOnlyNamespace) {
+		t.Errorf("expected delete in read-only namespace to fail with %s, have %v", ErrReadOnlyNamespace, err)
+	}
+
+	if err := s.Store("unknown", "key", bytes.NewReader([]byte("data"))); !errors.Is(err, ErrUnknownNamespace) {
+		t.Errorf("expected write to unknown namespace to fail with %s, have %v", ErrUnknownNamespace, err)
+	}
+	if _, err := s.Get("../photos", "key"); !errors.Is(err, ErrInvalidName) {
+		t.Errorf("expected get from invalid namespace to fail with %s, have %v", ErrInvalidName, err)
+	}
+}
+
+func TestNamespacePolicyReplacesServerPolicy(t *testing.T) {
+	s := newNamespaceServer(t, NewKeyring(newEncryptionKey()), map[string]NamespaceOpts{
+		"default":    {},
+		"convergent": {Policy: &NamespacePolicy{Convergent: true}},
+	})
+	s.ReplicationFactor = 3
+	s.WriteConsistency = ConsistencyQuorum
+	s.ReadConsistency = ConsistencyAll
+
+	ns, err := s.namespace("default")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := NamespacePolicy{ReplicationFactor: 3, WriteConsistency: ConsistencyQuorum, ReadConsistency: ConsistencyAll}
+	if ns.NamespacePolicy != want {
+		t.Errorf("expected the options of the server without a policy, have %+v", ns.NamespacePolicy)
+	}
+
+	// Fields a policy leaves unset are not taken from the server.
+	ns, err = s.namespace("convergent")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (NamespacePolicy{Convergent: true}); ns.NamespacePolicy != want {
+		t.Errorf("expected the policy to replace the options of the server, have %+v", ns.NamespacePolicy)
+	}
+}
+
+func TestFileServerReadsReplicaOfOtherNode(t *testing.T) {
+	keys := NewKeyring(newEncryptionKey())
+	namespaces := map[string]NamespaceOpts{"shared": {}}
+	writer := newNamespaceServer(t, keys, namespaces)
+	reader := newNamespaceServer(t, keys, namespaces)
+
+	data := []byte("written on one node, read on another")
+	if err := writer.Store("shared", "key", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	handReplica(t, writer, reader, "shared", "key")
+
+	if meta, ok := reader.store.head("shared", hashKey("key")); !ok || !meta.Replica {
+		t.Fatalf("expected reader to hold a replica, have %+v", meta)
+	}
+
+	got, err := reader.Get("shared", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(got); !bytes.Equal(b, data) {
+		t.Errorf("expected %s, have %s", data, b)
+	}
+}
+
+// handReplica hands the encrypted replica that from would send to its peers
+// of the file with the given key in namespace name over to to.
+func handReplica(t *testing.T, from *FileServer, to *FileServer, name string, key string) {
+	t.Helper()
+
+	ns, err := from.namespace(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := from.newUpload(ns, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, src, err := from.store.openReaderAt(name, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	r, err := newEncryptReaderAt(u.dataKey, u.IV, src, u.size, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := MessageStoreFile{
+		TransferID:  u.TransferID,
+		Namespace:   u.Namespace,
+		Key:         u.Key,
+		Size:        u.Total(),
+		ContentHash: u.ContentHash,
+		Version:     u.Version,
+		KeyID:       u.KeyID,
+		WrappedKey:  u.WrappedKey,
+	}
+	if _, err := to.receiveUpload(r, msg); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,10 +1,15 @@
 package p2p
 
 import (
+	"encoding/binary"
 	"encoding/gob"
+	"fmt"
 	"io"
 )
 
+// MaxMessageSize is the largest message payload DefaultDecoder accepts.
+const MaxMessageSize = 16 << 20
+
 // Decoder defines an interface for decoding RPC messages from an io.Reader.
 type Decoder interface {
 	Decode(io.Reader, *RPC) error
@@ -24,7 +29,7 @@ type DefaultDecoder struct{}
 // Decode decodes an RPC message from the given io.Reader using custom logic.
 // It first reads a byte to determine if the message is part of a stream.
 // If it is a stream, it sets the Stream field of the RPC message to true and returns.
-// Otherwise, it reads the payload into the RPC message.
+// Otherwise, it reads the length prefixed payload written by Frame into the RPC message.
 func (dec DefaultDecoder) Decode(r io.Reader, msg *RPC) error {
 	peerBuf := make([]byte, 1)
 	if _, err := r.Read(peerBuf); err != nil {
@@ -38,13 +43,30 @@ func (dec DefaultDecoder) Decode(r io.Reader, msg *RPC) error {
 		return nil
 	}
 
-	buf := make([]byte, 1024)
-	n, err := r.Read(buf)
-	if err != nil {
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
 		return err
 	}
+	if size > MaxMessageSize {
+		return fmt.Errorf("message of %d bytes exceeds the maximum of %d", size, MaxMessageSize)
+	}
 
-	msg.Payload = buf[:n]
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return err
+	}
+
+	msg.Payload = buf
 
 	return nil
 }
+
+// Frame prepends the IncomingMessage marker and the payload length to payload
+// so the message can be sent with a single write and decoded in full by
+// DefaultDecoder regardless of how the bytes arrive.
+func Frame(payload []byte) []byte {
+	buf := make([]byte, 5, 5+len(payload))
+	buf[0] = IncomingMessage
+	binary.BigEndian.PutUint32(buf[1:], uint32(len(payload)))
+	return append(buf, payload...)
+}
@@ -6,6 +6,7 @@ import (
 	"log"
 	"net"
 	"sync"
+	"time"
 )
 
 // TCPPeer represents the remote node over a TCP established connection.
@@ -18,6 +19,9 @@ type TCPPeer struct {
 	outbound bool
 
 	wg *sync.WaitGroup
+	// streams is signalled when a stream starts. The read loop pauses
+	// until the stream is closed, so at most one signal is pending.
+	streams chan struct{}
 }
 
 func NewTCPPeer(conn net.Conn, outbound bool) *TCPPeer {
@@ -25,6 +29,20 @@ func NewTCPPeer(conn net.Conn, outbound bool) *TCPPeer {
 		Conn:     conn,
 		outbound: outbound,
 		wg:       &sync.WaitGroup{},
+		streams:  make(chan struct{}, 1),
+	}
+}
+
+// WaitStream implements the Peer interface. The read loop of the connection
+// is paused once it has seen the stream start, so the stream can be read
+// from the peer as soon as WaitStream returns. Every stream has to be waited
+// for before it is read, or its reader and the read loop race for its bytes.
+func (p *TCPPeer) WaitStream(timeout time.Duration) error {
+	select {
+	case <-p.streams:
+		return nil
+	case <-time.After(timeout):
+		return fmt.Errorf("no stream from %s within %s", p.RemoteAddr(), timeout)
 	}
 }
 
@@ -157,6 +175,10 @@ func (t *TCPTransport) handleConn(conn net.Conn, outbound bool) {
 
 		if rpc.Stream {
 			peer.wg.Add(1)
+			select {
+			case peer.streams <- struct{}{}:
+			default:
+			}
 			fmt.Printf("[%s] incoming stream, waiting...\n", conn.RemoteAddr())
 			peer.wg.Wait()
 			fmt.Printf("[%s] stream closed, resuming read loop\n", conn.RemoteAddr())
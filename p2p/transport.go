@@ -1,11 +1,17 @@
 package p2p
 
-import "net"
+import (
+	"net"
+	"time"
+)
 
 // Peer is an interface that represents the remote node.
 type Peer interface {
 	net.Conn
 	Send([]byte) error
+	// WaitStream waits up to the given timeout for the remote node to
+	// start a stream, which has to be closed with CloseStream once read.
+	WaitStream(time.Duration) error
 	CloseStream()
 }
 
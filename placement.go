@@ -0,0 +1,278 @@
+package main
+
+import (
+	"hash/fnv"
+	"log"
+	"math"
+	"sort"
+
+	"github.com/Dhruv-mak/godiststore/p2p"
+)
+
+// minPlacementWeight is the share of the weight of the emptiest node that
+// every node is given at least when placing replicas.
+const minPlacementWeight = 0.01
+
+// Labels describe where a node sits in the failure domains of the cluster.
+type Labels struct {
+	Zone string
+	Rack string
+	Host string
+}
+
+// NodeInfo is what a node advertises about itself to its peers.
+type NodeInfo struct {
+	ID     string
+	Labels Labels
+	// Capacity is the capacity of the node and how much of it is in use.
+	Capacity Capacity
+	// Free is the number of bytes the node can still store, namespace
+	// quotas aside.
+	Free int64
+	// Namespaces are the namespaces the node is configured with.
+	Namespaces []string
+	// Draining is set once the node is being drained, after which it is
+	// not picked to hold replicas anymore.
+	Draining bool
+	// Addr is the address the node is connected to us on. It is filled in
+	// by the receiving side.
+	Addr string
+}
+
+// MessageNodeInfo asks a peer for its NodeInfo.
+type MessageNodeInfo struct{}
+
+// MessageNodeInfoResponse answers MessageNodeInfo.
+type MessageNodeInfoResponse struct {
+	Info NodeInfo
+}
+
+// PlacementFunc picks n of the given peers to hold the replicas of key, in
+// addition to the local copy held by local.
+type PlacementFunc func(key string, local NodeInfo, peers []NodeInfo, n int) []NodeInfo
+
+// SpreadPlacementFunc spreads the replicas of a key across as many zones,
+// then racks, then hosts as it can, counting the local copy. Between peers
+// that add the same diversity it picks by rendezvous hashing weighted by free
+// space, so emptier nodes get proportionally more replicas and every node
+// computes the same placement for a key from the same view of the cluster.
+func SpreadPlacementFunc(key string, local NodeInfo, peers []NodeInfo, n int) []NodeInfo {
+	ranked := make([]NodeInfo, len(peers))
+	copy(ranked, peers)
+
+	weights := placementWeights(peers)
+	scores := make(map[string]float64, len(peers))
+	for _, peer := range peers {
+		scores[peer.ID] = rendezvousScore(key, peer.ID, weights[peer.ID])
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		return scores[ranked[i].ID] > scores[ranked[j].ID]
+	})
+
+	chosen := []NodeInfo{local}
+	for len(chosen) <= n && len(ranked) > 0 {
+		best, bestSpread := 0, -1
+		for i, peer := range ranked {
+			if spread := placementSpread(peer.Labels, chosen); spread > bestSpread {
+				best, bestSpread = i, spread
+			}
+		}
+		chosen = append(chosen, ranked[best])
+		ranked = append(ranked[:best], ranked[best+1:]...)
+	}
+
+	return chosen[1:]
+}
+
+// placementSpread rates how much placing a replica on a node with the given
+// labels adds to the failure domains already covered by chosen: 3 for a new
+// zone, 2 for a new rack, 1 for a new host and 0 otherwise.
+func placementSpread(labels Labels, chosen []NodeInfo) int {
+	newZone, newRack, newHost := true, true, true
+	for _, node := range chosen {
+		if node.Labels.Zone == labels.Zone {
+			newZone = false
+			if node.Labels.Rack == labels.Rack {
+				newRack = false
+				if node.Labels.Host == labels.Host {
+					newHost = false
+				}
+			}
+		}
+	}
+
+	switch {
+	case newZone:
+		return 3
+	case newRack:
+		return 2
+	case newHost:
+		return 1
+	}
+	return 0
+}
+
+// placementWeights returns the placement weight of every node, the space it
+// has free. Nodes without a capacity limit weigh as much as the node with the
+// most free space that has one, and no node weighs less than
+// minPlacementWeight of that, so full nodes still rank below the others
+// rather than not at all.
+func placementWeights(nodes []NodeInfo) map[string]float64 {
+	var largest int64 = 1
+	for _, node := range nodes {
+		if node.Capacity.Total > 0 {
+			largest = max(largest, node.Free)
+		}
+	}
+	floor := max(float64(largest)*minPlacementWeight, 1)
+
+	weights := make(map[string]float64, len(nodes))
+	for _, node := range nodes {
+		free := node.Free
+		if node.Capacity.Total == 0 {
+			free = largest
+		}
+		weights[node.ID] = max(float64(free), floor)
+	}
+	return weights
+}
+
+// rendezvousScore returns the weighted rendezvous hashing score of a node for
+// a key.
+func rendezvousScore(key string, nodeID string, weight float64) float64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write([]byte(nodeID))
+
+	// Map the hash into (0, 1).
+	u := (float64(h.Sum64()>>11) + 0.5) / (1 << 53)
+	return -weight / math.Log(u)
+}
+
+// localInfo returns the NodeInfo of this node.
+func (s *FileServer) localInfo() NodeInfo {
+	info := NodeInfo{
+		ID:         s.ID,
+		Labels:     s.Labels,
+		Namespaces: s.namespaceNames(),
+		Draining:   s.draining.Load(),
+		Addr:       s.Transport.Addr(),
+	}
+	if capacity, err := s.store.Capacity(); err == nil {
+		info.Capacity = capacity
+	}
+	if free, err := s.store.free(); err == nil {
+		info.Free = free
+	}
+	return info
+}
+
+// peerInfo returns what peer last advertised about itself. Peers that have
+// not advertised anything yet are identified by their address and assumed
+// to have room.
+func (s *FileServer) peerInfo(peer p2p.Peer) NodeInfo {
+	addr := peer.RemoteAddr().String()
+
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	if info, ok := s.peerInfos[addr]; ok {
+		return info
+	}
+	return NodeInfo{ID: addr, Addr: addr, Free: math.MaxInt64}
+}
+
+// peerHasSpace reports whether peer may have room for size more bytes, going
+// by the free space it last reported.
+func (s *FileServer) peerHasSpace(peer p2p.Peer, size int64) bool {
+	return size <= s.peerInfo(peer).Free
+}
+
+// setPeerFree records the free space peer reported.
+func (s *FileServer) setPeerFree(peer p2p.Peer, free int64) {
+	info := s.peerInfo(peer)
+	info.Free = free
+
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
+
+	s.peerInfos[info.Addr] = info
+}
+
+// refreshPeerInfo asks peer to advertise its labels, capacity and namespaces.
+func (s *FileServer) refreshPeerInfo(peer p2p.Peer) {
+	resp, err := s.request(peer, MessageNodeInfo{})
+	if err != nil {
+		log.Printf("[%s] node info request to %s failed: %s", s.Transport.Addr(), peer.RemoteAddr(), err)
+		return
+	}
+	msg, ok := resp.(MessageNodeInfoResponse)
+	if !ok {
+		log.Printf("[%s] unexpected response %T to node info request", s.Transport.Addr(), resp)
+		return
+	}
+
+	info := msg.Info
+	info.Addr = peer.RemoteAddr().String()
+
+	s.peerLock.Lock()
+	s.peerInfos[info.Addr] = info
+	s.peerLock.Unlock()
+}
+
+// handleMessageNodeInfo answers a request for this node's NodeInfo.
+func (s *FileServer) handleMessageNodeInfo(from string, requestID string, msg MessageNodeInfo) error {
+	return s.reply(from, requestID, MessageNodeInfoResponse{Info: s.localInfo()})
+}
+
+// placementKey returns the key the replicas of the file stored under the
+// hashed key in namespace id are placed by. It is built from the hashed key,
+// which is all a node holding a replica knows of the file, so a draining node
+// moves its replicas where the writer would have placed them.
+func placementKey(id string, hashed string) string {
+	return id + "/" + hashed
+}
+
+// replicaPeers returns the peers that hold the replicas of key in namespace ns
+// according to the placement policy, given the current view of the cluster.
+// Without a replication factor every peer holds a replica.
+func (s *FileServer) replicaPeers(ns namespace, key string) []p2p.Peer {
+	return s.placePeers(ns, key, 0)
+}
+
+// placePeers picks the peers to send the replicas of a new write of size
+// bytes to, following the replication factor of namespace ns. Draining peers
+// are left out, and peers known to lack the space for it are passed over in
+// favour of others.
+func (s *FileServer) placePeers(ns namespace, key string, size int64) []p2p.Peer {
+	var peers []p2p.Peer
+	for _, peer := range s.peerList() {
+		if !s.peerInfo(peer).Draining {
+			peers = append(peers, peer)
+		}
+	}
+	if ns.ReplicationFactor <= 0 || ns.ReplicationFactor-1 >= len(peers) {
+		return peers
+	}
+
+	byID := make(map[string]p2p.Peer, len(peers))
+	infos := make([]NodeInfo, 0, len(peers))
+	for _, peer := range peers {
+		info := s.peerInfo(peer)
+		if size > 0 && info.Free < size {
+			continue
+		}
+		byID[info.ID] = peer
+		infos = append(infos, info)
+	}
+
+	local := NodeInfo{ID: s.ID, Labels: s.Labels}
+	placed := s.PlacementFunc(placementKey(ns.name, hashKey(key)), local, infos, ns.ReplicationFactor-1)
+
+	chosen := make([]p2p.Peer, 0, len(placed))
+	for _, info := range placed {
+		chosen = append(chosen, byID[info.ID])
+	}
+	return chosen
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestSpreadPlacementSpreadsAcrossZones(t *testing.T) {
+	local := NodeInfo{ID: "local", Labels: Labels{Zone: "a", Rack: "1", Host: "h0"}}
+	peers := []NodeInfo{
+		{ID: "n1", Labels: Labels{Zone: "a", Rack: "1", Host: "h1"}},
+		{ID: "n2", Labels: Labels{Zone: "a", Rack: "2", Host: "h2"}},
+		{ID: "n3", Labels: Labels{Zone: "b", Rack: "1", Host: "h3"}},
+		{ID: "n4", Labels: Labels{Zone: "b", Rack: "2", Host: "h4"}},
+		{ID: "n5", Labels: Labels{Zone: "c", Rack: "1", Host: "h5"}},
+	}
+
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		placed := SpreadPlacementFunc(key, local, peers, 2)
+		if len(placed) != 2 {
+			t.Fatalf("expected 2 replicas, have %d", len(placed))
+		}
+
+		zones := map[string]bool{local.Labels.Zone: true}
+		for _, node := range placed {
+			zones[node.Labels.Zone] = true
+		}
+		if len(zones) != 3 {
+			t.Errorf("expected replicas of (%s) in 3 zones, have %v", key, placed)
+		}
+
+		again := SpreadPlacementFunc(key, local, peers, 2)
+		if again[0].ID != placed[0].ID || again[1].ID != placed[1].ID {
+			t.Errorf("expected placement of (%s) to be stable, have %v and %v", key, placed, again)
+		}
+	}
+
+	// With more replicas than zones, racks are spread next.
+	placed := SpreadPlacementFunc("key", local, peers, 4)
+	racks := map[Labels]bool{{Zone: "a", Rack: "1"}: true}
+	for _, node := range placed {
+		racks[Labels{Zone: node.Labels.Zone, Rack: node.Labels.Rack}] = true
+	}
+	if len(racks) != 5 {
+		t.Errorf("expected replicas in 5 racks, have %v", placed)
+	}
+}
+
+func TestSpreadPlacementWeightsByFreeSpace(t *testing.T) {
+	local := NodeInfo{ID: "local"}
+	place := func(peers []NodeInfo) map[string]int {
+		counts := map[string]int{}
+		for i := 0; i < 4000; i++ {
+			placed := SpreadPlacementFunc(fmt.Sprintf("key_%d", i), local, peers, 1)
+			counts[placed[0].ID]++
+		}
+		return counts
+	}
+
+	counts := place([]NodeInfo{
+		{ID: "small", Capacity: Capacity{Total: 1 << 30}, Free: 1 << 30},
+		{ID: "big", Capacity: Capacity{Total: 3 << 30}, Free: 3 << 30},
+	})
+	if ratio := float64(counts["big"]) / float64(counts["small"]); ratio < 2.5 || ratio > 3.5 {
+		t.Errorf("expected about 3 times as many replicas on the big node, have %v", counts)
+	}
+
+	// A big node that is nearly full gets fewer replicas than an empty
+	// small one, and a full node still gets a few.
+	counts = place([]NodeInfo{
+		{ID: "small", Capacity: Capacity{Total: 1 << 30}, Free: 1 << 30},
+		{ID: "big", Capacity: Capacity{Total: 3 << 30, Used: 3<<30 - 1<<28}, Free: 1 << 28},
+		{ID: "full", Capacity: Capacity{Total: 3 << 30, Used: 3 << 30}},
+	})
+	if counts["big"] >= counts["small"] {
+		t.Errorf("expected fewer replicas on the nearly full node, have %v", counts)
+	}
+	if counts["full"] == 0 || counts["full"] >= counts["big"] {
+		t.Errorf("expected the full node to rank last but still get replicas, have %v", counts)
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/Dhruv-mak/godiststore/p2p"
+)
+
+// rebalanceDelay is how long the rebalancer waits after a membership change
+// before it starts, so a burst of changes leads to a single pass.
+const rebalanceDelay = time.Second
+
+// errDraining is returned by a node that is being drained when it is asked to
+// take on a new file.
+var errDraining = errors.New("node is draining")
+
+// RebalanceStats counts what a rebalance or drain did.
+type RebalanceStats struct {
+	// Checked is the number of replicas checked on peers.
+	Checked int
+	// Copied is the number of replicas copied to a peer that lacked them.
+	Copied int
+	// Failed is the number of replicas that could not be checked or copied.
+	Failed int
+}
+
+// MessageDraining tells peers that the sender is being drained and must not
+// be picked to hold replicas anymore.
+type MessageDraining struct{}
+
+// requestRebalance schedules a rebalance, unless one is pending already.
+func (s *FileServer) requestRebalance() {
+	select {
+	case s.rebalancech <- struct{}{}:
+	default:
+	}
+}
+
+// rebalancer runs a rebalance after every membership change until the server
+// is stopped.
+func (s *FileServer) rebalancer() {
+	for {
+		select {
+		case <-s.rebalancech:
+			select {
+			case <-time.After(rebalanceDelay):
+			case <-s.quitch:
+				return
+			}
+
+			stats, err := s.Rebalance()
+			if err != nil {
+				log.Println("rebalance error: ", err)
+			}
+			if stats.Copied > 0 || stats.Failed > 0 {
+				fmt.Printf("[%s] rebalanced: %+v\n", s.Transport.Addr(), stats)
+			}
+
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// Rebalance makes sure every file this node holds a plaintext copy of, in the
+// namespaces it is configured with, is held by the peers the placement policy
+// currently picks for it, copying the newest version to those that lack it.
+// It runs on its own whenever a peer joins or starts draining. Copies are
+// sent one at a time, at no more than RebalanceBytesPerSecond, so
+// rebalancing does not starve client traffic.
+//
+// Rebalance only adds copies. Peers the policy no longer picks keep the
+// replicas they hold, so the number of copies of a file can exceed its
+// ReplicationFactor after the cluster changes; the extra copies still take
+// part in reads and are kept up to date by read repair.
+func (s *FileServer) Rebalance() (RebalanceStats, error) {
+	var stats RebalanceStats
+
+	now := time.Now()
+	for _, name := range s.namespaceNames() {
+		ns, err := s.namespace(name)
+		if err != nil {
+			return stats, err
+		}
+		heads, err := s.store.heads(name)
+		if err != nil {
+			return stats, err
+		}
+
+		for _, meta := range heads {
+			if meta.Replica || meta.Expired(now) {
+				continue
+			}
+			for _, peer := range s.replicaPeers(ns, meta.Key) {
+				s.ensureCopy(&stats, peer, name, meta)
+			}
+		}
+	}
+
+	return stats, nil
+}
+
+// Drain prepares this node to leave the cluster without losing the copies it
+// holds. Peers are told to stop placing replicas on it and the node refuses
+// new ones. The files it holds plaintext copies of are then copied to the
+// peers that hold them from now on, and every replica it holds is copied to
+// a peer that lacks it, preferring the ones the placement policy picks for
+// it. The node can be stopped once Drain returns without error.
+func (s *FileServer) Drain() (RebalanceStats, error) {
+	s.draining.Store(true)
+	for _, peer := range s.peerList() {
+		if err := s.send(peer, &Message{Payload: MessageDraining{}}); err != nil {
+			log.Printf("[%s] telling %s about drain failed: %s", s.Transport.Addr(), peer.RemoteAddr(), err)
+		}
+	}
+
+	stats, err := s.Rebalance()
+	if err != nil {
+		return stats, err
+	}
+
+	ids, err := s.store.Namespaces()
+	if err != nil {
+		return stats, err
+	}
+	for _, id := range ids {
+		heads, err := s.store.heads(id)
+		if err != nil {
+			return stats, err
+		}
+		for _, meta := range heads {
+			if !meta.Replica {
+				continue
+			}
+			for _, peer := range s.migrationTargets(meta.Version.NodeID, id, meta.Key) {
+				if s.ensureCopy(&stats, peer, id, meta) {
+					break
+				}
+			}
+		}
+	}
+
+	fmt.Printf("[%s] drained: %+v\n", s.Transport.Addr(), stats)
+
+	if stats.Failed > 0 {
+		return stats, fmt.Errorf("drain left %d replicas behind", stats.Failed)
+	}
+	return stats, nil
+}
+
+// migrationTargets returns the peers the replica stored under the hashed key
+// in namespace ns, written by the node with the given id, can move to, in the
+// order the placement policy prefers them.
+func (s *FileServer) migrationTargets(id string, ns string, key string) []p2p.Peer {
+	owner := NodeInfo{ID: id}
+	byID := make(map[string]p2p.Peer)
+	var infos []NodeInfo
+	for _, peer := range s.peerList() {
+		info := s.peerInfo(peer)
+		if info.ID == id {
+			owner = info
+			continue
+		}
+		if info.Draining {
+			continue
+		}
+		byID[info.ID] = peer
+		infos = append(infos, info)
+	}
+
+	var targets []p2p.Peer
+	for _, info := range s.PlacementFunc(placementKey(ns, key), owner, infos, len(infos)) {
+		targets = append(targets, byID[info.ID])
+	}
+	return targets
+}
+
+// ensureCopy copies the local copy described by meta of a file in namespace
+// id to peer, unless the peer already holds that version or a newer one. It
+// reports whether the peer holds the file afterwards.
+func (s *FileServer) ensureCopy(stats *RebalanceStats, peer p2p.Peer, id string, meta ObjectMeta) bool {
+	stats.Checked++
+
+	key := meta.Key
+	if !meta.Replica {
+		key = hashKey(meta.Key)
+	}
+
+	resp, err := s.request(peer, MessageStat{Namespace: id, Key: key})
+	if err != nil {
+		log.Printf("[%s] checking (%s) on %s failed: %s", s.Transport.Addr(), meta.Key, peer.RemoteAddr(), err)
+		stats.Failed++
+		return false
+	}
+	if stat, ok := resp.(MessageStatResponse); ok && stat.Found && !meta.Version.After(stat.Meta.Version) {
+		return true
+	}
+
+	switch {
+	case meta.Deleted:
+		err = s.sendDelete(peer, MessageDeleteFile{Namespace: id, Key: key, Version: meta.Version})
+	case !meta.Replica:
+		var (
+			ns namespace
+			u  *upload
+		)
+		if ns, err = s.namespace(id); err != nil {
+			break
+		}
+		if u, err = s.newUpload(ns, meta.Key); err == nil {
+			u.bytesPerSecond = s.RebalanceBytesPerSecond
+			err = s.sendUpload(peer, u)
+		}
+	default:
+		u := s.newReplicaUpload(id, meta)
+		u.bytesPerSecond = s.RebalanceBytesPerSecond
+		err = s.sendUpload(peer, u)
+	}
+	if err != nil {
+		log.Printf("[%s] copying (%s) to %s failed: %s", s.Transport.Addr(), meta.Key, peer.RemoteAddr(), err)
+		stats.Failed++
+		return false
+	}
+
+	stats.Copied++
+	return true
+}
+
+// handleMessageDraining marks the sender as draining.
+func (s *FileServer) handleMessageDraining(from string) error {
+	s.peerLock.Lock()
+	peer, ok := s.peers[from]
+	s.peerLock.Unlock()
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+
+	info := s.peerInfo(peer)
+	info.Draining = true
+
+	s.peerLock.Lock()
+	s.peerInfos[from] = info
+	s.peerLock.Unlock()
+
+	fmt.Printf("[%s] peer %s is draining\n", s.Transport.Addr(), from)
+
+	s.requestRebalance()
+
+	return nil
+}
+
+// heads returns the metadata of the current version of every object stored
+// under the given id, tombstones included.
+func (s *Store) heads(id string) ([]ObjectMeta, error) {
+	var heads []ObjectMeta
+	err := s.walk(id, func(name string, base string) error {
+		if meta, err := s.readMetaBlob(name + metaSuffix); err == nil {
+			heads = append(heads, meta)
+		}
+		return nil
+	})
+	return heads, err
+}
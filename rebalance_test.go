@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestDrainRefusesNewReplicas(t *testing.T) {
+	s := newTestServer(t)
+
+	if err := s.Store(testNamespace, "foo", bytes.NewReader([]byte("some bytes"))); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := s.Drain()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats != (RebalanceStats{}) {
+		t.Errorf("expected nothing to do without peers, have %+v", stats)
+	}
+	if !s.localInfo().Draining {
+		t.Errorf("expected node to advertise that it is draining")
+	}
+
+	data := []byte("replica bytes")
+	msg := MessageStoreFile{
+		TransferID: generateID(),
+		Namespace:  generateID(),
+		Key:        "bar",
+		Size:       int64(len(data)),
+	}
+	if _, err := s.receiveUpload(bytes.NewReader(data), msg); !errors.Is(err, errDraining) {
+		t.Errorf("expected draining node to refuse replica with %s, have %v", errDraining, err)
+	}
+	if s.store.Has(msg.Namespace, msg.Key) {
+		t.Errorf("expected refused replica not to be stored")
+	}
+}
+
+func TestRebalanceCopiesToJoiningNode(t *testing.T) {
+	servers := newTestCluster(t, 2)
+	a, b := servers[0], servers[1]
+
+	data := []byte("written before the node joined")
+	if _, err := a.StoreWithOptions(testNamespace, "key", bytes.NewReader(data), WriteOptions{Consistency: ConsistencyAll}); err != nil {
+		t.Fatal(err)
+	}
+
+	c := newClusterServer(t, a.KeyProvider)
+	connectServers(t, c, a)
+	connectServers(t, c, b)
+	waitForPeers(t, a, b, c)
+
+	waitFor(t, "the joining node to receive a copy", func() bool {
+		return c.store.Has(testNamespace, hashKey("key"))
+	})
+	r, err := c.Get(testNamespace, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, _ := io.ReadAll(r); !bytes.Equal(have, data) {
+		t.Errorf("expected %s, have %s", data, have)
+	}
+}
+
+func TestRebalanceLimitsRate(t *testing.T) {
+	servers := newTestCluster(t, 2)
+	a, b := servers[0], servers[1]
+	a.RebalanceBytesPerSecond = 32 << 10
+
+	data := bytes.Repeat([]byte("r"), 64<<10)
+	if _, err := a.StoreWithOptions(testNamespace, "key", bytes.NewReader(data), WriteOptions{Consistency: ConsistencyAll}); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.store.Delete(testNamespace, hashKey("key")); err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	stats, err := a.Rebalance()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Copied != 1 {
+		t.Fatalf("expected one copy to be sent, have %+v", stats)
+	}
+	// 64 KiB at 32 KiB a second takes two seconds.
+	if elapsed := time.Since(start); elapsed < 1500*time.Millisecond {
+		t.Errorf("expected the copy to be sent at no more than %d bytes a second, took %s", a.RebalanceBytesPerSecond, elapsed)
+	}
+	if !b.store.Has(testNamespace, hashKey("key")) {
+		t.Errorf("expected b to hold a copy again")
+	}
+}
+
+func TestMigrationTargetsFollowPlacement(t *testing.T) {
+	servers := newTestCluster(t, 4)
+	writer := servers[0]
+	writer.ReplicationFactor = 2
+	ns, err := writer.namespace(testNamespace)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	placed := writer.replicaPeers(ns, "key")
+	if len(placed) != 1 {
+		t.Fatalf("expected the replica to be placed on one peer, have %d", len(placed))
+	}
+	want := writer.peerInfo(placed[0]).ID
+
+	// A node that does not hold the replica ranks the peers as the writer
+	// does, knowing only the hashed key.
+	for _, s := range servers[1:] {
+		if s.ID == want {
+			continue
+		}
+		targets := s.migrationTargets(writer.ID, testNamespace, hashKey("key"))
+		if len(targets) == 0 || s.peerInfo(targets[0]).ID != want {
+			t.Errorf("expected %s to move the replica to %s first", s.Transport.Addr(), want)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultQuarantineDirName is the prefix corrupt objects are moved under in
+// the storage of the store, unless configured otherwise.
+const defaultQuarantineDirName = ".quarantine"
+
+// ScrubberOpts holds the configuration options for the Scrubber.
+type ScrubberOpts struct {
+	// Interval is the pause between two full passes over the store.
+	Interval time.Duration
+	// BytesPerSecond limits how fast objects are read back from disk so the
+	// scrubber does not compete with client traffic. Zero means unlimited.
+	BytesPerSecond int64
+	// QuarantineDir is the prefix corrupt objects are moved under in the
+	// storage of the store. It defaults to a hidden prefix, which for a
+	// DiskStorage is a directory under the store root.
+	QuarantineDir string
+	// OnCorrupt is called for every object found corrupt, after it has been
+	// quarantined.
+	OnCorrupt func(id string, meta ObjectMeta)
+}
+
+// ScrubStats holds counters describing the work done by a Scrubber.
+type ScrubStats struct {
+	Passes       int64
+	Scanned      int64
+	BytesScanned int64
+	Corrupt      int64
+}
+
+// Scrubber periodically re-reads every object in a Store and checks it
+// against the checksum recorded when it was written, catching bit rot before
+// a client runs into it.
+type Scrubber struct {
+	ScrubberOpts
+
+	store  *Store
+	quitch chan struct{}
+	once   sync.Once
+
+	passes       atomic.Int64
+	scanned      atomic.Int64
+	bytesScanned atomic.Int64
+	corrupt      atomic.Int64
+}
+
+// NewScrubber creates a new Scrubber for the given store.
+func NewScrubber(store *Store, opts ScrubberOpts) *Scrubber {
+	if len(opts.QuarantineDir) == 0 {
+		opts.QuarantineDir = defaultQuarantineDirName
+	}
+
+	return &Scrubber{
+		ScrubberOpts: opts,
+		store:        store,
+		quitch:       make(chan struct{}),
+	}
+}
+
+// Stats returns a snapshot of the scrubber's counters.
+func (s *Scrubber) Stats() ScrubStats {
+	return ScrubStats{
+		Passes:       s.passes.Load(),
+		Scanned:      s.scanned.Load(),
+		BytesScanned: s.bytesScanned.Load(),
+		Corrupt:      s.corrupt.Load(),
+	}
+}
+
+// Start runs scrub passes every Interval until Stop is called.
+func (s *Scrubber) Start() {
+	ticker := time.NewTicker(s.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.ScrubOnce(); err != nil {
+				log.Println("scrub error: ", err)
+			}
+		case <-s.quitch:
+			return
+		}
+	}
+}
+
+// Stop stops the scrubber.
+func (s *Scrubber) Stop() {
+	s.once.Do(func() { close(s.quitch) })
+}
+
+// ScrubOnce makes a single pass over every object in the store.
+func (s *Scrubber) ScrubOnce() error {
+	ids, err := s.store.Namespaces()
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		err := s.store.walk(id, func(name string, base string) error {
+			select {
+			case <-s.quitch:
+				return errScrubStopped
+			default:
+			}
+			return s.scrubObject(id, name)
+		})
+		if errors.Is(err, errScrubStopped) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	s.passes.Add(1)
+
+	return nil
+}
+
+// errScrubStopped aborts a pass when the scrubber is stopped.
+var errScrubStopped = errors.New("scrubber stopped")
+
+// scrubObject verifies the object blob name and quarantines it on mismatch.
+// Objects being written are skipped, and an object is only quarantined if
+// it still has the version it was checked against, so a write that replaced
+// it while it was being read is not mistaken for corruption.
+func (s *Scrubber) scrubObject(id string, name string) error {
+	if s.store.isBusy(name) {
+		return nil
+	}
+	meta, err := s.store.readMetaBlob(name + metaSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		// Nothing recorded to check the object against.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	blob, err := s.store.Storage.Read(name)
+	if errors.Is(err, os.ErrNotExist) {
+		// Replaced or deleted since it was listed.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	n, err := io.Copy(h, newThrottledReader(blob, s.BytesPerSecond))
+	blob.Close()
+	if err != nil {
+		return err
+	}
+
+	s.scanned.Add(1)
+	s.bytesScanned.Add(n)
+
+	if have := hex.EncodeToString(h.Sum(nil)); have == meta.Checksum {
+		return nil
+	}
+	if current, err := s.store.readMetaBlob(name + metaSuffix); err != nil || current.Version != meta.Version || current.Checksum != meta.Checksum || s.store.isBusy(name) {
+		return nil
+	}
+
+	s.corrupt.Add(1)
+	log.Printf("scrubber found corrupt object (%s) in namespace (%s), moving it to quarantine", meta.Key, id)
+
+	if err := s.store.quarantine(id, name, s.QuarantineDir); err != nil {
+		return err
+	}
+
+	if s.OnCorrupt != nil {
+		s.OnCorrupt(id, meta)
+	}
+
+	return nil
+}
+
+// quarantine moves the object blob name and its metadata out of the
+// namespace id under the prefix dir, where they are kept for inspection but
+// no longer served.
+func (s *Store) quarantine(id string, name string, dir string) error {
+	base := baseName(name)
+	target := dir + "/" + id + "/" + base
+
+	defer s.markBusy(name)()
+
+	leaf := base
+	if meta, err := s.readMetaBlob(name + metaSuffix); err == nil {
+		leaf, _ = treeLeaf(meta)
+	}
+	if err := s.Storage.Rename(name, target); err != nil {
+		return err
+	}
+	if err := s.Storage.Rename(name+metaSuffix, target+metaSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if tree := s.loadedTree(id); tree != nil {
+		tree.Remove(leaf)
+	}
+
+	return nil
+}
+
+// throttledReader limits the rate at which the underlying reader is consumed.
+type throttledReader struct {
+	r     io.Reader
+	rate  int64
+	start time.Time
+	read  int64
+}
+
+// newThrottledReader wraps r so it is read at no more than rate bytes per
+// second. A rate of zero or less disables the limit.
+func newThrottledReader(r io.Reader, rate int64) io.Reader {
+	if rate <= 0 {
+		return r
+	}
+	return &throttledReader{r: r, rate: rate, start: time.Now()}
+}
+
+// Read implements io.Reader.
+func (t *throttledReader) Read(b []byte) (int, error) {
+	if int64(len(b)) > t.rate {
+		b = b[:t.rate]
+	}
+
+	n, err := t.r.Read(b)
+	t.read += int64(n)
+
+	expected := time.Duration(float64(t.read) / float64(t.rate) * float64(time.Second))
+	if wait := expected - time.Since(t.start); wait > 0 {
+		time.Sleep(wait)
+	}
+
+	return n, err
+}
+
+// repairObject asks the connected peers for a good copy of an object the
+// scrubber found corrupt.
+func (s *FileServer) repairObject(id string, meta ObjectMeta) {
+	ns, nsErr := s.namespace(id)
+	for _, peer := range s.peerList() {
+		var err error
+		switch {
+		case meta.Replica:
+			err = s.fetchReplica(peer, id, meta)
+		case nsErr != nil:
+			err = nsErr
+		default:
+			_, err = s.fetchFile(peer, ns, meta.Key)
+		}
+		if err != nil {
+			log.Printf("[%s] repairing (%s) from %s failed: %s", s.Transport.Addr(), meta.Key, peer.RemoteAddr(), err)
+			continue
+		}
+
+		fmt.Printf("[%s] repaired (%s) in namespace (%s) from %s\n", s.Transport.Addr(), meta.Key, id, peer.RemoteAddr())
+		return
+	}
+
+	log.Printf("[%s] could not find a good copy of (%s) in namespace (%s)", s.Transport.Addr(), meta.Key, id)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestScrubberQuarantinesCorruptObjects(t *testing.T) {
+	s := newStore()
+	id := generateID()
+	defer teardown(t, s)
+
+	for i := 0; i < 5; i++ {
+		key := fmt.Sprintf("foo_%d", i)
+		if _, err := s.writeStream(id, key, bytes.NewReader([]byte("some jpg bytes"))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	key := "foo_3"
+	pathKey := s.PathTransformFunc(key)
+	path := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
+	if err := os.WriteFile(path, []byte("some png bytes"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	var reported []string
+	scrubber := NewScrubber(s, ScrubberOpts{
+		OnCorrupt: func(id string, meta ObjectMeta) {
+			reported = append(reported, meta.Key)
+		},
+	})
+
+	if err := scrubber.ScrubOnce(); err != nil {
+		t.Fatal(err)
+	}
+
+	stats := scrubber.Stats()
+	if stats.Scanned != 5 || stats.Corrupt != 1 || stats.Passes != 1 {
+		t.Errorf("unexpected stats %+v", stats)
+	}
+	if len(reported) != 1 || reported[0] != key {
+		t.Errorf("expected (%s) to be reported, have %v", key, reported)
+	}
+	if s.Has(id, key) {
+		t.Errorf("expected corrupt object to be moved out of the namespace")
+	}
+
+	quarantined := filepath.Join(s.Root, defaultQuarantineDirName, id, pathKey.Filename)
+	if _, err := os.Stat(quarantined); err != nil {
+		t.Errorf("expected corrupt object in quarantine: %s", err)
+	}
+
+	// The quarantine must not be scrubbed as if it were a namespace.
+	if err := scrubber.ScrubOnce(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := scrubber.Stats(); stats.Scanned != 9 || stats.Corrupt != 1 {
+		t.Errorf("unexpected stats after second pass %+v", stats)
+	}
+}
+
+func TestScrubberRepairKeepsVersion(t *testing.T) {
+	servers := newTestCluster(t, 3)
+	a, b := servers[0], servers[1]
+
+	// b repairs its replica from the one held by the third node.
+	result, err := a.StoreWithOptions(testNamespace, "key", bytes.NewReader([]byte("some jpg bytes")), WriteOptions{Consistency: ConsistencyAll})
+	if err != nil {
+		t.Fatal(err)
+	}
+	before, _ := b.store.head(testNamespace, hashKey("key"))
+	if _, err := b.store.Storage.Write(b.store.objectName(testNamespace, hashKey("key")), bytes.NewReader([]byte("bitrot"))); err != nil {
+		t.Fatal(err)
+	}
+
+	scrubber := NewScrubber(b.store, ScrubberOpts{OnCorrupt: b.repairObject})
+	if err := scrubber.ScrubOnce(); err != nil {
+		t.Fatal(err)
+	}
+	if scrubber.Stats().Corrupt != 1 {
+		t.Fatalf("expected the replica to be found corrupt, have %+v", scrubber.Stats())
+	}
+
+	after, ok := b.store.head(testNamespace, hashKey("key"))
+	if !ok {
+		t.Fatalf("expected the replica to be repaired")
+	}
+	if after.Version != result.Version || after.Checksum != before.Checksum {
+		t.Errorf("expected the repaired replica to keep version %s, have %s", result.Version, after.Version)
+	}
+	if err := b.store.Verify(testNamespace, hashKey("key")); err != nil {
+		t.Errorf("expected the repaired replica to verify: %s", err)
+	}
+}
+
+func TestScrubberSkipsBusyObjects(t *testing.T) {
+	s := newStore()
+	id := generateID()
+	defer teardown(t, s)
+
+	if _, err := s.writeStream(id, "key", bytes.NewReader([]byte("some jpg bytes"))); err != nil {
+		t.Fatal(err)
+	}
+	name := s.objectName(id, "key")
+	if _, err := s.Storage.Write(name, bytes.NewReader([]byte("being replaced"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// An object in the middle of a write does not match its metadata yet.
+	scrubber := NewScrubber(s, ScrubberOpts{})
+	done := s.markBusy(name)
+	if err := scrubber.ScrubOnce(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := scrubber.Stats(); stats.Corrupt != 0 || !s.Has(id, "key") {
+		t.Errorf("expected the object being written to be left alone, have %+v", stats)
+	}
+
+	done()
+	if err := scrubber.ScrubOnce(); err != nil {
+		t.Fatal(err)
+	}
+	if stats := scrubber.Stats(); stats.Corrupt != 1 {
+		t.Errorf("expected the object to be checked once the write is done, have %+v", stats)
+	}
+}
@@ -2,12 +2,18 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"encoding/gob"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"net"
+	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Dhruv-mak/godiststore/p2p"
@@ -15,53 +21,186 @@ import (
 
 // FileServerOpts holds the configuration options for the FileServer.
 type FileServerOpts struct {
-	ID                string
-	EncKey            []byte
+	ID string
+	// KeyProvider holds the master keys the data keys of replicas are
+	// wrapped with, for namespaces without a KeyProvider of their own. A
+	// Keyring keeps them in memory; LoadKeyFile and NewPassphraseKeyring
+	// provide one from a key file or passphrases.
+	KeyProvider KeyProvider
+	// ConvergenceSecret is the secret, shared by the nodes of the cluster,
+	// the data keys of namespaces with a Convergent policy are derived
+	// from.
+	ConvergenceSecret []byte
 	StorageRoot       string
 	PathTransformFunc PathTransformFunc
 	Transport         p2p.Transport
 	BootstrapNodes    []string
+	// Storage is the backend files are kept in. It defaults to a
+	// DiskStorage under StorageRoot; NewMemoryStorage and OpenLogStorage
+	// provide the others.
+	Storage Storage
+	// Namespaces are the namespaces files can be stored in through this
+	// node, by name. Replicas are held for any namespace.
+	Namespaces map[string]NamespaceOpts
+	// WriteConsistency is the consistency level Store waits for in
+	// namespaces without a policy of their own.
+	WriteConsistency ConsistencyLevel
+	// ReadConsistency is the number of replicas Get consults in namespaces
+	// without a policy of their own.
+	ReadConsistency ConsistencyLevel
+	// ScrubInterval enables the background scrubber, which re-verifies every
+	// stored object this often. Zero disables it.
+	ScrubInterval time.Duration
+	// ScrubBytesPerSecond limits how fast the scrubber reads from disk.
+	ScrubBytesPerSecond int64
+	// TombstoneGracePeriod is how long the tombstones of deleted files are
+	// kept before they are garbage collected. A node that is partitioned
+	// away for longer than this can bring deleted files back.
+	TombstoneGracePeriod time.Duration
+	// ReapInterval is how often expired files are looked for and replaced
+	// with tombstones.
+	ReapInterval time.Duration
+	// Capacity is the number of bytes this node may store, its own files and
+	// the replicas it holds for others together. Zero is unlimited.
+	Capacity int64
+	// Labels place this node in the zones, racks and hosts of the cluster.
+	// They are advertised to peers, along with the capacity of the node.
+	Labels Labels
+	// ReplicationFactor is the number of copies of a file to keep, the
+	// local one included, in namespaces without a policy of their own. Zero
+	// keeps a copy on every peer.
+	ReplicationFactor int
+	// PlacementFunc picks the peers replicas are kept on when there are
+	// more peers than ReplicationFactor requires.
+	PlacementFunc PlacementFunc
+	// RebalanceBytesPerSecond limits how fast files are copied between
+	// nodes by the rebalancer and by Drain. Zero is unlimited.
+	RebalanceBytesPerSecond int64
+	// GCInterval enables the background garbage collector, which removes
+	// data the store no longer references this often. Zero disables it.
+	GCInterval time.Duration
+	// TransferTTL is how long partial transfers are kept without progress
+	// before they are garbage collected.
+	TransferTTL time.Duration
+	// OrphanNamespaceAge is how long the files of a namespace that none of
+	// the nodes of the cluster is configured with are kept after the last
+	// write to it before they are garbage collected. They are only collected
+	// while every node this one knows of is connected. Zero keeps them.
+	OrphanNamespaceAge time.Duration
+	// AuthKey signs the tokens that operations are authorized with. It is
+	// shared by the nodes of the cluster and issues tokens through
+	// IssueToken. Without it every operation is allowed.
+	AuthKey []byte
+	// Token is the token this node presents to its peers, and the one
+	// operations run with when their options carry none. Nodes normally
+	// hold a token for AnyNamespace; a node with a narrower one can only
+	// read and write those namespaces on its peers.
+	Token string
 }
 
 // FileServer represents a file server that can store and retrieve files over a P2P network.
 type FileServer struct {
 	FileServerOpts
 
-	peerLock sync.Mutex
-	peers    map[string]p2p.Peer
+	peerLock  sync.Mutex
+	peers     map[string]p2p.Peer
+	peerInfos map[string]NodeInfo
+
+	// streams holds a lock per peer address that is held while anything is
+	// written to the connection to the peer, and incoming one that is held
+	// while a stream from the peer is received.
+	streamLock sync.Mutex
+	streams    map[string]*sync.Mutex
+	incoming   map[string]*sync.Mutex
+
+	keyLocks keyLocks
 	store    *Store
+	scrubber *Scrubber
+	clock    *HLC
 	quitch   chan struct{}
+
+	draining    atomic.Bool
+	rebalancech chan struct{}
+
+	pendingLock sync.Mutex
+	pending     map[string]chan any
+
+	uploadLock sync.Mutex
+	uploads    map[string][]*upload
+
+	deleteLock sync.Mutex
+	deletes    map[string][]MessageDeleteFile
 }
 
 // NewFileServer creates a new FileServer with the given options.
 func NewFileServer(opts FileServerOpts) *FileServer {
 	storeOpts := StoreOpts{
 		Root:              opts.StorageRoot,
+		Storage:           opts.Storage,
 		PathTransformFunc: opts.PathTransformFunc,
+		Capacity:          opts.Capacity,
+		Quotas:            namespaceQuotas(opts.Namespaces),
 	}
 
 	if len(opts.ID) == 0 {
 		opts.ID = generateID()
 	}
+	if opts.TombstoneGracePeriod == 0 {
+		opts.TombstoneGracePeriod = defaultTombstoneGracePeriod
+	}
+	if opts.ReapInterval == 0 {
+		opts.ReapInterval = defaultReapInterval
+	}
+	if opts.PlacementFunc == nil {
+		opts.PlacementFunc = SpreadPlacementFunc
+	}
+	if opts.TransferTTL == 0 {
+		opts.TransferTTL = defaultTransferTTL
+	}
 
-	return &FileServer{
+	s := &FileServer{
 		store:          NewStore(storeOpts),
 		FileServerOpts: opts,
 		quitch:         make(chan struct{}),
+		rebalancech:    make(chan struct{}, 1),
 		peers:          make(map[string]p2p.Peer),
+		streams:        make(map[string]*sync.Mutex),
+		incoming:       make(map[string]*sync.Mutex),
+		peerInfos:      make(map[string]NodeInfo),
+		pending:        make(map[string]chan any),
+		uploads:        make(map[string][]*upload),
+		deletes:        make(map[string][]MessageDeleteFile),
+		clock:          NewHLC(opts.ID),
 	}
+
+	s.scrubber = NewScrubber(s.store, ScrubberOpts{
+		Interval:       opts.ScrubInterval,
+		BytesPerSecond: opts.ScrubBytesPerSecond,
+		OnCorrupt:      s.repairObject,
+	})
+
+	return s
 }
 
+// requestTimeout is how long request waits for a peer to answer.
+const requestTimeout = 5 * time.Second
+
+// ErrRequestTimeout is returned when a peer does not answer a request in time.
+var ErrRequestTimeout = errors.New("request timed out")
+
 // broadcast sends a message to all connected peers.
 func (s *FileServer) broadcast(msg *Message) error {
+	msg.Token = s.Token
 	buf := new(bytes.Buffer)
 	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
 		return err
 	}
 
-	for _, peer := range s.peers {
-		peer.Send([]byte{p2p.IncomingMessage})
-		if err := peer.Send(buf.Bytes()); err != nil {
+	for _, peer := range s.peerList() {
+		unlock := s.lockStream(peer)
+		err := peer.Send(p2p.Frame(buf.Bytes()))
+		unlock()
+		if err != nil {
 			return err
 		}
 	}
@@ -69,112 +208,807 @@ func (s *FileServer) broadcast(msg *Message) error {
 	return nil
 }
 
+// send sends a message to a single peer.
+func (s *FileServer) send(peer p2p.Peer, msg *Message) error {
+	defer s.lockStream(peer)()
+
+	return s.writeMessage(peer, msg)
+}
+
+// writeMessage writes a message to peer. The caller must hold the stream
+// lock of the peer.
+func (s *FileServer) writeMessage(peer p2p.Peer, msg *Message) error {
+	msg.Token = s.Token
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(msg); err != nil {
+		return err
+	}
+
+	return peer.Send(p2p.Frame(buf.Bytes()))
+}
+
+// lockStream locks the connection to peer and returns the function unlocking
+// it. A stream is written as a message announcing it, the IncomingStream byte
+// and its bytes, in several writes, so the lock has to be held from the first
+// to the last of them to keep other streams and messages to the same peer
+// from landing in between.
+func (s *FileServer) lockStream(peer p2p.Peer) func() {
+	return s.lockPeer(s.streams, peer)
+}
+
+// lockIncoming locks the streams coming in from peer, so they are received
+// one at a time, and returns the function unlocking it. It is not the lock
+// of lockStream: a node holding that while it reads would deadlock with a
+// peer streaming to it at the same time as it streams to the peer.
+func (s *FileServer) lockIncoming(peer p2p.Peer) func() {
+	return s.lockPeer(s.incoming, peer)
+}
+
+// lockPeer locks the lock of peer in locks and returns the function
+// unlocking it.
+func (s *FileServer) lockPeer(locks map[string]*sync.Mutex, peer p2p.Peer) func() {
+	addr := peer.RemoteAddr().String()
+
+	s.streamLock.Lock()
+	mu, ok := locks[addr]
+	if !ok {
+		mu = new(sync.Mutex)
+		locks[addr] = mu
+	}
+	s.streamLock.Unlock()
+
+	mu.Lock()
+	return mu.Unlock
+}
+
+// request sends payload to peer and waits for the matching response. It must
+// not be called from the message loop, since that is where responses are
+// delivered.
+func (s *FileServer) request(peer p2p.Peer, payload any) (any, error) {
+	id, ch := s.expect()
+	defer s.forget(id)
+
+	if err := s.send(peer, &Message{RequestID: id, Payload: payload}); err != nil {
+		return nil, err
+	}
+
+	return s.await(peer, ch, requestTimeout)
+}
+
+// expect registers a new request ID whose response will be delivered on the
+// returned channel. Callers must forget the ID once they are done with it.
+func (s *FileServer) expect() (string, chan any) {
+	id := generateID()
+	ch := make(chan any, 1)
+
+	s.pendingLock.Lock()
+	s.pending[id] = ch
+	s.pendingLock.Unlock()
+
+	return id, ch
+}
+
+// forget drops a request ID registered with expect.
+func (s *FileServer) forget(id string) {
+	s.pendingLock.Lock()
+	delete(s.pending, id)
+	s.pendingLock.Unlock()
+}
+
+// await waits up to timeout for the response to a request sent to peer.
+func (s *FileServer) await(peer p2p.Peer, ch chan any, timeout time.Duration) (any, error) {
+	select {
+	case resp := <-ch:
+		if denied, ok := resp.(MessageDenied); ok {
+			return nil, fmt.Errorf("%w by %s: %s", ErrPermissionDenied, peer.RemoteAddr(), denied.Reason)
+		}
+		return resp, nil
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("%w: waiting for %s", ErrRequestTimeout, peer.RemoteAddr())
+	case <-s.quitch:
+		return nil, fmt.Errorf("file server stopped")
+	}
+}
+
+// reply answers a request received from the given peer.
+func (s *FileServer) reply(from string, requestID string, payload any) error {
+	s.peerLock.Lock()
+	peer, ok := s.peers[from]
+	s.peerLock.Unlock()
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+
+	return s.send(peer, &Message{RequestID: requestID, Response: true, Payload: payload})
+}
+
+// resolve hands a response over to the request waiting for it.
+func (s *FileServer) resolve(msg *Message) error {
+	s.pendingLock.Lock()
+	ch, ok := s.pending[msg.RequestID]
+	s.pendingLock.Unlock()
+	if !ok {
+		return fmt.Errorf("no pending request (%s) for response", msg.RequestID)
+	}
+
+	ch <- msg.Payload
+
+	return nil
+}
+
 // Message represents a generic message with a payload.
 type Message struct {
+	// RequestID correlates a request with its response. It is empty for
+	// messages that do not expect an answer.
+	RequestID string
+	// Response marks the message as the answer to RequestID.
+	Response bool
+	// Token is the token of the sending node, which the receiver authorizes
+	// the message with.
+	Token   string
 	Payload any
 }
 
 // MessageStoreFile represents a message to store a file.
+// The stream that follows carries the bytes of the file from Offset up to
+// Size, so an interrupted transfer can be resumed under the same TransferID.
 type MessageStoreFile struct {
-	ID   string
-	Key  string
-	Size int64
+	TransferID  string
+	Namespace   string
+	Key         string
+	Size        int64
+	Offset      int64
+	ContentHash string
+	Version     Version
+	ExpiresAt   time.Time
+	KeyID       string
+	WrappedKey  []byte
 }
 
-// MessageGetFile represents a message to get a file.
+// MessageGetFile represents a message to get a file. It is answered with a
+// MessageFileStream followed by a stream carrying a fileHeader and the file.
+// When Offset or Length are set only that range of the file is sent, and
+// HeaderBytes asks for the first HeaderBytes bytes of the file to be sent
+// ahead of the range, which is how a reader of an encrypted file gets its IV.
 type MessageGetFile struct {
-	ID  string
-	Key string
+	TransferID  string
+	Namespace   string
+	Key         string
+	Offset      int64
+	Length      int64
+	HeaderBytes int64
 }
 
-// Get retrieves a file from the local store or the network.
-func (s *FileServer) Get(key string) (io.Reader, error) {
-	if s.store.Has(s.ID, key) {
-		fmt.Printf("[%s] serving file (%s) from local disk\n", s.Transport.Addr(), key)
-		_, r, err := s.store.Read(s.ID, key)
-		return r, err
-	}
+// MessageFileStream answers a MessageGetFile. The stream that follows it on
+// the connection is the answer, which tells it apart from the streams of
+// uploads sent by the same peer.
+type MessageFileStream struct{}
 
-	fmt.Printf("[%s] don't have file (%s) locally, fetching from network...\n", s.Transport.Addr(), key)
+// fileHeader precedes the body of every file streamed in answer to a
+// MessageGetFile.
+type fileHeader struct {
+	// Size is the number of bytes of the body that follows.
+	Size int64
+	// Total is the size of the whole file, which differs from Size when
+	// only a range was asked for.
+	Total int64
+	// ContentHash is the hex encoded SHA-256 of the plaintext recorded when
+	// the file was stored.
+	ContentHash string
+	// Version is the version of the file being sent.
+	Version Version
+	// ExpiresAt is when the file expires, if ever.
+	ExpiresAt time.Time
+	// KeyID and WrappedKey are the wrapped data key of an encrypted
+	// replica.
+	KeyID      string
+	WrappedKey []byte
+	// Err is set when the peer cannot serve the file, in which case no body
+	// follows.
+	Err string
+}
 
-	msg := Message{
-		Payload: MessageGetFile{
-			ID:  s.ID,
-			Key: hashKey(key),
-		},
+// writeFileHeader writes a length prefixed, gob encoded header to w.
+func writeFileHeader(w io.Writer, h fileHeader) error {
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(h); err != nil {
+		return err
 	}
+	if err := binary.Write(w, binary.LittleEndian, uint32(buf.Len())); err != nil {
+		return err
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
 
-	if err := s.broadcast(&msg); err != nil {
-		return nil, err
+// readFileHeader reads a header written by writeFileHeader from r without
+// consuming any of the body that follows it.
+func readFileHeader(r io.Reader) (fileHeader, error) {
+	var (
+		h    fileHeader
+		size uint32
+	)
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return h, err
+	}
+	if size > p2p.MaxMessageSize {
+		return h, fmt.Errorf("file header of %d bytes is too large", size)
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return h, err
 	}
+	err := gob.NewDecoder(bytes.NewReader(buf)).Decode(&h)
+	return h, err
+}
 
-	time.Sleep(time.Millisecond * 500)
+// peerList returns a snapshot of the connected peers.
+func (s *FileServer) peerList() []p2p.Peer {
+	s.peerLock.Lock()
+	defer s.peerLock.Unlock()
 
+	peers := make([]p2p.Peer, 0, len(s.peers))
 	for _, peer := range s.peers {
-		var fileSize int64
-		binary.Read(peer, binary.LittleEndian, &fileSize)
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// Get retrieves a file from a namespace using the read consistency level of
+// the namespace.
+func (s *FileServer) Get(ns string, key string) (io.Reader, error) {
+	namespace, err := s.namespace(ns)
+	if err != nil {
+		return nil, err
+	}
+	return s.GetWithOptions(ns, key, ReadOptions{Consistency: namespace.ReadConsistency})
+}
+
+// getOne retrieves a file from the local store or the network. Without a
+// plaintext copy, a replica this node holds for the namespace is decrypted
+// before peers are asked; a replica that fails verification is skipped and
+// the next one is tried instead. The local copy is verified as it is read,
+// in a single pass: reading a corrupt copy to the end fails with ErrCorrupt
+// and discards it, so the next read fetches a healthy replica. A file deleted
+// on this node is not looked for elsewhere.
+func (s *FileServer) getOne(ns namespace, key string) (io.Reader, error) {
+	if err := s.checkDeleted(ns.name, key); err != nil {
+		return nil, err
+	}
 
-		n, err := s.store.WriteDecrypt(s.EncKey, s.ID, key, io.LimitReader(peer, fileSize))
+	if s.store.Has(ns.name, key) {
+		fmt.Printf("[%s] serving file (%s) from local disk\n", s.Transport.Addr(), key)
+		_, r, err := s.store.Read(ns.name, key)
 		if err != nil {
 			return nil, err
 		}
+		return &discardOnCorrupt{r: r, discard: func(err error) {
+			log.Printf("[%s] local copy of (%s) failed verification: %s", s.Transport.Addr(), key, err)
+			if err := s.store.Delete(ns.name, key); err != nil {
+				log.Println("delete error: ", err)
+			}
+		}}, nil
+	}
+
+	if replica, ok := s.store.head(ns.name, hashKey(key)); ok {
+		if replica.Deleted {
+			return nil, fmt.Errorf("%w: (%s) at version %s", ErrDeleted, key, replica.Version)
+		}
+		_, err := s.decryptReplica(ns, key, replica)
+		if err == nil {
+			fmt.Printf("[%s] serving file (%s) from local replica\n", s.Transport.Addr(), key)
+			_, r, err := s.store.Read(ns.name, key)
+			return r, err
+		}
+		log.Printf("[%s] local replica of (%s) could not be used: %s", s.Transport.Addr(), key, err)
+	}
+
+	fmt.Printf("[%s] don't have file (%s) locally, fetching from network...\n", s.Transport.Addr(), key)
+
+	lastErr := fmt.Errorf("file (%s) not found on any peer", key)
+	for _, peer := range s.peerList() {
+		n, err := s.fetchFile(peer, ns, key)
+		if err != nil {
+			log.Printf("[%s] fetching (%s) from %s failed: %s", s.Transport.Addr(), key, peer.RemoteAddr(), err)
+			if errors.Is(err, ErrCorrupt) || errors.Is(lastErr, ErrCorrupt) {
+				lastErr = fmt.Errorf("%w: no replica of (%s) passed verification", ErrCorrupt, key)
+			}
+			continue
+		}
 
 		fmt.Printf("[%s] received (%d) bytes over the network from (%s)\n", s.Transport.Addr(), n, peer.RemoteAddr())
 
-		peer.CloseStream()
+		_, r, err := s.store.Read(ns.name, key)
+		return r, err
 	}
 
-	_, r, err := s.store.Read(s.ID, key)
-	return r, err
+	return nil, lastErr
 }
 
-// Store stores a file in the local store and broadcasts it to the network.
-func (s *FileServer) Store(key string, r io.Reader) error {
-	var (
-		fileBuffer = new(bytes.Buffer)
-		tee        = io.TeeReader(r, fileBuffer)
-	)
+// discardOnCorrupt reads a local copy through the verifying reader r and
+// calls discard the first time it fails verification.
+type discardOnCorrupt struct {
+	r       io.Reader
+	discard func(error)
+	once    sync.Once
+}
+
+// Read implements io.Reader.
+func (d *discardOnCorrupt) Read(b []byte) (int, error) {
+	n, err := d.r.Read(b)
+	if errors.Is(err, ErrCorrupt) {
+		d.once.Do(func() { d.discard(err) })
+	}
+	return n, err
+}
 
-	size, err := s.store.Write(s.ID, key, tee)
+// Close implements io.Closer.
+func (d *discardOnCorrupt) Close() error {
+	if c, ok := d.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// requestFile sends a MessageGetFile to a single peer and hands the header
+// and body of the answer to fn. It fails with ErrRequestTimeout if the peer
+// does not start answering within requestTimeout or stalls for as long while
+// sending the answer.
+func (s *FileServer) requestFile(peer p2p.Peer, req MessageGetFile, fn func(fileHeader, io.Reader) error) error {
+	id, ch := s.expect()
+	defer s.forget(id)
+
+	if err := s.send(peer, &Message{RequestID: id, Payload: req}); err != nil {
+		return err
+	}
+
+	// The stream is only ours once the peer has announced it; until then
+	// the streams on the connection belong to uploads.
+	resp, err := s.await(peer, ch, requestTimeout)
 	if err != nil {
 		return err
 	}
+	if _, ok := resp.(MessageFileStream); !ok {
+		return fmt.Errorf("unexpected response %T to file request", resp)
+	}
+	if err := peer.WaitStream(requestTimeout); err != nil {
+		return fmt.Errorf("%w: %s", ErrRequestTimeout, err)
+	}
+	defer peer.CloseStream()
+	// The read loop of the connection reads without a deadline.
+	defer peer.SetReadDeadline(time.Time{})
 
-	msg := Message{
-		Payload: MessageStoreFile{
-			ID:   s.ID,
-			Key:  hashKey(key),
-			Size: size + 16,
-		},
+	r := &deadlineReader{conn: peer, timeout: requestTimeout}
+	header, err := readFileHeader(r)
+	if err != nil {
+		return err
+	}
+	if len(header.Err) > 0 {
+		return errors.New(header.Err)
 	}
 
-	if err := s.broadcast(&msg); err != nil {
+	// Whatever fn leaves unread is drained, so the next message on the
+	// connection is read from where it starts.
+	body := io.LimitReader(r, header.Size)
+	err = fn(header, body)
+	io.Copy(io.Discard, body)
+	return err
+}
+
+// deadlineReader reads from a connection, failing with ErrRequestTimeout if
+// no bytes arrive for timeout.
+type deadlineReader struct {
+	conn    net.Conn
+	timeout time.Duration
+}
+
+// Read implements io.Reader.
+func (r *deadlineReader) Read(b []byte) (int, error) {
+	if err := r.conn.SetReadDeadline(time.Now().Add(r.timeout)); err != nil {
+		return 0, err
+	}
+	n, err := r.conn.Read(b)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		err = fmt.Errorf("%w: reading from %s", ErrRequestTimeout, r.conn.RemoteAddr())
+	}
+	return n, err
+}
+
+// fetchFile asks a single peer for the file with the given key in namespace
+// ns, decrypts it into the local store and verifies it against the content hash the peer
+// recorded when the file was replicated to it. The encrypted file is received
+// into a checkpointed transfer first, so a download that is cut off resumes
+// where it stopped on the next attempt, from this peer or any other replica.
+func (s *FileServer) fetchFile(peer p2p.Peer, ns namespace, key string) (int64, error) {
+	t, err := s.store.OpenTransfer(TransferState{
+		ID:        downloadTransferID(ns.name, key),
+		Namespace: ns.name,
+		Key:       key,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer t.Close()
+
+	req := MessageGetFile{
+		TransferID: t.ID,
+		Namespace:  ns.name,
+		Key:        hashKey(key),
+		Offset:     t.Offset,
+	}
+	var last fileHeader
+	err = s.requestFile(peer, req, func(header fileHeader, r io.Reader) error {
+		if t.Offset == 0 {
+			t.Total, t.ContentHash, t.Version = header.Total, header.ContentHash, header.Version
+		}
+		if t.Total != header.Total || t.ContentHash != header.ContentHash || t.Version != header.Version {
+			io.Copy(io.Discard, r)
+			t.Remove()
+			return fmt.Errorf("file (%s) changed since transfer (%s) started", key, t.ID)
+		}
+		if t.Offset > 0 {
+			fmt.Printf("[%s] resuming transfer (%s) from %s at offset %d\n", s.Transport.Addr(), t.ID, peer.RemoteAddr(), t.Offset)
+		}
+		last = header
+
+		_, err := t.Write(r)
 		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	if !t.Complete() {
+		return 0, fmt.Errorf("transfer (%s) ended at %d of %d bytes", t.ID, t.Offset, t.Total)
 	}
 
-	time.Sleep(time.Millisecond * 5)
+	// Whatever happens now, the received bytes have been used up.
+	defer t.Remove()
 
-	peers := []io.Writer{}
-	for _, peer := range s.peers {
-		peers = append(peers, peer)
+	dataKey, err := ns.unwrapKey(last.KeyID, last.WrappedKey)
+	if err != nil {
+		return 0, err
+	}
+
+	r, err := t.Reader()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	// Check the content before it can replace anything in the store.
+	h := sha256.New()
+	if _, err := copyDecrypt(dataKey, r, h); err != nil {
+		return 0, err
+	}
+	if have := hex.EncodeToString(h.Sum(nil)); have != t.ContentHash {
+		return 0, fmt.Errorf("%w: received content hash %s, want %s", ErrCorrupt, have, t.ContentHash)
+	}
+
+	r.Close()
+	r, err = t.Reader()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	meta := ObjectMeta{Version: t.Version, ExpiresAt: last.ExpiresAt}
+	return s.store.WriteDecryptWithMeta(dataKey, ns.name, key, r, meta)
+}
+
+// decryptReplica decrypts the replica described by meta that this node holds
+// of the file with the given key in namespace ns into a plaintext copy,
+// after checking it against the content hash recorded for it.
+func (s *FileServer) decryptReplica(ns namespace, key string, meta ObjectMeta) (int64, error) {
+	dataKey, err := ns.unwrapKey(meta.KeyID, meta.WrappedKey)
+	if err != nil {
+		return 0, err
+	}
+
+	_, r, err := s.store.readStream(ns.name, hashKey(key))
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	h := sha256.New()
+	if _, err := copyDecrypt(dataKey, r, h); err != nil {
+		return 0, err
+	}
+	if have := hex.EncodeToString(h.Sum(nil)); have != meta.ContentHash {
+		return 0, fmt.Errorf("%w: decrypted content hash %s, want %s", ErrCorrupt, have, meta.ContentHash)
+	}
+
+	r.Close()
+	_, r, err = s.store.readStream(ns.name, hashKey(key))
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	return s.store.WriteDecryptWithMeta(dataKey, ns.name, key, r, ObjectMeta{Version: meta.Version, ExpiresAt: meta.ExpiresAt})
+}
+
+// downloadTransferID returns the ID of the transfer a file is downloaded
+// into. It only depends on the file, so a later Get picks up where an
+// interrupted one left off.
+func downloadTransferID(id string, key string) string {
+	return hashKey("get/" + id + "/" + key)
+}
+
+// fetchReplica copies an encrypted replica held in namespace id from a single
+// peer, byte for byte, and checks it against the checksum recorded for the
+// local copy it replaces.
+func (s *FileServer) fetchReplica(peer p2p.Peer, id string, want ObjectMeta) error {
+	req := MessageGetFile{Namespace: id, Key: want.Key}
+	return s.requestFile(peer, req, func(header fileHeader, r io.Reader) error {
+		// The copy keeps the version it was written with, so it ranks
+		// exactly like the replica it replaces.
+		meta := ObjectMeta{
+			ContentHash: header.ContentHash,
+			Version:     header.Version,
+			ExpiresAt:   header.ExpiresAt,
+			Replica:     true,
+			KeyID:       header.KeyID,
+			WrappedKey:  header.WrappedKey,
+		}
+		if _, err := s.store.WriteWithMeta(id, want.Key, r, meta); err != nil {
+			return err
+		}
+
+		meta, err := s.store.Stat(id, want.Key)
+		if err != nil {
+			return err
+		}
+		if meta.Checksum != want.Checksum {
+			if err := s.store.Delete(id, want.Key); err != nil {
+				log.Println("delete error: ", err)
+			}
+			return fmt.Errorf("%w: received checksum %s, want %s", ErrCorrupt, meta.Checksum, want.Checksum)
+		}
+
+		return nil
+	})
+}
+
+// GetRange retrieves length bytes starting at offset of a file in namespace ns
+// from the local store or the network, without transferring the rest of the
+// file. A length of zero reads to the end of the file, and a negative offset
+// or length fails with ErrInvalidRange before anything is asked of a peer.
+// Since CTR mode lets any block be decrypted on its own, peers only send the
+// IV and the requested slice of the encrypted replica, which is decrypted as
+// it is read rather than held in memory. A reader given up on before its end
+// should be closed, which frees the connection to the peer. Slices cannot be
+// checked against the content hash of the whole file; use Get when end to end
+// verification is required. The read is authorized with the Token of the
+// server.
+func (s *FileServer) GetRange(ns string, key string, offset int64, length int64) (io.Reader, error) {
+	if err := s.authorize("", ns, PermRead); err != nil {
+		return nil, err
+	}
+	if err := checkRange(offset, length); err != nil {
+		return nil, err
+	}
+	namespace, err := s.namespace(ns)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.checkDeleted(ns, key); err != nil {
+		return nil, err
+	}
+
+	if s.store.Has(ns, key) {
+		fmt.Printf("[%s] serving range of file (%s) from local disk\n", s.Transport.Addr(), key)
+		_, r, err := s.store.ReadRange(ns, key, offset, length)
+		return r, err
+	}
+
+	fmt.Printf("[%s] don't have file (%s) locally, fetching range from network...\n", s.Transport.Addr(), key)
+
+	req := MessageGetFile{
+		Namespace:   ns,
+		Key:         hashKey(key),
+		Offset:      aesBlockSize + offset,
+		Length:      length,
+		HeaderBytes: aesBlockSize,
+	}
+
+	lastErr := fmt.Errorf("file (%s) not found on any peer", key)
+	for _, peer := range s.peerList() {
+		r, err := s.streamRange(peer, namespace, req, offset)
+		if err != nil {
+			log.Printf("[%s] fetching range of (%s) from %s failed: %s", s.Transport.Addr(), key, peer.RemoteAddr(), err)
+			lastErr = err
+			continue
+		}
+
+		fmt.Printf("[%s] streaming range of (%s) over the network from (%s)\n", s.Transport.Addr(), key, peer.RemoteAddr())
+
+		return r, nil
+	}
+
+	return nil, lastErr
+}
+
+// streamRange asks peer for the range of an encrypted replica described by
+// req and returns a reader decrypting it as it arrives, starting offset bytes
+// into the plaintext. It fails without returning a reader if the peer cannot
+// serve the range. Errors after that are returned by the reader, and closing
+// it stops the transfer.
+func (s *FileServer) streamRange(peer p2p.Peer, ns namespace, req MessageGetFile, offset int64) (io.ReadCloser, error) {
+	pr, pw := io.Pipe()
+	started := make(chan struct{})
+	done := make(chan error, 1)
+
+	go func() {
+		err := s.requestFile(peer, req, func(header fileHeader, r io.Reader) error {
+			dataKey, err := ns.unwrapKey(header.KeyID, header.WrappedKey)
+			if err != nil {
+				return err
+			}
+			iv := make([]byte, aesBlockSize)
+			if _, err := io.ReadFull(r, iv); err != nil {
+				return err
+			}
+
+			close(started)
+			n, err := copyDecryptAt(dataKey, iv, offset, r, pw)
+			if err != nil {
+				return err
+			}
+			if want := header.Size - aesBlockSize; int64(n) != want {
+				return fmt.Errorf("received %d bytes of range, want %d", n, want)
+			}
+			return nil
+		})
+		pw.CloseWithError(err)
+		done <- err
+	}()
+
+	select {
+	case <-started:
+		return pr, nil
+	case err := <-done:
+		return nil, err
 	}
-	mw := io.MultiWriter(peers...)
-	mw.Write([]byte{p2p.IncomingStream})
-	n, err := copyEncrypt(s.EncKey, fileBuffer, mw)
+}
+
+// Store stores a file in namespace ns in the local store and replicates it to
+// the network, using the write consistency level of the namespace.
+func (s *FileServer) Store(ns string, key string, r io.Reader) error {
+	namespace, err := s.namespace(ns)
 	if err != nil {
 		return err
 	}
+	_, err = s.StoreWithOptions(ns, key, r, WriteOptions{Consistency: namespace.WriteConsistency})
+	return err
+}
 
-	fmt.Printf("[%s] received and written (%d) bytes to disk\n", s.Transport.Addr(), n)
+// StoreWithOptions stores a file in namespace ns in the local store and
+// replicates it to the network, encrypted with the key of the namespace. The
+// input is streamed straight to disk and replicas are encrypted
+// from the local copy, so memory use does not depend on the size of the file
+// and r does not need to have a known length. With a ReplicationFactor set,
+// replicas go to the peers picked by PlacementFunc. Namespaces that are not
+// configured on this node fail with ErrUnknownNamespace and read-only ones
+// with ErrReadOnlyNamespace.
+//
+// Every peer acknowledges once the file is durably on its disk. The write
+// returns as soon as enough replicas, the local copy included, have done so
+// to satisfy opts.Consistency, and fails with ErrQuorumNotMet if that becomes
+// impossible. Replicas still in flight keep going in the background and
+// interrupted ones are resumed when their peer reconnects. Peers that are
+// known to lack the space for the file are not sent it and count as failed.
+// A local write that exceeds the capacity of this node or the quota of the
+// namespace fails with ErrInsufficientSpace.
+//
+// Writes the token in opts, or the Token of the server, does not allow fail
+// with ErrPermissionDenied before anything is checked or written.
+//
+// Writes with an IfMatch or IfNoneMatch precondition have to be sent to the
+// node owning the key, and fail with ErrNotOwner on any other. They fail with
+// ErrPreconditionFailed, before anything is written, if the current version
+// of the file does not satisfy it.
+func (s *FileServer) StoreWithOptions(ns string, key string, r io.Reader, opts WriteOptions) (StoreResult, error) {
+	result := StoreResult{
+		Replicas: []ReplicaResult{{Addr: s.Transport.Addr()}},
+	}
 
-	return nil
+	if err := s.authorize(opts.Token, ns, PermWrite); err != nil {
+		return result, err
+	}
+	namespace, err := s.writable(ns)
+	if err != nil {
+		return result, err
+	}
+
+	unlock := s.keyLocks.lock(ns + "/" + key)
+	if err := s.checkPreconditions(namespace, key, opts); err != nil {
+		unlock()
+		return result, err
+	}
+
+	meta := ObjectMeta{Version: s.clock.Now(), ExpiresAt: opts.ExpiresAt}
+	if _, err := s.store.WriteWithMeta(ns, key, r, meta); err != nil {
+		unlock()
+		result.Replicas[0].Err = err
+		return result, err
+	}
+	result.Version = meta.Version
+	result.Replicas[0].Acked = true
+
+	u, err := s.newUpload(namespace, key)
+	unlock()
+	if err != nil {
+		return result, err
+	}
+
+	peers := s.placePeers(namespace, key, u.Total())
+	return s.replicate(result, key, opts.Consistency, peers, func(peer p2p.Peer) error {
+		if !s.peerHasSpace(peer, u.Total()) {
+			return fmt.Errorf("%w: skipping %s, which reported being full", ErrInsufficientSpace, peer.RemoteAddr())
+		}
+
+		err := s.sendUpload(peer, u)
+		if err != nil && !errors.Is(err, errUploadSuperseded) && !errors.Is(err, ErrInsufficientSpace) {
+			log.Printf("[%s] transfer (%s) to %s interrupted, will resume on reconnect: %s", s.Transport.Addr(), u.TransferID, peer.RemoteAddr(), err)
+			s.deferUpload(peer.RemoteAddr().String(), u)
+		}
+		return err
+	})
+}
+
+// replicate runs send for every one of peers in parallel and waits until
+// enough of them, together with the replicas result already counts as acked,
+// have succeeded to satisfy level. It fails with ErrQuorumNotMet once that
+// has become impossible.
+func (s *FileServer) replicate(result StoreResult, key string, level ConsistencyLevel, peers []p2p.Peer, send func(p2p.Peer) error) (StoreResult, error) {
+	result.Required = level.Required(len(result.Replicas) + len(peers))
+
+	type ack struct {
+		index int
+		err   error
+	}
+	acks := make(chan ack, len(peers))
+	for _, peer := range peers {
+		index := len(result.Replicas)
+		result.Replicas = append(result.Replicas, ReplicaResult{Addr: peer.RemoteAddr().String()})
+
+		go func(peer p2p.Peer) {
+			acks <- ack{index: index, err: send(peer)}
+		}(peer)
+	}
+
+	for outstanding := len(peers); outstanding > 0 && result.Acked() < result.Required; outstanding-- {
+		if result.Acked()+outstanding < result.Required {
+			break
+		}
+
+		a := <-acks
+		if a.err != nil {
+			result.Replicas[a.index].Err = a.err
+			continue
+		}
+		result.Replicas[a.index].Acked = true
+	}
+
+	if acked := result.Acked(); acked < result.Required {
+		return result, fmt.Errorf("%w: %d of %d replicas acknowledged (%s) at consistency %s", ErrQuorumNotMet, acked, result.Required, key, level)
+	}
+
+	return result, nil
 }
 
 // Stop stops the file server.
 func (s *FileServer) Stop() {
+	s.scrubber.Stop()
 	close(s.quitch)
 }
 
+// ScrubStats returns the counters of the background scrubber.
+func (s *FileServer) ScrubStats() ScrubStats {
+	return s.scrubber.Stats()
+}
+
 // OnPeer handles a new peer connection.
 func (s *FileServer) OnPeer(p p2p.Peer) error {
 	s.peerLock.Lock()
@@ -184,6 +1018,13 @@ func (s *FileServer) OnPeer(p p2p.Peer) error {
 
 	log.Printf("connected with remote %s", p.RemoteAddr())
 
+	go s.resumeUploads(p)
+	go s.resumeDeletes(p)
+	go func() {
+		s.refreshPeerInfo(p)
+		s.requestRebalance()
+	}()
+
 	return nil
 }
 
@@ -213,40 +1054,126 @@ func (s *FileServer) loop() {
 
 // handleMessage handles incoming messages based on their type.
 func (s *FileServer) handleMessage(from string, msg *Message) error {
+	if err := s.authorizeMessage(msg); err != nil {
+		if msg.Response {
+			return fmt.Errorf("[%s] dropped response from %s: %w", s.Transport.Addr(), from, err)
+		}
+		return s.deny(from, msg, err)
+	}
+
+	if msg.Response {
+		err := s.resolve(msg)
+		if _, ok := msg.Payload.(MessageFileStream); ok && err != nil {
+			s.discardFileStream(from)
+		}
+		return err
+	}
+
 	switch v := msg.Payload.(type) {
 	case MessageStoreFile:
-		return s.handleMessageStoreFile(from, v)
+		return s.handleMessageStoreFile(from, msg.RequestID, v)
 	case MessageGetFile:
-		return s.handleMessageGetFile(from, v)
+		return s.handleMessageGetFile(from, msg.RequestID, v)
+	case MessageDraining:
+		return s.handleMessageDraining(from)
+	case MessageNodeInfo:
+		return s.handleMessageNodeInfo(from, msg.RequestID, v)
+	case MessageDeleteFile:
+		return s.handleMessageDeleteFile(from, msg.RequestID, v)
+	case MessageStat:
+		return s.handleMessageStat(from, msg.RequestID, v)
+	case MessageTransferStatus:
+		return s.handleMessageTransferStatus(from, msg.RequestID, v)
+	case MessageMerkleNodes:
+		return s.handleMessageMerkleNodes(from, msg.RequestID, v)
+	case MessageMerkleLeaves:
+		return s.handleMessageMerkleLeaves(from, msg.RequestID, v)
+	case MessageRewrapKey:
+		return s.handleMessageRewrapKey(from, msg.RequestID, v)
 	}
 
 	return nil
 }
 
+// discardFileStream reads and drops the answer to a file request from the
+// peer at addr that was given up on, so the connection can carry on.
+func (s *FileServer) discardFileStream(addr string) {
+	s.peerLock.Lock()
+	peer, ok := s.peers[addr]
+	s.peerLock.Unlock()
+	if !ok || peer.WaitStream(requestTimeout) != nil {
+		return
+	}
+	defer peer.CloseStream()
+
+	if header, err := readFileHeader(peer); err == nil && len(header.Err) == 0 {
+		io.CopyN(io.Discard, peer, header.Size)
+	}
+}
+
 // handleMessageGetFile handles a request to get a file.
-func (s *FileServer) handleMessageGetFile(from string, msg MessageGetFile) error {
-	if !s.store.Has(msg.ID, msg.Key) {
-		return fmt.Errorf("[%s] need to serve file (%s) but it does not exist on disk", s.Transport.Addr(), msg.Key)
+func (s *FileServer) handleMessageGetFile(from string, requestID string, msg MessageGetFile) error {
+	s.peerLock.Lock()
+	peer, ok := s.peers[from]
+	s.peerLock.Unlock()
+	if !ok {
+		return fmt.Errorf("peer %s not in map", from)
+	}
+	defer s.lockStream(peer)()
+
+	// The answer is announced before it is streamed, and the requester
+	// waits for it, so failures are sent as a header carrying the error.
+	startStream := func() error {
+		if err := s.writeMessage(peer, &Message{RequestID: requestID, Response: true, Payload: MessageFileStream{}}); err != nil {
+			return err
+		}
+		return peer.Send([]byte{p2p.IncomingStream})
+	}
+	fail := func(err error) error {
+		if startStream() == nil {
+			writeFileHeader(peer, fileHeader{Err: fmt.Sprintf("%s on %s", err, s.Transport.Addr())})
+		}
+		return fmt.Errorf("[%s] need to serve file (%s) but %w", s.Transport.Addr(), msg.Key, err)
+	}
+
+	if !s.store.Has(msg.Namespace, msg.Key) {
+		return fail(fmt.Errorf("file (%s) does not exist", msg.Key))
 	}
 
 	fmt.Printf("[%s] serving file (%s) over the network\n", s.Transport.Addr(), msg.Key)
 
-	fileSize, r, err := s.store.Read(msg.ID, msg.Key)
+	meta, err := s.store.Stat(msg.Namespace, msg.Key)
 	if err != nil {
-		return err
+		return fail(err)
+	}
+	if meta.Expired(time.Now()) {
+		return fail(fmt.Errorf("file (%s) expired at %s", msg.Key, meta.ExpiresAt))
+	}
+
+	fileSize, r, err := s.readRequestedFile(msg)
+	if err != nil {
+		return fail(err)
 	}
 
 	if rc, ok := r.(io.ReadCloser); ok {
 		defer rc.Close()
 	}
 
-	peer, ok := s.peers[from]
-	if !ok {
-		return fmt.Errorf("peer %s not in map", from)
+	if err := startStream(); err != nil {
+		return err
+	}
+	header := fileHeader{
+		Size:        fileSize,
+		Total:       meta.Size,
+		ContentHash: meta.ContentHash,
+		Version:     meta.Version,
+		ExpiresAt:   meta.ExpiresAt,
+		KeyID:       meta.KeyID,
+		WrappedKey:  meta.WrappedKey,
+	}
+	if err := writeFileHeader(peer, header); err != nil {
+		return err
 	}
-
-	peer.Send([]byte{p2p.IncomingStream})
-	binary.Write(peer, binary.LittleEndian, fileSize)
 	n, err := io.Copy(peer, r)
 	if err != nil {
 		return err
@@ -257,23 +1184,114 @@ func (s *FileServer) handleMessageGetFile(from string, msg MessageGetFile) error
 	return nil
 }
 
+// readRequestedFile opens the part of a file asked for by a MessageGetFile and
+// returns the number of bytes that will be sent.
+func (s *FileServer) readRequestedFile(msg MessageGetFile) (int64, io.Reader, error) {
+	if msg.Offset == 0 && msg.Length == 0 && msg.HeaderBytes == 0 {
+		return s.store.Read(msg.Namespace, msg.Key)
+	}
+
+	size, body, err := s.store.ReadRange(msg.Namespace, msg.Key, msg.Offset, msg.Length)
+	if err != nil {
+		return 0, nil, err
+	}
+	if msg.HeaderBytes == 0 {
+		return size, body, nil
+	}
+
+	headSize, head, err := s.store.ReadRange(msg.Namespace, msg.Key, 0, msg.HeaderBytes)
+	if err != nil {
+		body.Close()
+		return 0, nil, err
+	}
+
+	r := readCloser{
+		Reader: io.MultiReader(head, body),
+		Closer: closerFunc(func() error {
+			head.Close()
+			return body.Close()
+		}),
+	}
+
+	return headSize + size, r, nil
+}
+
+// closerFunc adapts a function to the io.Closer interface.
+type closerFunc func() error
+
+// Close implements io.Closer.
+func (f closerFunc) Close() error {
+	return f()
+}
+
+// MessageStoreAck is sent in answer to a MessageStoreFile once the file has
+// been durably written, or has failed to be.
+type MessageStoreAck struct {
+	Err string
+	// InsufficientSpace is set when the file was refused because it does
+	// not fit in the capacity of the peer or the quota of the namespace.
+	InsufficientSpace bool
+	// Free is the number of bytes the peer can still store, namespace
+	// quotas aside.
+	Free int64
+}
+
 // handleMessageStoreFile handles a request to store a file.
-func (s *FileServer) handleMessageStoreFile(from string, msg MessageStoreFile) error {
+func (s *FileServer) handleMessageStoreFile(from string, requestID string, msg MessageStoreFile) error {
+	s.peerLock.Lock()
 	peer, ok := s.peers[from]
+	s.peerLock.Unlock()
 	if !ok {
 		return fmt.Errorf("peer (%s) could not be found in the peer list", from)
 	}
 
-	n, err := s.store.Write(msg.ID, msg.Key, io.LimitReader(peer, msg.Size))
+	s.clock.Update(msg.Version)
+
+	go s.receiveStoreFile(peer, requestID, msg)
+
+	return nil
+}
+
+// receiveStoreFile receives the stream announced by a MessageStoreFile from
+// peer and acknowledges it. It runs next to the message loop, which would be
+// held up by the whole transfer otherwise, and gives up on a sender that
+// stops sending for requestTimeout.
+func (s *FileServer) receiveStoreFile(peer p2p.Peer, requestID string, msg MessageStoreFile) {
+	n, err := s.readStoreFile(peer, msg)
+
+	var ack MessageStoreAck
 	if err != nil {
-		return err
+		ack.Err = err.Error()
+		ack.InsufficientSpace = errors.Is(err, ErrInsufficientSpace)
+	}
+	if free, spaceErr := s.store.free(); spaceErr == nil {
+		ack.Free = free
+	}
+	if replyErr := s.reply(peer.RemoteAddr().String(), requestID, ack); replyErr != nil {
+		log.Println("store ack error: ", replyErr)
+	}
+	if err != nil {
+		log.Printf("[%s] storing transfer (%s) from %s failed: %s", s.Transport.Addr(), msg.TransferID, peer.RemoteAddr(), err)
+		return
 	}
 
 	fmt.Printf("[%s] written %d bytes to disk\n", s.Transport.Addr(), n)
+}
 
-	peer.CloseStream()
+// readStoreFile reads the stream announced by msg from peer into its
+// transfer.
+func (s *FileServer) readStoreFile(peer p2p.Peer, msg MessageStoreFile) (int64, error) {
+	defer s.lockIncoming(peer)()
 
-	return nil
+	if err := peer.WaitStream(requestTimeout); err != nil {
+		return 0, fmt.Errorf("%w: %s", ErrRequestTimeout, err)
+	}
+	defer peer.CloseStream()
+	// The read loop of the connection reads without a deadline.
+	defer peer.SetReadDeadline(time.Time{})
+
+	r := &deadlineReader{conn: peer, timeout: requestTimeout}
+	return s.receiveUpload(io.LimitReader(r, msg.Size-msg.Offset), msg)
 }
 
 // bootstrapNetwork connects to bootstrap nodes to join the network.
@@ -303,6 +1321,16 @@ func (s *FileServer) Start() error {
 	}
 	s.bootstrapNetwork()
 
+	if s.ScrubInterval > 0 {
+		go s.scrubber.Start()
+	}
+	go s.collectTombstones()
+	go s.reap()
+	go s.rebalancer()
+	if s.GCInterval > 0 {
+		go s.collectGarbage()
+	}
+
 	s.loop()
 
 	return nil
@@ -311,4 +1339,21 @@ func (s *FileServer) Start() error {
 func init() {
 	gob.Register(MessageStoreFile{})
 	gob.Register(MessageGetFile{})
+	gob.Register(MessageFileStream{})
+	gob.Register(MessageStoreAck{})
+	gob.Register(MessageDraining{})
+	gob.Register(MessageNodeInfo{})
+	gob.Register(MessageNodeInfoResponse{})
+	gob.Register(MessageDeleteFile{})
+	gob.Register(MessageStat{})
+	gob.Register(MessageStatResponse{})
+	gob.Register(MessageTransferStatus{})
+	gob.Register(MessageTransferStatusResponse{})
+	gob.Register(MessageMerkleNodes{})
+	gob.Register(MessageMerkleNodesResponse{})
+	gob.Register(MessageMerkleLeaves{})
+	gob.Register(MessageMerkleLeavesResponse{})
+	gob.Register(MessageDenied{})
+	gob.Register(MessageRewrapKey{})
+	gob.Register(MessageRewrapKeyResponse{})
 }
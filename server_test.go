@@ -0,0 +1,524 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Dhruv-mak/godiststore/p2p"
+)
+
+// newTestCluster starts n file servers serving testNamespace that are all
+// connected to each other, and stops them when the test ends.
+func newTestCluster(t *testing.T, n int) []*FileServer {
+	t.Helper()
+
+	keys := NewKeyring(newEncryptionKey())
+	servers := make([]*FileServer, n)
+	for i := range servers {
+		servers[i] = newClusterServer(t, keys)
+	}
+	for i, s := range servers {
+		for _, other := range servers[:i] {
+			connectServers(t, s, other)
+		}
+	}
+	waitForPeers(t, servers...)
+
+	return servers
+}
+
+// newClusterServer starts a file server serving testNamespace on a free port
+// of the loopback interface.
+func newClusterServer(t *testing.T, keys KeyProvider) *FileServer {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	tr := p2p.NewTCPTransport(p2p.TCPTransportOpts{
+		ListenAddr:    addr,
+		HandshakeFunc: p2p.NOPHandshakeFunc,
+		Decoder:       p2p.DefaultDecoder{},
+	})
+	s := NewFileServer(FileServerOpts{
+		KeyProvider:       keys,
+		StorageRoot:       t.TempDir(),
+		PathTransformFunc: CASPathTransformFunc,
+		Transport:         tr,
+		Namespaces:        map[string]NamespaceOpts{testNamespace: {}},
+	})
+	tr.OnPeer = s.OnPeer
+
+	go s.Start()
+	t.Cleanup(s.Stop)
+
+	return s
+}
+
+// connectServers connects from to to, retrying until to is listening.
+func connectServers(t *testing.T, from *FileServer, to *FileServer) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		err := from.Transport.Dial(to.Transport.Addr())
+		if err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// waitForPeers waits until every one of servers is connected to all others
+// and has been told their NodeInfo.
+func waitForPeers(t *testing.T, servers ...*FileServer) {
+	t.Helper()
+
+	waitFor(t, "servers to connect", func() bool {
+		for _, s := range servers {
+			s.peerLock.Lock()
+			connected, known := len(s.peers), len(s.peerInfos)
+			s.peerLock.Unlock()
+			if connected < len(servers)-1 || known < connected {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// waitFor waits up to five seconds for done to return true.
+func waitFor(t *testing.T, what string, done func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// testPeer is a peer that is never written to, for tests that only need
+// peers to tell apart.
+type testPeer struct {
+	net.Conn
+	addr *net.TCPAddr
+}
+
+func newTestPeer(port int) testPeer {
+	return testPeer{addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: port}}
+}
+
+func (p testPeer) RemoteAddr() net.Addr           { return p.addr }
+func (p testPeer) Send([]byte) error              { return nil }
+func (p testPeer) WaitStream(time.Duration) error { return nil }
+func (p testPeer) CloseStream()                   {}
+
+func TestReplicateResult(t *testing.T) {
+	s := newTestServer(t)
+	peers := []p2p.Peer{newTestPeer(1), newTestPeer(2), newTestPeer(3)}
+	local := StoreResult{Replicas: []ReplicaResult{{Addr: "local", Acked: true}}}
+
+	result, err := s.replicate(local, "key", ConsistencyAll, peers, func(p2p.Peer) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Required != 4 || result.Acked() != 4 {
+		t.Errorf("expected all 4 replicas to be required and acked, have %d of %d", result.Acked(), result.Required)
+	}
+	for i, peer := range peers {
+		replica := result.Replicas[i+1]
+		if replica.Addr != peer.RemoteAddr().String() || !replica.Acked || replica.Err != nil {
+			t.Errorf("expected replica %d to be acked by %s, have %+v", i+1, peer.RemoteAddr(), replica)
+		}
+	}
+
+	// A write at consistency one is done with the local copy.
+	release := make(chan struct{})
+	defer close(release)
+	result, err = s.replicate(local, "key", ConsistencyOne, peers, func(p2p.Peer) error {
+		<-release
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Required != 1 || result.Acked() != 1 || len(result.Replicas) != 4 {
+		t.Errorf("expected only the local copy to be waited for, have %+v", result)
+	}
+}
+
+func TestReplicateQuorumNotMet(t *testing.T) {
+	s := newTestServer(t)
+	peers := []p2p.Peer{newTestPeer(1), newTestPeer(2), newTestPeer(3)}
+	local := StoreResult{Replicas: []ReplicaResult{{Addr: "local", Acked: true}}}
+	errRefused := errors.New("refused")
+
+	// Once one replica fails, a write at consistency all cannot succeed
+	// and returns without waiting for the others.
+	release := make(chan struct{})
+	defer close(release)
+	result, err := s.replicate(local, "key", ConsistencyAll, peers, func(peer p2p.Peer) error {
+		if peer == peers[1] {
+			return errRefused
+		}
+		<-release
+		return nil
+	})
+	if !errors.Is(err, ErrQuorumNotMet) {
+		t.Fatalf("expected write to fail with %s, have %v", ErrQuorumNotMet, err)
+	}
+	if !errors.Is(result.Replicas[2].Err, errRefused) {
+		t.Errorf("expected the error of the failed replica to be kept, have %v", result.Replicas[2].Err)
+	}
+	if result.Acked() != 1 {
+		t.Errorf("expected only the local copy to be acked, have %d", result.Acked())
+	}
+
+	// A quorum of 3 out of 4 survives a single failure.
+	result, err = s.replicate(local, "key", ConsistencyQuorum, peers, func(peer p2p.Peer) error {
+		if peer == peers[1] {
+			return errRefused
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Required != 3 || result.Acked() < 3 {
+		t.Errorf("expected 3 replicas to be required and acked, have %d of %d", result.Acked(), result.Required)
+	}
+}
+
+func TestStoreAcksPerPeer(t *testing.T) {
+	servers := newTestCluster(t, 3)
+	writer := servers[0]
+
+	data := []byte("acknowledged by every replica")
+	result, err := writer.StoreWithOptions(testNamespace, "key", bytes.NewReader(data), WriteOptions{Consistency: ConsistencyAll})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Required != 3 || result.Acked() != 3 {
+		t.Fatalf("expected 3 of 3 replicas to acknowledge, have %+v", result)
+	}
+	if result.Replicas[0].Addr != writer.Transport.Addr() {
+		t.Errorf("expected the local copy to come first, have %s", result.Replicas[0].Addr)
+	}
+
+	for _, s := range servers[1:] {
+		meta, ok := s.store.head(testNamespace, hashKey("key"))
+		if !ok || meta.Version != result.Version {
+			t.Errorf("expected %s to hold a replica at version %s, have %+v", s.Transport.Addr(), result.Version, meta)
+		}
+	}
+}
+
+func TestConcurrentStreamsToOnePeer(t *testing.T) {
+	servers := newTestCluster(t, 2)
+	writer, reader := servers[0], servers[1]
+
+	// Several files larger than a transfer segment are sent to the same
+	// peer at once; their streams must not be interleaved on the
+	// connection.
+	files := make(map[string][]byte)
+	for i := range 4 {
+		files[fmt.Sprintf("file-%d", i)] = bytes.Repeat([]byte{byte('a' + i)}, 2*transferSegmentSize+i)
+	}
+
+	var wg sync.WaitGroup
+	for key, data := range files {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := writer.StoreWithOptions(testNamespace, key, bytes.NewReader(data), WriteOptions{Consistency: ConsistencyAll}); err != nil {
+				t.Errorf("storing (%s): %s", key, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	for key, data := range files {
+		r, err := reader.Get(testNamespace, key)
+		if err != nil {
+			t.Fatalf("reading (%s): %s", key, err)
+		}
+		if b, _ := io.ReadAll(r); !bytes.Equal(b, data) {
+			t.Errorf("expected replica of (%s) to arrive intact", key)
+		}
+	}
+}
+
+func TestStoreFileReceivedOutsideLoop(t *testing.T) {
+	servers := newTestCluster(t, 3)
+	a, b, c := servers[0], servers[1], servers[2]
+	peerOf := func(s *FileServer, other *FileServer) p2p.Peer {
+		for _, peer := range s.peerList() {
+			if s.peerInfo(peer).ID == other.ID {
+				return peer
+			}
+		}
+		t.Fatalf("%s is not connected to %s", s.ID, other.ID)
+		return nil
+	}
+
+	if _, err := a.store.Write(testNamespace, "key", bytes.NewReader(make([]byte, 1000))); err != nil {
+		t.Fatal(err)
+	}
+	ns, _ := a.namespace(testNamespace)
+	u, err := a.newUpload(ns, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.bytesPerSecond = 400
+
+	sent := make(chan error, 1)
+	go func() { sent <- a.sendUpload(peerOf(a, b), u) }()
+
+	// b answers other peers while the slow stream from a is coming in.
+	time.Sleep(100 * time.Millisecond)
+	if _, err := c.request(peerOf(c, b), MessageNodeInfo{}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-sent:
+		t.Fatalf("expected the upload to still be streaming, have %v", err)
+	default:
+	}
+
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+	if !b.store.Has(testNamespace, u.Key) {
+		t.Errorf("expected the replica to be stored once the stream is done")
+	}
+}
+
+func TestRequestFileAnswersErrors(t *testing.T) {
+	servers := newTestCluster(t, 2)
+	a, b := servers[0], servers[1]
+	peer := a.peerList()[0]
+
+	// A file whose metadata cannot be read is refused with an error rather
+	// than left unanswered.
+	if err := b.Store(testNamespace, "broken", bytes.NewReader([]byte("data"))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.store.Storage.Write(b.store.metaName(testNamespace, "broken"), bytes.NewReader([]byte("{"))); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{"missing", "broken"} {
+		done := make(chan error, 1)
+		go func() {
+			done <- a.requestFile(peer, MessageGetFile{Namespace: testNamespace, Key: key}, func(fileHeader, io.Reader) error {
+				return nil
+			})
+		}()
+		select {
+		case err := <-done:
+			if err == nil {
+				t.Errorf("expected request for (%s) to fail", key)
+			}
+		case <-time.After(2 * requestTimeout):
+			t.Fatalf("expected request for (%s) to be answered", key)
+		}
+	}
+
+	// The connection is still usable afterwards.
+	data := []byte("still connected")
+	if err := b.Store(testNamespace, "key", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	var have []byte
+	err := a.requestFile(peer, MessageGetFile{Namespace: testNamespace, Key: "key"}, func(_ fileHeader, r io.Reader) error {
+		var err error
+		have, err = io.ReadAll(r)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(have, data) {
+		t.Errorf("expected %s, have %s", data, have)
+	}
+}
+
+func TestGetDiscardsCorruptLocalCopy(t *testing.T) {
+	s := newTestServer(t)
+	if err := s.Store(testNamespace, "key", bytes.NewReader([]byte("original"))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.store.Storage.Write(s.store.objectName(testNamespace, "key"), bytes.NewReader([]byte("bitrot!!"))); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := s.Get(testNamespace, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected reading a corrupt copy to fail with %s, have %v", ErrCorrupt, err)
+	}
+	if s.store.Has(testNamespace, "key") {
+		t.Errorf("expected the corrupt copy to be discarded")
+	}
+}
+
+func TestGetRangeRejectsNegativeRange(t *testing.T) {
+	servers := newTestCluster(t, 2)
+	a, b := servers[0], servers[1]
+	if err := b.Store(testNamespace, "key", bytes.NewReader([]byte("0123456789"))); err != nil {
+		t.Fatal(err)
+	}
+
+	// a holds no plaintext copy, so the range would otherwise be asked of b.
+	for _, tt := range [][2]int64{{-1, 4}, {0, -4}} {
+		if _, err := a.GetRange(testNamespace, "key", tt[0], tt[1]); !errors.Is(err, ErrInvalidRange) {
+			t.Errorf("range (%d, %d): expected %s, have %v", tt[0], tt[1], ErrInvalidRange, err)
+		}
+	}
+}
+
+func TestStoreStreamsUnknownLength(t *testing.T) {
+	servers := newTestCluster(t, 3)
+	writer := servers[0]
+
+	// The data comes through a pipe, so neither its length nor a way to
+	// read it twice is known up front.
+	data := make([]byte, 3*transferSegmentSize+17)
+	for i := range data {
+		data[i] = byte(i*7 + i/251)
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		for chunk := data; len(chunk) > 0; {
+			n := min(len(chunk), 1000)
+			if _, err := pw.Write(chunk[:n]); err != nil {
+				return
+			}
+			chunk = chunk[n:]
+		}
+		pw.Close()
+	}()
+
+	result, err := writer.StoreWithOptions(testNamespace, "key", pr, WriteOptions{Consistency: ConsistencyAll})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Acked() != 3 {
+		t.Fatalf("expected 3 replicas to acknowledge, have %+v", result)
+	}
+
+	for _, s := range servers[1:] {
+		meta, ok := s.store.head(testNamespace, hashKey("key"))
+		if !ok || meta.Version != result.Version {
+			t.Fatalf("expected %s to hold a replica at version %s, have %+v", s.Transport.Addr(), result.Version, meta)
+		}
+		r, err := s.GetWithOptions(testNamespace, "key", ReadOptions{Consistency: ConsistencyOne})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if have, _ := io.ReadAll(r); !bytes.Equal(have, data) {
+			t.Errorf("expected the replica on %s to arrive intact, have %d bytes", s.Transport.Addr(), len(have))
+		}
+	}
+}
+
+func TestRequestFileAmongUploads(t *testing.T) {
+	servers := newTestCluster(t, 2)
+	a, b := servers[0], servers[1]
+	peer := a.peerList()[0]
+
+	data := []byte("asked for")
+	if err := b.Store(testNamespace, "key", bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	// b streams uploads to a while a asks it for a file, so a has to tell
+	// the answer apart from the uploads arriving on the same connection.
+	var wg sync.WaitGroup
+	for i := range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key := fmt.Sprintf("upload-%d", i)
+			if _, err := b.StoreWithOptions(testNamespace, key, bytes.NewReader(make([]byte, transferSegmentSize)), WriteOptions{Consistency: ConsistencyAll}); err != nil {
+				t.Errorf("storing (%s): %s", key, err)
+			}
+		}()
+	}
+	for range 4 {
+		var have []byte
+		err := a.requestFile(peer, MessageGetFile{Namespace: testNamespace, Key: "key"}, func(_ fileHeader, r io.Reader) error {
+			var err error
+			have, err = io.ReadAll(r)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(have, data) {
+			t.Errorf("expected %s, have %s", data, have)
+		}
+	}
+	wg.Wait()
+}
+
+func TestGetRangeStreamsFromPeer(t *testing.T) {
+	servers := newTestCluster(t, 3)
+	a, b := servers[0], servers[1]
+
+	data := make([]byte, 3*transferSegmentSize)
+	for i := range data {
+		data[i] = byte(i*7 + i/251)
+	}
+	if _, err := a.StoreWithOptions(testNamespace, "key", bytes.NewReader(data), WriteOptions{Consistency: ConsistencyAll}); err != nil {
+		t.Fatal(err)
+	}
+
+	// b only holds an encrypted replica, so the range comes from a peer.
+	r, err := b.GetRange(testNamespace, "key", 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, _ := io.ReadAll(r); !bytes.Equal(have, data[10:]) {
+		t.Fatalf("expected the rest of the file from offset 10, have %d bytes", len(have))
+	}
+
+	// A range given up on early leaves the connection usable.
+	r, err = b.GetRange(testNamespace, "key", 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	head := make([]byte, 100)
+	if _, err := io.ReadFull(r, head); err != nil {
+		t.Fatal(err)
+	}
+	r.(io.Closer).Close()
+
+	r, err = b.GetRange(testNamespace, "key", 5, 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if have, _ := io.ReadAll(r); !bytes.Equal(have, data[5:25]) {
+		t.Errorf("expected %x, have %x", data[5:25], have)
+	}
+}
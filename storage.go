@@ -0,0 +1,73 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+)
+
+// Storage is where a Store keeps its bytes. Objects, their metadata and
+// history, and partial transfers are all kept as blobs with slash separated
+// names such as "<id>/<path>/<filename>". Implementations must be safe for
+// concurrent use, and report missing blobs with errors matching
+// os.ErrNotExist.
+type Storage interface {
+	// Write stores everything read from r as the blob name, replacing any
+	// blob of that name. The blob is durable once Write returns; if it
+	// fails, the blob it would have replaced is left as it was.
+	Write(name string, r io.Reader) (int64, error)
+	// Read opens the blob name.
+	Read(name string) (Blob, error)
+	// Has reports whether the blob name exists.
+	Has(name string) bool
+	// Delete removes the blob name. Deleting a missing blob is not an error.
+	Delete(name string) error
+	// Stat returns the size of the blob name.
+	Stat(name string) (int64, error)
+	// List returns, in lexical order, the names of the blobs under prefix,
+	// that is whose names start with prefix and a slash. An empty prefix
+	// lists every blob.
+	List(prefix string) ([]string, error)
+	// Rename renames the blob from to to, replacing any blob named to.
+	Rename(from string, to string) error
+	// Clear removes every blob.
+	Clear() error
+}
+
+// Blob is a blob opened for reading.
+type Blob interface {
+	io.Reader
+	io.ReaderAt
+	io.Closer
+	// Size returns the size of the blob.
+	Size() int64
+}
+
+// underPrefix reports whether the blob name is listed under prefix.
+func underPrefix(name string, prefix string) bool {
+	return len(prefix) == 0 || strings.HasPrefix(name, prefix+"/")
+}
+
+// sortedNames returns the names under prefix among names, in lexical order.
+func sortedNames[T any](names map[string]T, prefix string) []string {
+	var list []string
+	for name := range names {
+		if underPrefix(name, prefix) {
+			list = append(list, name)
+		}
+	}
+	sort.Strings(list)
+	return list
+}
+
+// notExist returns the error reporting that the blob name does not exist.
+func notExist(op string, name string) error {
+	return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+}
+
+// baseName returns the last element of the blob name.
+func baseName(name string) string {
+	return path.Base(name)
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// diskTempDirName is the directory under the root blobs are written to before
+// they are renamed into place.
+const diskTempDirName = ".tmp"
+
+// DiskStorage keeps every blob in its own file under a root directory, at
+// the path given by its name. Names that would resolve outside the root are
+// rejected with an InvalidNameError.
+type DiskStorage struct {
+	root string
+}
+
+// NewDiskStorage creates a DiskStorage rooted at root.
+func NewDiskStorage(root string) *DiskStorage {
+	return &DiskStorage{root: root}
+}
+
+// path returns the path of the file of the blob name.
+func (d *DiskStorage) path(name string) string {
+	return filepath.Join(d.root, filepath.FromSlash(name))
+}
+
+// Write implements Storage. The blob is written to a temporary file that is
+// synced and then renamed over the old one.
+func (d *DiskStorage) Write(name string, r io.Reader) (int64, error) {
+	if err := checkBlobName(name); err != nil {
+		return 0, err
+	}
+	tmpDir := filepath.Join(d.root, diskTempDirName)
+	if err := os.MkdirAll(tmpDir, os.ModePerm); err != nil {
+		return 0, err
+	}
+	f, err := os.CreateTemp(tmpDir, "blob-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	n, err := io.Copy(f, r)
+	if err != nil {
+		return n, err
+	}
+	if err := f.Sync(); err != nil {
+		return n, err
+	}
+	if err := f.Close(); err != nil {
+		return n, err
+	}
+
+	return n, d.renameInto(f.Name(), d.path(name))
+}
+
+// renameInto renames the file from to the path to, creating its parent
+// directories. It tries again if a concurrent Delete prunes them before the
+// rename.
+func (d *DiskStorage) renameInto(from string, to string) error {
+	var err error
+	for range 3 {
+		if err = os.MkdirAll(filepath.Dir(to), os.ModePerm); err != nil {
+			return err
+		}
+		if err = os.Rename(from, to); !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if _, statErr := os.Stat(from); statErr != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// diskBlob is a blob file opened for reading.
+type diskBlob struct {
+	*os.File
+	size int64
+}
+
+// Size implements Blob.
+func (b diskBlob) Size() int64 {
+	return b.size
+}
+
+// Read implements Storage.
+func (d *DiskStorage) Read(name string) (Blob, error) {
+	if err := checkBlobName(name); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(d.path(name))
+	if err != nil {
+		return nil, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if fi.IsDir() {
+		f.Close()
+		return nil, notExist("read", name)
+	}
+
+	return diskBlob{File: f, size: fi.Size()}, nil
+}
+
+// Has implements Storage. Directories are not blobs.
+func (d *DiskStorage) Has(name string) bool {
+	if checkBlobName(name) != nil {
+		return false
+	}
+	fi, err := os.Stat(d.path(name))
+	return err == nil && !fi.IsDir()
+}
+
+// Delete implements Storage. Directories left empty are removed as well.
+func (d *DiskStorage) Delete(name string) error {
+	if err := checkBlobName(name); err != nil {
+		return err
+	}
+	path := d.path(name)
+	if !d.Has(name) {
+		return nil
+	}
+	err := os.Remove(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	d.pruneDirs(filepath.Dir(path))
+	return nil
+}
+
+// pruneDirs removes dir and its parents below the root for as long as they
+// are empty.
+func (d *DiskStorage) pruneDirs(dir string) {
+	root := filepath.Clean(d.root)
+	for dir != root && strings.HasPrefix(dir, root+string(filepath.Separator)) {
+		if err := os.Remove(dir); err != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
+
+// Stat implements Storage.
+func (d *DiskStorage) Stat(name string) (int64, error) {
+	if err := checkBlobName(name); err != nil {
+		return 0, err
+	}
+	fi, err := os.Stat(d.path(name))
+	if err != nil {
+		return 0, err
+	}
+	if fi.IsDir() {
+		return 0, notExist("stat", name)
+	}
+	return fi.Size(), nil
+}
+
+// List implements Storage.
+func (d *DiskStorage) List(prefix string) ([]string, error) {
+	if len(prefix) > 0 {
+		if err := checkBlobName(prefix); err != nil {
+			return nil, err
+		}
+	}
+	var names []string
+	err := filepath.WalkDir(d.path(prefix), func(path string, e fs.DirEntry, err error) error {
+		// Directories may be pruned by a concurrent Delete.
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(d.root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if e.IsDir() {
+			if rel == diskTempDirName {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if underPrefix(rel, prefix) {
+			names = append(names, rel)
+		}
+		return nil
+	})
+	// WalkDir lists "a/b" before "a.meta", which sorts first.
+	sort.Strings(names)
+	return names, err
+}
+
+// Rename implements Storage. Directories left empty are removed.
+func (d *DiskStorage) Rename(from string, to string) error {
+	for _, name := range []string{from, to} {
+		if err := checkBlobName(name); err != nil {
+			return err
+		}
+	}
+	if err := d.renameInto(d.path(from), d.path(to)); err != nil {
+		return err
+	}
+	d.pruneDirs(filepath.Dir(d.path(from)))
+	return nil
+}
+
+// garbage implements garbageCollector. Temporary files last modified before
+// the given time were left behind by writes that never finished, and empty
+// directories by deletes that lost a race with a write.
+func (d *DiskStorage) garbage(before time.Time) ([]GCItem, error) {
+	var items []GCItem
+
+	entries, err := os.ReadDir(filepath.Join(d.root, diskTempDirName))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || !info.ModTime().Before(before) {
+			continue
+		}
+		path := filepath.Join(d.root, diskTempDirName, entry.Name())
+		items = append(items, GCItem{
+			Name:   diskTempDirName + "/" + entry.Name(),
+			Size:   info.Size(),
+			Reason: "abandoned temporary file",
+			remove: func() error { return os.Remove(path) },
+		})
+	}
+
+	if _, err := d.emptyDirs(d.root, &items); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	return items, nil
+}
+
+// emptyDirs adds an item for every directory under dir that holds nothing but
+// empty directories to items, deepest first, and reports whether dir itself
+// is such a directory.
+func (d *DiskStorage) emptyDirs(dir string, items *[]GCItem) (bool, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return false, err
+	}
+
+	empty := true
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			empty = false
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		if path == filepath.Join(d.root, diskTempDirName) {
+			empty = false
+			continue
+		}
+		sub, err := d.emptyDirs(path, items)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		if !sub {
+			empty = false
+			continue
+		}
+
+		rel, err := filepath.Rel(d.root, path)
+		if err != nil {
+			return false, err
+		}
+		*items = append(*items, GCItem{
+			Name:   filepath.ToSlash(rel) + "/",
+			Reason: "empty directory",
+			remove: func() error {
+				// A write may have put something in it meanwhile.
+				if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) && !isDirNotEmpty(path) {
+					return err
+				}
+				return nil
+			},
+		})
+	}
+	return empty, nil
+}
+
+// isDirNotEmpty reports whether the directory at path has entries.
+func isDirNotEmpty(path string) bool {
+	entries, err := os.ReadDir(path)
+	return err == nil && len(entries) > 0
+}
+
+// Clear implements Storage.
+func (d *DiskStorage) Clear() error {
+	return os.RemoveAll(d.root)
+}
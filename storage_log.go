@@ -0,0 +1,693 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultSegmentSize is the size at which a segment is sealed by default.
+	defaultSegmentSize = 64 << 20
+	// defaultCompactRatio is the share of the log taken up by overwritten
+	// and deleted blobs at which it is compacted by default.
+	defaultCompactRatio = 0.5
+)
+
+// Operations recorded in a log.
+const (
+	logPut byte = iota + 1
+	logDelete
+	logRename
+)
+
+// logHeaderSize is the size of the header of a log record: a CRC-32 of the
+// rest of the record, the operation, and the lengths of the name and of the
+// data that follow it.
+const logHeaderSize = 4 + 1 + 4 + 8
+
+// LogStorageOpts holds the configuration options for a LogStorage.
+type LogStorageOpts struct {
+	// Root is the directory the segments are kept in.
+	Root string
+	// SegmentSize is the size at which the segment being appended to is
+	// sealed and a new one started.
+	SegmentSize int64
+	// CompactRatio is the share of the log taken up by overwritten and
+	// deleted blobs at which it is compacted in the background, once that
+	// is at least a segment's worth. Negative disables it.
+	CompactRatio float64
+}
+
+// logSegment is a file of a log.
+type logSegment struct {
+	id int
+	f  *os.File
+	// size is the number of bytes appended to the segment.
+	size int64
+	// live is the number of bytes of blobs in the index it holds.
+	live int64
+}
+
+// logEntry locates the data of a blob in the log.
+type logEntry struct {
+	segment int
+	offset  int64
+	size    int64
+}
+
+// LogStorage packs blobs into a few large segment files instead of keeping a
+// file per blob, which suits millions of small objects better than a
+// directory tree. Every write, delete and rename is appended as a record to
+// the newest segment, and an index of where the data of every blob starts is
+// kept in memory and rebuilt from the segments when the log is opened.
+// Records are checksummed, so one cut short by a crash is detected and
+// dropped, and corrupt ones are set aside. The space taken by overwritten and
+// deleted blobs is reclaimed by Compact, which copies the live blobs into a
+// fresh segment.
+type LogStorage struct {
+	LogStorageOpts
+
+	mu       sync.RWMutex
+	segments map[int]*logSegment
+	active   *logSegment
+	index    map[string]logEntry
+
+	compactLock sync.Mutex
+}
+
+// OpenLogStorage opens the log under opts.Root, creating it if it does not
+// exist.
+func OpenLogStorage(opts LogStorageOpts) (*LogStorage, error) {
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = defaultSegmentSize
+	}
+	if opts.CompactRatio == 0 {
+		opts.CompactRatio = defaultCompactRatio
+	}
+	if err := os.MkdirAll(opts.Root, os.ModePerm); err != nil {
+		return nil, err
+	}
+
+	l := &LogStorage{
+		LogStorageOpts: opts,
+		segments:       make(map[int]*logSegment),
+		index:          make(map[string]logEntry),
+	}
+	if err := l.recover(); err != nil {
+		l.Close()
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// segmentPath returns the path of the segment with the given id.
+func (l *LogStorage) segmentPath(id int) string {
+	return filepath.Join(l.Root, fmt.Sprintf("segment-%08d.log", id))
+}
+
+// recover opens the segments and rebuilds the index by replaying them in
+// order. Spool files of writes that never made it into the log are removed.
+func (l *LogStorage) recover() error {
+	spools, err := filepath.Glob(filepath.Join(l.Root, "spool-*"))
+	if err != nil {
+		return err
+	}
+	for _, path := range spools {
+		os.Remove(path)
+	}
+
+	paths, err := filepath.Glob(filepath.Join(l.Root, "segment-*.log"))
+	if err != nil {
+		return err
+	}
+	var ids []int
+	for _, path := range paths {
+		var id int
+		if _, err := fmt.Sscanf(filepath.Base(path), "segment-%08d.log", &id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+
+	for _, id := range ids {
+		f, err := os.OpenFile(l.segmentPath(id), os.O_RDWR, 0o644)
+		if err != nil {
+			return err
+		}
+		seg := &logSegment{id: id, f: f}
+		l.segments[id] = seg
+		if err := l.replay(seg, id == ids[len(ids)-1]); err != nil {
+			return err
+		}
+		l.active = seg
+	}
+
+	if l.active == nil {
+		return l.startSegment(1)
+	}
+	return nil
+}
+
+// replay applies the records of seg to the index. A record that is
+// incomplete or fails its checksum is skipped up to the next valid record,
+// and the bytes skipped are copied aside by quarantine. Only when no valid
+// record follows in the last segment, the one that was being appended to, is
+// it taken for a write cut short by a crash and truncated instead.
+func (l *LogStorage) replay(seg *logSegment, last bool) error {
+	fi, err := seg.f.Stat()
+	if err != nil {
+		return err
+	}
+
+	var offset int64
+	for offset < fi.Size() {
+		op, name, data, dataLen, err := l.readRecord(seg.f, offset, fi.Size())
+		if err != nil {
+			next := l.nextRecord(seg.f, offset+1, fi.Size())
+			if last && next == fi.Size() {
+				log.Printf("truncating log segment %d at offset %d: %s", seg.id, offset, err)
+				if err := seg.f.Truncate(offset); err != nil {
+					return err
+				}
+				break
+			}
+
+			log.Printf("skipping %d corrupt bytes of log segment %d at offset %d: %s", next-offset, seg.id, offset, err)
+			if err := l.quarantine(seg, offset, next); err != nil {
+				return err
+			}
+			offset = next
+			seg.size = offset
+			continue
+		}
+
+		switch op {
+		case logPut:
+			l.setEntry(name, logEntry{segment: seg.id, offset: data, size: dataLen})
+		case logDelete:
+			l.removeEntry(name)
+		case logRename:
+			to := make([]byte, dataLen)
+			if _, err := seg.f.ReadAt(to, data); err != nil {
+				return err
+			}
+			if entry, ok := l.index[name]; ok {
+				l.removeEntry(name)
+				l.setEntry(string(to), entry)
+			}
+		}
+
+		offset = data + dataLen
+		seg.size = offset
+	}
+
+	return nil
+}
+
+// nextRecord returns the offset of the first valid record in f, which is
+// size bytes long, at or after offset, or size if there is none.
+func (l *LogStorage) nextRecord(f *os.File, offset int64, size int64) int64 {
+	for ; offset < size; offset++ {
+		if _, _, _, _, err := l.readRecord(f, offset, size); err == nil {
+			return offset
+		}
+	}
+	return size
+}
+
+// quarantine copies the bytes of seg from start up to end into a file of
+// their own next to the segments, so corrupt records are kept for
+// inspection after compaction has removed the segment.
+func (l *LogStorage) quarantine(seg *logSegment, start int64, end int64) error {
+	path := filepath.Join(l.Root, fmt.Sprintf("corrupt-%08d-%d.bin", seg.id, start))
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(f, io.NewSectionReader(seg.f, start, end-start))
+	return err
+}
+
+// readRecord reads the header and name of the record at offset in f, which
+// is size bytes long, and checks the record against its checksum. It returns
+// the offset and length of the data of the record.
+func (l *LogStorage) readRecord(f *os.File, offset int64, size int64) (byte, string, int64, int64, error) {
+	var header [logHeaderSize]byte
+	if offset+logHeaderSize > size {
+		return 0, "", 0, 0, io.ErrUnexpectedEOF
+	}
+	if _, err := f.ReadAt(header[:], offset); err != nil {
+		return 0, "", 0, 0, err
+	}
+	sum := binary.BigEndian.Uint32(header[:4])
+	op := header[4]
+	nameLen := int64(binary.BigEndian.Uint32(header[5:9]))
+	dataLen := int64(binary.BigEndian.Uint64(header[9:]))
+
+	data := offset + logHeaderSize + nameLen
+	if nameLen < 0 || dataLen < 0 || data+dataLen > size {
+		return 0, "", 0, 0, io.ErrUnexpectedEOF
+	}
+	if op < logPut || op > logRename {
+		return 0, "", 0, 0, fmt.Errorf("unknown operation %d", op)
+	}
+
+	h := crc32.NewIEEE()
+	if _, err := io.Copy(h, io.NewSectionReader(f, offset+4, data+dataLen-offset-4)); err != nil {
+		return 0, "", 0, 0, err
+	}
+	if h.Sum32() != sum {
+		return 0, "", 0, 0, fmt.Errorf("checksum mismatch")
+	}
+
+	name := make([]byte, nameLen)
+	if _, err := f.ReadAt(name, offset+logHeaderSize); err != nil {
+		return 0, "", 0, 0, err
+	}
+
+	return op, string(name), data, dataLen, nil
+}
+
+// setEntry points the index entry of name at entry, keeping the live byte
+// counts of the segments up to date. The caller must hold the write lock.
+func (l *LogStorage) setEntry(name string, entry logEntry) {
+	l.removeEntry(name)
+	l.index[name] = entry
+	l.segments[entry.segment].live += entry.size
+}
+
+// removeEntry removes the index entry of name. The caller must hold the
+// write lock.
+func (l *LogStorage) removeEntry(name string) {
+	if old, ok := l.index[name]; ok {
+		if seg, ok := l.segments[old.segment]; ok {
+			seg.live -= old.size
+		}
+		delete(l.index, name)
+	}
+}
+
+// startSegment creates the segment with the given id and makes it the one
+// appended to. The caller must hold the write lock.
+func (l *LogStorage) startSegment(id int) error {
+	f, err := os.OpenFile(l.segmentPath(id), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	seg := &logSegment{id: id, f: f}
+	l.segments[id] = seg
+	l.active = seg
+	return nil
+}
+
+// appendRecord appends a record to seg and syncs it. It returns the offset
+// the data of the record starts at. The caller must have exclusive access to
+// seg.
+func appendRecord(seg *logSegment, op byte, name string, data io.Reader, dataLen int64) (int64, error) {
+	var header [logHeaderSize]byte
+	header[4] = op
+	binary.BigEndian.PutUint32(header[5:9], uint32(len(name)))
+	binary.BigEndian.PutUint64(header[9:], uint64(dataLen))
+
+	h := crc32.NewIEEE()
+	h.Write(header[4:])
+	h.Write([]byte(name))
+
+	w := io.NewOffsetWriter(seg.f, seg.size)
+	if _, err := w.Write(header[:]); err != nil {
+		return 0, err
+	}
+	if _, err := io.WriteString(w, name); err != nil {
+		return 0, err
+	}
+	if n, err := io.Copy(io.MultiWriter(w, h), data); err != nil {
+		return 0, err
+	} else if n != dataLen {
+		return 0, fmt.Errorf("appended %d bytes of %s, want %d", n, name, dataLen)
+	}
+
+	// The checksum goes in last, so a record cut short never passes it.
+	binary.BigEndian.PutUint32(header[:4], h.Sum32())
+	if _, err := seg.f.WriteAt(header[:4], seg.size); err != nil {
+		return 0, err
+	}
+	if err := seg.f.Sync(); err != nil {
+		return 0, err
+	}
+
+	offset := seg.size + logHeaderSize + int64(len(name))
+	seg.size = offset + dataLen
+	return offset, nil
+}
+
+// append appends a record to the active segment, sealing it first if the
+// record would take it past SegmentSize. The caller must hold the write lock.
+func (l *LogStorage) append(op byte, name string, data io.Reader, dataLen int64) (logEntry, error) {
+	size := logHeaderSize + int64(len(name)) + dataLen
+	if l.active.size > 0 && l.active.size+size > l.SegmentSize {
+		if err := l.startSegment(l.active.id + 1); err != nil {
+			return logEntry{}, err
+		}
+	}
+
+	offset, err := appendRecord(l.active, op, name, data, dataLen)
+	if err != nil {
+		// Drop whatever part of the record made it in.
+		l.active.f.Truncate(l.active.size)
+		return logEntry{}, err
+	}
+	return logEntry{segment: l.active.id, offset: offset, size: dataLen}, nil
+}
+
+// Write implements Storage. The blob is spooled to a temporary file first, so
+// a slow writer does not hold up other writes to the log.
+func (l *LogStorage) Write(name string, r io.Reader) (int64, error) {
+	tmp, err := os.CreateTemp(l.Root, "spool-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	n, err := io.Copy(tmp, r)
+	if err != nil {
+		return n, err
+	}
+
+	l.mu.Lock()
+	entry, err := l.append(logPut, name, io.NewSectionReader(tmp, 0, n), n)
+	if err == nil {
+		l.setEntry(name, entry)
+	}
+	l.mu.Unlock()
+
+	if err == nil {
+		l.maybeCompact()
+	}
+	return n, err
+}
+
+// logBlob is a blob in the log opened for reading. It has a file of its own,
+// so it can still be read after compaction removed the segment.
+type logBlob struct {
+	*io.SectionReader
+	f *os.File
+}
+
+// Close implements Blob.
+func (b logBlob) Close() error {
+	return b.f.Close()
+}
+
+// Read implements Storage.
+func (l *LogStorage) Read(name string) (Blob, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	entry, ok := l.index[name]
+	if !ok {
+		return nil, notExist("read", name)
+	}
+	f, err := os.Open(l.segmentPath(entry.segment))
+	if err != nil {
+		return nil, err
+	}
+	return logBlob{io.NewSectionReader(f, entry.offset, entry.size), f}, nil
+}
+
+// Has implements Storage.
+func (l *LogStorage) Has(name string) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	_, ok := l.index[name]
+	return ok
+}
+
+// Delete implements Storage.
+func (l *LogStorage) Delete(name string) error {
+	l.mu.Lock()
+	if _, ok := l.index[name]; !ok {
+		l.mu.Unlock()
+		return nil
+	}
+	_, err := l.append(logDelete, name, strings.NewReader(""), 0)
+	if err == nil {
+		l.removeEntry(name)
+	}
+	l.mu.Unlock()
+
+	if err == nil {
+		l.maybeCompact()
+	}
+	return err
+}
+
+// Stat implements Storage.
+func (l *LogStorage) Stat(name string) (int64, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	entry, ok := l.index[name]
+	if !ok {
+		return 0, notExist("stat", name)
+	}
+	return entry.size, nil
+}
+
+// List implements Storage.
+func (l *LogStorage) List(prefix string) ([]string, error) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	return sortedNames(l.index, prefix), nil
+}
+
+// Rename implements Storage. The data stays where it is; only the record of
+// the rename is appended.
+func (l *LogStorage) Rename(from string, to string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	entry, ok := l.index[from]
+	if !ok {
+		return notExist("rename", from)
+	}
+	if _, err := l.append(logRename, from, strings.NewReader(to), int64(len(to))); err != nil {
+		return err
+	}
+	l.removeEntry(from)
+	l.setEntry(to, entry)
+
+	return nil
+}
+
+// Clear implements Storage.
+func (l *LogStorage) Clear() error {
+	l.compactLock.Lock()
+	defer l.compactLock.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	next := l.active.id + 1
+	for id, seg := range l.segments {
+		seg.f.Close()
+		if err := os.Remove(l.segmentPath(id)); err != nil {
+			return err
+		}
+		delete(l.segments, id)
+	}
+	l.index = make(map[string]logEntry)
+
+	return l.startSegment(next)
+}
+
+// Garbage returns the number of bytes the log could shrink by if it were
+// compacted, and its total size.
+func (l *LogStorage) Garbage() (int64, int64) {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+
+	var garbage, total int64
+	for _, seg := range l.segments {
+		garbage += seg.size - seg.live
+		total += seg.size
+	}
+	return garbage, total
+}
+
+// garbage implements garbageCollector. The space taken up by overwritten and
+// deleted blobs is reclaimed by compacting the log.
+func (l *LogStorage) garbage(time.Time) ([]GCItem, error) {
+	garbage, _ := l.Garbage()
+	if garbage == 0 {
+		return nil, nil
+	}
+	return []GCItem{{
+		Name:   "segments",
+		Size:   garbage,
+		Reason: "overwritten and deleted blobs",
+		remove: l.Compact,
+	}}, nil
+}
+
+// maybeCompact starts a compaction in the background once enough of the log
+// is garbage, unless one is running already.
+func (l *LogStorage) maybeCompact() {
+	if l.CompactRatio < 0 {
+		return
+	}
+	garbage, total := l.Garbage()
+	if garbage < l.SegmentSize || float64(garbage) < l.CompactRatio*float64(total) {
+		return
+	}
+	if !l.compactLock.TryLock() {
+		return
+	}
+
+	go func() {
+		defer l.compactLock.Unlock()
+		if err := l.compact(); err != nil {
+			log.Println("log compaction error: ", err)
+		}
+	}()
+}
+
+// Compact reclaims the space taken by overwritten and deleted blobs. The
+// segment being appended to is sealed, the live blobs of all sealed segments
+// are copied into a single new one, and the sealed segments are removed.
+// Reads and writes carry on while the blobs are copied.
+func (l *LogStorage) Compact() error {
+	l.compactLock.Lock()
+	defer l.compactLock.Unlock()
+
+	return l.compact()
+}
+
+// compact implements Compact. The caller must hold the compaction lock.
+func (l *LogStorage) compact() error {
+	// Seal the active segment, leaving a gap in the ids for the compacted
+	// segment. It is replayed after the segments it replaces but before
+	// anything written while it is being built.
+	l.mu.Lock()
+	sealed := make(map[int]*logSegment, len(l.segments))
+	for id, seg := range l.segments {
+		sealed[id] = seg
+	}
+	compactedID := l.active.id + 1
+	if err := l.startSegment(l.active.id + 2); err != nil {
+		l.mu.Unlock()
+		return err
+	}
+	snapshot := make(map[string]logEntry, len(l.index))
+	for name, entry := range l.index {
+		snapshot[name] = entry
+	}
+	l.mu.Unlock()
+
+	f, err := os.OpenFile(l.segmentPath(compactedID), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	compacted := &logSegment{id: compactedID, f: f}
+
+	// Copy in name order, so blobs listed together are stored together.
+	moved := make(map[logEntry]logEntry, len(snapshot))
+	for _, name := range sortedNames(snapshot, "") {
+		if err := l.copyEntry(compacted, moved, name, snapshot[name]); err != nil {
+			f.Close()
+			os.Remove(l.segmentPath(compactedID))
+			return err
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// Blobs written or renamed while copying point to the new segment or to
+	// their copy. Those renamed to a name the copy does not know are copied
+	// under their new name now.
+	l.segments[compactedID] = compacted
+	for name, entry := range l.index {
+		if _, ok := sealed[entry.segment]; !ok {
+			continue
+		}
+		if _, ok := moved[entry]; !ok {
+			if err := l.copyEntry(compacted, moved, name, entry); err != nil {
+				return err
+			}
+		}
+		l.setEntry(name, moved[entry])
+	}
+
+	// The sealed segments are removed oldest first once the copy is on
+	// disk, so a crash partway through never leaves a put behind without
+	// the later records that deleted or replaced it.
+	if err := compacted.f.Sync(); err != nil {
+		return err
+	}
+	ids := make([]int, 0, len(sealed))
+	for id := range sealed {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	var reclaimed int64
+	for _, id := range ids {
+		seg := sealed[id]
+		reclaimed += seg.size
+		seg.f.Close()
+		delete(l.segments, id)
+		if err := os.Remove(l.segmentPath(id)); err != nil {
+			return err
+		}
+	}
+	log.Printf("compacted %d log segments of %d bytes into one of %d bytes", len(sealed), reclaimed, compacted.size)
+
+	return nil
+}
+
+// copyEntry appends the data of entry as a put of name to seg and records
+// where it was copied to in moved.
+func (l *LogStorage) copyEntry(seg *logSegment, moved map[logEntry]logEntry, name string, entry logEntry) error {
+	src, err := os.Open(l.segmentPath(entry.segment))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	offset, err := appendRecord(seg, logPut, name, io.NewSectionReader(src, entry.offset, entry.size), entry.size)
+	if err != nil {
+		return err
+	}
+	moved[entry] = logEntry{segment: seg.id, offset: offset, size: entry.size}
+	return nil
+}
+
+// Close waits for a running compaction and closes the segments of the log.
+func (l *LogStorage) Close() error {
+	l.compactLock.Lock()
+	defer l.compactLock.Unlock()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var err error
+	for _, seg := range l.segments {
+		if cerr := seg.f.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
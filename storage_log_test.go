@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLogStorageReopen(t *testing.T) {
+	root := t.TempDir()
+	l, err := OpenLogStorage(LogStorageOpts{Root: root})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l.Write("a", bytes.NewReader([]byte("old")))
+	l.Write("a", bytes.NewReader([]byte("new")))
+	l.Write("b", bytes.NewReader([]byte("gone")))
+	l.Delete("b")
+	l.Write("c", bytes.NewReader([]byte("moved")))
+	l.Rename("c", "d")
+	l.Close()
+
+	l, err = OpenLogStorage(LogStorageOpts{Root: root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	names, _ := l.List("")
+	if want := []string{"a", "d"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("expected reopened log to hold %v, have %v", want, names)
+	}
+	if have := readAll(t, l, "a"); string(have) != "new" {
+		t.Errorf("expected a to hold new, have %s", have)
+	}
+	if have := readAll(t, l, "d"); string(have) != "moved" {
+		t.Errorf("expected d to hold moved, have %s", have)
+	}
+}
+
+func TestLogStorageRecoversTornWrite(t *testing.T) {
+	root := t.TempDir()
+	l, err := OpenLogStorage(LogStorageOpts{Root: root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Write("a", bytes.NewReader([]byte("kept")))
+	l.Write("b", bytes.NewReader([]byte("cut short")))
+	path := l.segmentPath(l.active.id)
+	l.Close()
+
+	// Lose the end of the last record, as a crash in the middle of a write
+	// would.
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, fi.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err = OpenLogStorage(LogStorageOpts{Root: root})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if names, _ := l.List(""); !reflect.DeepEqual(names, []string{"a"}) {
+		t.Fatalf("expected only a to survive, have %v", names)
+	}
+	if have := readAll(t, l, "a"); string(have) != "kept" {
+		t.Errorf("expected a to hold kept, have %s", have)
+	}
+
+	// Writes carry on where the last complete record ended.
+	l.Write("c", bytes.NewReader([]byte("after")))
+	if have := readAll(t, l, "c"); string(have) != "after" {
+		t.Errorf("expected c to hold after, have %s", have)
+	}
+}
+
+func TestLogStorageSkipsCorruptRecords(t *testing.T) {
+	root := t.TempDir()
+	l, err := OpenLogStorage(LogStorageOpts{Root: root, SegmentSize: 64, CompactRatio: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Two records of 28 bytes fit in a segment.
+	for _, name := range []string{"a", "b", "c", "d"} {
+		l.Write(name, bytes.NewReader(bytes.Repeat([]byte(name), 10)))
+	}
+	if len(l.segments) != 2 {
+		t.Fatalf("expected the records to take up 2 segments, have %d", len(l.segments))
+	}
+	paths := []string{l.segmentPath(l.active.id - 1), l.segmentPath(l.active.id)}
+	l.Close()
+
+	// Flip a byte of the first record of the sealed segment and of the
+	// last one.
+	var sizes []int64
+	for _, path := range paths {
+		f, err := os.OpenFile(path, os.O_RDWR, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.WriteAt([]byte("x"), logHeaderSize+1)
+		fi, _ := f.Stat()
+		sizes = append(sizes, fi.Size())
+		f.Close()
+	}
+
+	l, err = OpenLogStorage(LogStorageOpts{Root: root, SegmentSize: 64, CompactRatio: -1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if names, _ := l.List(""); !reflect.DeepEqual(names, []string{"b", "d"}) {
+		t.Fatalf("expected the records after the corrupt ones to survive, have %v", names)
+	}
+	if have := readAll(t, l, "d"); !bytes.Equal(have, bytes.Repeat([]byte("d"), 10)) {
+		t.Errorf("expected d to be intact, have %s", have)
+	}
+	for i, path := range paths {
+		if fi, _ := os.Stat(path); fi.Size() != sizes[i] {
+			t.Errorf("expected segment %s not to be truncated, have %d bytes of %d", path, fi.Size(), sizes[i])
+		}
+	}
+	if quarantined, _ := filepath.Glob(filepath.Join(root, "corrupt-*")); len(quarantined) != 2 {
+		t.Errorf("expected both corrupt records to be set aside, have %v", quarantined)
+	}
+}
+
+func TestLogStorageCompact(t *testing.T) {
+	root := t.TempDir()
+	opts := LogStorageOpts{Root: root, SegmentSize: 1024, CompactRatio: -1}
+	l, err := OpenLogStorage(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for round := 0; round < 10; round++ {
+		for i := 0; i < 20; i++ {
+			data := fmt.Sprintf("value %d of key %d", round, i)
+			if _, err := l.Write(fmt.Sprintf("key_%d", i), bytes.NewReader([]byte(data))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i := 10; i < 20; i++ {
+		l.Delete(fmt.Sprintf("key_%d", i))
+	}
+	l.Rename("key_0", "renamed")
+
+	if len(l.segments) < 2 {
+		t.Fatalf("expected writes to span several segments, have %d", len(l.segments))
+	}
+	garbage, total := l.Garbage()
+	if err := l.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if _, after := l.Garbage(); after > total-garbage+int64(len(l.index))*(logHeaderSize+16) {
+		t.Errorf("expected compaction to reclaim %d of %d bytes, log is still %d bytes", garbage, total, after)
+	}
+
+	check := func(l *LogStorage) {
+		t.Helper()
+		names, _ := l.List("")
+		if len(names) != 10 {
+			t.Fatalf("expected 10 blobs, have %v", names)
+		}
+		if have := readAll(t, l, "renamed"); string(have) != "value 9 of key 0" {
+			t.Errorf("expected renamed to hold the last value of key 0, have %s", have)
+		}
+		if have := readAll(t, l, "key_9"); string(have) != "value 9 of key 9" {
+			t.Errorf("expected key_9 to hold its last value, have %s", have)
+		}
+	}
+	check(l)
+	l.Close()
+
+	l, err = OpenLogStorage(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	check(l)
+}
+
+func TestLogStorageCompactWhileWriting(t *testing.T) {
+	opts := LogStorageOpts{Root: t.TempDir(), SegmentSize: 4096, CompactRatio: 0.3}
+	l, err := OpenLogStorage(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			if err := l.Compact(); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("key_%d", i%50)
+		if _, err := l.Write(key, bytes.NewReader([]byte(fmt.Sprintf("value %d", i)))); err != nil {
+			t.Fatal(err)
+		}
+		if i%7 == 0 {
+			l.Rename(key, key+"_moved")
+		}
+	}
+	<-done
+
+	for i := 1950; i < 2000; i++ {
+		key := fmt.Sprintf("key_%d", i%50)
+		if i%7 == 0 {
+			key += "_moved"
+		}
+		if have := readAll(t, l, key); string(have) != fmt.Sprintf("value %d", i) {
+			t.Errorf("expected %s to hold value %d, have %s", key, i, have)
+		}
+	}
+}
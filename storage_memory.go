@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// MemoryStorage keeps blobs in memory. It is mostly useful in tests.
+type MemoryStorage struct {
+	mu    sync.RWMutex
+	blobs map[string][]byte
+}
+
+// NewMemoryStorage creates an empty MemoryStorage.
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{
+		blobs: make(map[string][]byte),
+	}
+}
+
+// Write implements Storage.
+func (m *MemoryStorage) Write(name string, r io.Reader) (int64, error) {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return int64(len(b)), err
+	}
+
+	m.mu.Lock()
+	m.blobs[name] = b
+	m.mu.Unlock()
+
+	return int64(len(b)), nil
+}
+
+// memoryBlob is a blob held in memory opened for reading.
+type memoryBlob struct {
+	*bytes.Reader
+}
+
+// Close implements Blob.
+func (memoryBlob) Close() error {
+	return nil
+}
+
+// Read implements Storage. Blobs are never modified in place, so the reader
+// keeps seeing the blob as it was when it was opened.
+func (m *MemoryStorage) Read(name string) (Blob, error) {
+	m.mu.RLock()
+	b, ok := m.blobs[name]
+	m.mu.RUnlock()
+	if !ok {
+		return nil, notExist("read", name)
+	}
+
+	return memoryBlob{bytes.NewReader(b)}, nil
+}
+
+// Has implements Storage.
+func (m *MemoryStorage) Has(name string) bool {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	_, ok := m.blobs[name]
+	return ok
+}
+
+// Delete implements Storage.
+func (m *MemoryStorage) Delete(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.blobs, name)
+	return nil
+}
+
+// Stat implements Storage.
+func (m *MemoryStorage) Stat(name string) (int64, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	b, ok := m.blobs[name]
+	if !ok {
+		return 0, notExist("stat", name)
+	}
+	return int64(len(b)), nil
+}
+
+// List implements Storage.
+func (m *MemoryStorage) List(prefix string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return sortedNames(m.blobs, prefix), nil
+}
+
+// Rename implements Storage.
+func (m *MemoryStorage) Rename(from string, to string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	b, ok := m.blobs[from]
+	if !ok {
+		return notExist("rename", from)
+	}
+	delete(m.blobs, from)
+	m.blobs[to] = b
+
+	return nil
+}
+
+// Clear implements Storage.
+func (m *MemoryStorage) Clear() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.blobs = make(map[string][]byte)
+	return nil
+}
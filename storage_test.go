@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// storageBackends opens every built-in Storage in a fresh directory.
+func storageBackends(t *testing.T) map[string]Storage {
+	log, err := OpenLogStorage(LogStorageOpts{Root: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { log.Close() })
+
+	return map[string]Storage{
+		"disk":   NewDiskStorage(t.TempDir()),
+		"memory": NewMemoryStorage(),
+		"log":    log,
+	}
+}
+
+func readAll(t *testing.T, storage Storage, name string) []byte {
+	t.Helper()
+
+	blob, err := storage.Read(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+
+	b, err := io.ReadAll(blob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestStorage(t *testing.T) {
+	for backend, storage := range storageBackends(t) {
+		t.Run(backend, func(t *testing.T) {
+			blobs := map[string]string{
+				"a/b":      "first",
+				"a/b.meta": "meta",
+				"a/c/d":    "second",
+				"ab":       "third",
+			}
+			for name, data := range blobs {
+				if n, err := storage.Write(name, bytes.NewReader([]byte(data))); err != nil || n != int64(len(data)) {
+					t.Fatalf("writing %s: wrote %d bytes, err %v", name, n, err)
+				}
+			}
+
+			if have := readAll(t, storage, "a/c/d"); string(have) != "second" {
+				t.Errorf("expected a/c/d to hold second, have %s", have)
+			}
+			if size, err := storage.Stat("a/b"); err != nil || size != 5 {
+				t.Errorf("expected a/b to be 5 bytes, have %d, %v", size, err)
+			}
+			if !storage.Has("ab") || storage.Has("a") {
+				t.Errorf("expected to have ab and not a")
+			}
+
+			names, err := storage.List("a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []string{"a/b", "a/b.meta", "a/c/d"}; !reflect.DeepEqual(names, want) {
+				t.Errorf("expected list of a to be %v, have %v", want, names)
+			}
+
+			// A failed write leaves the old blob alone.
+			broken := io.MultiReader(bytes.NewReader([]byte("partial")), &failingReader{err: io.ErrUnexpectedEOF})
+			if _, err := storage.Write("a/b", broken); err == nil {
+				t.Errorf("expected write from failing reader to fail")
+			}
+			if have := readAll(t, storage, "a/b"); string(have) != "first" {
+				t.Errorf("expected failed write to keep a/b, have %s", have)
+			}
+
+			if err := storage.Rename("a/b", "x/y"); err != nil {
+				t.Fatal(err)
+			}
+			if storage.Has("a/b") || string(readAll(t, storage, "x/y")) != "first" {
+				t.Errorf("expected a/b to be renamed to x/y")
+			}
+
+			if err := storage.Delete("a/c/d"); err != nil {
+				t.Fatal(err)
+			}
+			if err := storage.Delete("a/c/d"); err != nil {
+				t.Errorf("expected deleting a missing blob to succeed, have %v", err)
+			}
+			if _, err := storage.Read("a/c/d"); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("expected reading deleted blob to fail with ErrNotExist, have %v", err)
+			}
+			if _, err := storage.Stat("a/c/d"); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("expected stat of deleted blob to fail with ErrNotExist, have %v", err)
+			}
+
+			names, err = storage.List("")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := []string{"a/b.meta", "ab", "x/y"}; !reflect.DeepEqual(names, want) {
+				t.Errorf("expected all blobs to be %v, have %v", want, names)
+			}
+
+			if err := storage.Clear(); err != nil {
+				t.Fatal(err)
+			}
+			if names, _ := storage.List(""); len(names) != 0 {
+				t.Errorf("expected no blobs after clear, have %v", names)
+			}
+		})
+	}
+}
+
+func TestStoreOnStorageBackends(t *testing.T) {
+	for backend, storage := range storageBackends(t) {
+		t.Run(backend, func(t *testing.T) {
+			s := NewStore(StoreOpts{
+				PathTransformFunc: CASPathTransformFunc,
+				Storage:           storage,
+			})
+			id := generateID()
+			defer teardown(t, s)
+
+			for _, data := range []string{"v1", "v2"} {
+				if _, err := s.writeStream(id, "key", bytes.NewReader([]byte(data))); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			_, r, err := s.Read(id, "key")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b, _ := io.ReadAll(r); string(b) != "v2" {
+				t.Errorf("expected v2, have %s", b)
+			}
+
+			versions, err := s.ListVersions(id, "key")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(versions) != 2 {
+				t.Fatalf("expected 2 versions, have %d", len(versions))
+			}
+			_, r, err = s.ReadVersion(id, "key", versions[1].Version)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b, _ := io.ReadAll(r); string(b) != "v1" {
+				t.Errorf("expected old version v1, have %s", b)
+			}
+
+			if ids, _ := s.Namespaces(); !reflect.DeepEqual(ids, []string{id}) {
+				t.Errorf("expected namespaces [%s], have %v", id, ids)
+			}
+
+			if err := s.Delete(id, "key"); err != nil {
+				t.Fatal(err)
+			}
+			if s.Has(id, "key") {
+				t.Errorf("expected key to be deleted")
+			}
+		})
+	}
+}
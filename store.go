@@ -2,13 +2,17 @@ package main
 
 import (
 	"crypto/sha1"
+	"crypto/sha256"
 	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
 	"log"
 	"os"
+	"slices"
 	"strings"
+	"sync"
+	"time"
 )
 
 const defaultRootFolderName = "ggnetwork"
@@ -57,10 +61,24 @@ func (p PathKey) FullPath() string {
 	return fmt.Sprintf("%s/%s", p.PathName, p.Filename)
 }
 
+// defaultMaxVersions is the number of old versions kept per key by default.
+const defaultMaxVersions = 5
+
 // StoreOpts holds the configuration options for the Store.
 type StoreOpts struct {
 	Root              string
 	PathTransformFunc PathTransformFunc
+	// MaxVersions is the number of old versions kept per key in addition to
+	// the current one. Negative disables the history.
+	MaxVersions int
+	// Capacity is the number of bytes the store may hold. Zero is unlimited.
+	Capacity int64
+	// Quotas limits the number of bytes stored per namespace ID.
+	// Namespaces without an entry are only limited by Capacity.
+	Quotas map[string]int64
+	// Storage is where the bytes are kept. It defaults to a DiskStorage
+	// under Root. NewStore wraps it to keep count of the bytes stored.
+	Storage Storage
 }
 
 // DefaultPathTransformFunc is the default function for transforming a key into a PathKey.
@@ -74,6 +92,23 @@ var DefaultPathTransformFunc = func(key string) PathKey {
 // Store represents a storage system for files.
 type Store struct {
 	StoreOpts
+
+	treeLock sync.Mutex
+	trees    map[string]*MerkleTree
+
+	busyLock sync.Mutex
+	busy     map[string]int
+	// collecting holds the objects the garbage collector is removing blobs
+	// of, with a channel closed once it is done.
+	collecting map[string]chan struct{}
+
+	// meter counts the bytes in Storage, which it wraps.
+	meter *meteredStorage
+
+	reserveLock sync.Mutex
+	// reserved is the number of bytes held by reservations per namespace
+	// ID, and in total under the empty ID.
+	reserved map[string]int64
 }
 
 // NewStore creates a new Store with the given options.
@@ -84,37 +119,105 @@ func NewStore(opts StoreOpts) *Store {
 	if len(opts.Root) == 0 {
 		opts.Root = defaultRootFolderName
 	}
+	if opts.MaxVersions == 0 {
+		opts.MaxVersions = defaultMaxVersions
+	}
+	if opts.Storage == nil {
+		opts.Storage = NewDiskStorage(opts.Root)
+	}
+	meter := newMeteredStorage(opts.Storage)
+	opts.Storage = meter
 
 	return &Store{
-		StoreOpts: opts,
+		StoreOpts:  opts,
+		trees:      make(map[string]*MerkleTree),
+		busy:       make(map[string]int),
+		collecting: make(map[string]chan struct{}),
+		meter:      meter,
+		reserved:   make(map[string]int64),
 	}
 }
 
-// Has checks if a file with the given key exists in the store.
+// Has checks if a file with the given key exists in the store. Deleted files
+// whose tombstone is still kept do not count.
 func (s *Store) Has(id string, key string) bool {
-	pathKey := s.PathTransformFunc(key)
-	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
+	if !s.exists(id, key) {
+		return false
+	}
 
-	_, err := os.Stat(fullPathWithRoot)
-	return !errors.Is(err, os.ErrNotExist)
+	meta, err := s.Stat(id, key)
+	return err != nil || !meta.Deleted
+}
+
+// exists checks if there is a head for the given key in the store, which may
+// be a tombstone.
+func (s *Store) exists(id string, key string) bool {
+	if s.checkKey(id, key) != nil {
+		return false
+	}
+	return s.Storage.Has(s.objectName(id, key))
+}
+
+// head returns the metadata of the current version of the object with the
+// given key, tombstones included, and whether there is one.
+func (s *Store) head(id string, key string) (ObjectMeta, bool) {
+	meta, err := s.Stat(id, key)
+	return meta, err == nil && s.exists(id, key)
 }
 
 // Clear removes all files and directories in the store.
 func (s *Store) Clear() error {
-	return os.RemoveAll(s.Root)
+	s.treeLock.Lock()
+	s.trees = make(map[string]*MerkleTree)
+	s.treeLock.Unlock()
+
+	return s.Storage.Clear()
 }
 
-// Delete removes a file with the given key from the store.
+// Delete removes the object with the given key from the store: its head,
+// its metadata and its history. Other objects are left alone, even those
+// whose paths share a prefix with it, and only directories left empty are
+// removed.
 func (s *Store) Delete(id string, key string) error {
+	if err := s.checkKey(id, key); err != nil {
+		return err
+	}
+
 	pathKey := s.PathTransformFunc(key)
+	name := s.objectName(id, key)
 
-	defer func() {
-		log.Printf("deleted [%s] from disk", pathKey.Filename)
-	}()
+	defer s.markBusy(name)()
+
+	leaf := pathKey.Filename
+	if meta, err := s.readMetaBlob(name + metaSuffix); err == nil {
+		leaf, _ = treeLeaf(meta)
+	}
+	if err := s.removeObject(name); err != nil {
+		return err
+	}
+	if tree := s.loadedTree(id); tree != nil {
+		tree.Remove(leaf)
+	}
 
-	firstPathNameWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FirstPathName())
+	log.Printf("deleted [%s] from disk", pathKey.Filename)
+
+	return nil
+}
 
-	return os.RemoveAll(firstPathNameWithRoot)
+// removeObject deletes the blobs of the object with the given head name. The
+// head goes first, so the object is gone at once, and whatever a failure
+// leaves of it is collected as garbage later.
+func (s *Store) removeObject(name string) error {
+	history, err := s.Storage.List(name + versionsDirSuffix)
+	if err != nil {
+		return err
+	}
+	for _, blob := range append([]string{name, name + metaSuffix}, history...) {
+		if err := s.Storage.Delete(blob); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Write writes data from the given reader to a file with the given key in the store.
@@ -122,57 +225,452 @@ func (s *Store) Write(id string, key string, r io.Reader) (int64, error) {
 	return s.writeStream(id, key, r)
 }
 
+// WriteWithMeta writes data from the given reader to a file with the given key in the store
+// and records meta alongside it. Size and Checksum are filled in from the written bytes.
+func (s *Store) WriteWithMeta(id string, key string, r io.Reader, meta ObjectMeta) (int64, error) {
+	return s.writeObject(id, key, r, meta)
+}
+
 // WriteDecrypt writes decrypted data from the given reader to a file with the given key in the store.
 func (s *Store) WriteDecrypt(encKey []byte, id string, key string, r io.Reader) (int64, error) {
-	f, err := s.openFileForWriting(id, key)
+	return s.WriteDecryptWithMeta(encKey, id, key, r, ObjectMeta{})
+}
+
+// WriteDecryptWithMeta writes decrypted data from the given reader to a file with the given key
+// in the store and records meta alongside it, like WriteWithMeta.
+func (s *Store) WriteDecryptWithMeta(encKey []byte, id string, key string, r io.Reader, meta ObjectMeta) (int64, error) {
+	return s.commitObject(id, key, meta, func(w io.Writer) (int64, error) {
+		n, err := copyDecrypt(encKey, r, w)
+		return int64(n), err
+	})
+}
+
+// writeStream writes data from the given reader to a file with the given key in the store.
+func (s *Store) writeStream(id string, key string, r io.Reader) (int64, error) {
+	return s.writeObject(id, key, r, ObjectMeta{})
+}
+
+// writeObject writes data from the given reader to a file with the given key in the store
+// and records its metadata.
+func (s *Store) writeObject(id string, key string, r io.Reader, meta ObjectMeta) (int64, error) {
+	return s.commitObject(id, key, meta, func(w io.Writer) (int64, error) {
+		return io.Copy(w, r)
+	})
+}
+
+// commitObject writes the object with the given key using write and records
+// meta alongside it, with Key, Size and Checksum filled in from the written
+// bytes.
+//
+// The newest version of an object is kept as its head; the version it
+// replaces is moved into the object's history, of which at most MaxVersions
+// entries are kept. A write that is older than the current head, such as a
+// replica of a concurrent write arriving late, goes straight into the
+// history, so every node ends up with the same head whatever order writes
+// arrive in.
+//
+// A write that fails, for instance with ErrInsufficientSpace because it does
+// not fit in the capacity of the store or the quota of the namespace, leaves
+// the store as it was.
+func (s *Store) commitObject(id string, key string, meta ObjectMeta, write func(io.Writer) (int64, error)) (int64, error) {
+	if err := s.checkKey(id, key); err != nil {
+		return 0, err
+	}
+	if meta.Version.IsZero() {
+		meta.Version = Version{WallTime: time.Now().UnixNano()}
+	}
+
+	limit, err := s.available(id)
 	if err != nil {
 		return 0, err
 	}
-	n, err := copyDecrypt(encKey, r, f)
-	return int64(n), err
+
+	defer s.markBusy(s.objectName(id, key))()
+
+	var (
+		headName = s.objectName(id, key)
+		name     = headName
+		archived *ObjectMeta
+	)
+	if current, ok := s.head(id, key); ok {
+		switch {
+		case meta.Version.After(current.Version):
+			if err := s.archive(id, key, current); err != nil {
+				return 0, err
+			}
+			archived = &current
+		case meta.Version != current.Version:
+			name = s.versionName(id, key, meta.Version)
+		}
+	}
+
+	// The storage reads the object from a pipe that write fills, so a write
+	// that fails midway never replaces the blob.
+	var (
+		h       = sha256.New()
+		pr, pw  = io.Pipe()
+		limited = &limitedWriter{w: pw, limit: limit}
+		counter = &countingWriter{w: io.MultiWriter(limited, h)}
+		done    = make(chan error, 1)
+		n       int64
+	)
+	go func() {
+		var err error
+		n, err = write(counter)
+		pw.CloseWithError(err)
+		done <- err
+	}()
+	_, storeErr := s.Storage.Write(name, pr)
+	pr.CloseWithError(storeErr)
+	if err := <-done; err != nil || storeErr != nil {
+		if err == nil {
+			err = storeErr
+		}
+		if archived != nil {
+			if err := s.unarchive(id, key, *archived); err != nil {
+				log.Printf("restoring [%s] after failed write: %s", key, err)
+			}
+		}
+		return n, err
+	}
+
+	meta.Key = key
+	meta.Size = counter.n
+	meta.Checksum = hex.EncodeToString(h.Sum(nil))
+	if len(meta.ContentHash) == 0 {
+		meta.ContentHash = meta.Checksum
+	}
+	if err := s.writeMetaBlob(name+metaSuffix, meta); err != nil {
+		return n, err
+	}
+
+	if name == headName {
+		s.updateTree(id, meta)
+	} else {
+		log.Printf("kept older version %s of [%s] in history", meta.Version, key)
+	}
+
+	return n, s.pruneVersions(id, key)
 }
 
-// openFileForWriting opens a file for writing with the given key in the store.
-func (s *Store) openFileForWriting(id string, key string) (*os.File, error) {
-	pathKey := s.PathTransformFunc(key)
-	pathNameWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.PathName)
-	if err := os.MkdirAll(pathNameWithRoot, os.ModePerm); err != nil {
-		return nil, err
+// markBusy marks the object with the given head name as being changed, so
+// the garbage collector leaves its blobs alone until the returned function is
+// called. It waits for the garbage collector to be done with the object
+// first.
+func (s *Store) markBusy(name string) func() {
+	s.busyLock.Lock()
+	for {
+		done, ok := s.collecting[name]
+		if !ok {
+			break
+		}
+		s.busyLock.Unlock()
+		<-done
+		s.busyLock.Lock()
+	}
+	s.busy[name]++
+	s.busyLock.Unlock()
+
+	return func() {
+		s.busyLock.Lock()
+		if s.busy[name]--; s.busy[name] == 0 {
+			delete(s.busy, name)
+		}
+		s.busyLock.Unlock()
 	}
+}
 
-	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
+// isBusy reports whether the object with the given head name is being
+// changed or collected.
+func (s *Store) isBusy(name string) bool {
+	s.busyLock.Lock()
+	defer s.busyLock.Unlock()
 
-	return os.Create(fullPathWithRoot)
+	_, collecting := s.collecting[name]
+	return s.busy[name] > 0 || collecting
 }
 
-// writeStream writes data from the given reader to a file with the given key in the store.
-func (s *Store) writeStream(id string, key string, r io.Reader) (int64, error) {
-	f, err := s.openFileForWriting(id, key)
-	if err != nil {
-		return 0, err
+// markCollecting marks the object with the given head name as being removed
+// by the garbage collector, so changes to it wait until the returned function
+// is called. It reports false, and marks nothing, if the object is busy.
+func (s *Store) markCollecting(name string) (func(), bool) {
+	s.busyLock.Lock()
+	defer s.busyLock.Unlock()
+
+	if _, collecting := s.collecting[name]; collecting || s.busy[name] > 0 {
+		return nil, false
 	}
-	return io.Copy(f, r)
+	done := make(chan struct{})
+	s.collecting[name] = done
+
+	return func() {
+		s.busyLock.Lock()
+		delete(s.collecting, name)
+		s.busyLock.Unlock()
+		close(done)
+	}, true
+}
+
+// countingWriter counts the bytes written through it.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+// Write implements io.Writer.
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// objectName returns the name of the blob holding the head of the object
+// with the given key.
+func (s *Store) objectName(id string, key string) string {
+	pathKey := s.PathTransformFunc(key)
+	return fmt.Sprintf("%s/%s", id, pathKey.FullPath())
 }
 
 // Read reads data from a file with the given key in the store.
+// If a checksum was recorded for the file, reading it to the end verifies it
+// and fails with ErrCorrupt on mismatch.
 func (s *Store) Read(id string, key string) (int64, io.Reader, error) {
-	return s.readStream(id, key)
+	n, r, err := s.readStream(id, key)
+	if err != nil {
+		return n, r, err
+	}
+
+	if meta, err := s.Stat(id, key); err == nil && len(meta.Checksum) > 0 {
+		return n, newVerifyingReader(r, meta.Checksum), nil
+	}
+
+	return n, r, nil
 }
 
 // readStream reads data from a file with the given key in the store.
 func (s *Store) readStream(id string, key string) (int64, io.ReadCloser, error) {
-	pathKey := s.PathTransformFunc(key)
-	fullPathWithRoot := fmt.Sprintf("%s/%s/%s", s.Root, id, pathKey.FullPath())
+	if err := s.checkKey(id, key); err != nil {
+		return 0, nil, err
+	}
+
+	blob, err := s.Storage.Read(s.objectName(id, key))
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return blob.Size(), blob, nil
+}
+
+// List returns the filenames of all objects stored under the given id.
+func (s *Store) List(id string) ([]string, error) {
+	var names []string
+	err := s.walk(id, func(name string, base string) error {
+		names = append(names, base)
+		return nil
+	})
+	return names, err
+}
+
+// Namespaces returns the ids that have objects stored in the store. Hidden
+// prefixes, such as the quarantine, are skipped.
+func (s *Store) Namespaces() ([]string, error) {
+	names, err := s.Storage.List("")
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, name := range names {
+		id, _, ok := strings.Cut(name, "/")
+		if !ok || strings.HasPrefix(id, ".") {
+			continue
+		}
+		if len(ids) == 0 || ids[len(ids)-1] != id {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// walk calls fn with the name and the last element of the name of every
+// object blob stored under the given id, skipping metadata and version
+// history.
+func (s *Store) walk(id string, fn func(name string, base string) error) error {
+	if err := checkNamespace(id); err != nil {
+		return err
+	}
+
+	names, err := s.Storage.List(id)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		parts := strings.Split(name, "/")
+		base := parts[len(parts)-1]
+		if isMetaFile(base) || slices.ContainsFunc(parts[:len(parts)-1], isVersionsDir) {
+			continue
+		}
+		if err := fn(name, base); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Tree returns the Merkle tree of the objects stored under the given id, with
+// a leaf per object as given by treeLeaf. The tree is built from disk the
+// first time it is requested and kept up to date by Write and Delete
+// afterwards.
+func (s *Store) Tree(id string) (*MerkleTree, error) {
+	if err := checkNamespace(id); err != nil {
+		return nil, err
+	}
+
+	s.treeLock.Lock()
+	defer s.treeLock.Unlock()
+
+	if tree, ok := s.trees[id]; ok {
+		return tree, nil
+	}
+
+	tree := NewMerkleTree()
+	err := s.walk(id, func(name string, base string) error {
+		if meta, err := s.readMetaBlob(name + metaSuffix); err == nil {
+			tree.Insert(treeLeaf(meta))
+			return nil
+		}
+
+		// Objects written without metadata are hashed as they are.
+		hash, err := s.hashBlob(name)
+		if errors.Is(err, os.ErrNotExist) {
+			// Deleted since it was listed.
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		tree.Insert(base, hash)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	s.trees[id] = tree
+
+	return tree, nil
+}
+
+// loadedTree returns the Merkle tree for id if it has already been built.
+func (s *Store) loadedTree(id string) *MerkleTree {
+	s.treeLock.Lock()
+	defer s.treeLock.Unlock()
+
+	return s.trees[id]
+}
+
+// updateTree records the leaf of a freshly written object, described by
+// meta, in the tree of its namespace. Trees that have not been built yet
+// will pick it up from disk.
+func (s *Store) updateTree(id string, meta ObjectMeta) {
+	if tree := s.loadedTree(id); tree != nil {
+		tree.Insert(treeLeaf(meta))
+	}
+}
 
-	file, err := os.Open(fullPathWithRoot)
+// treeLeaf returns the name and hash of the leaf of the object described by
+// meta in the Merkle tree of its namespace. The node that wrote a file holds
+// its plaintext under the key while its peers hold encrypted replicas under
+// the hash of the key, each encrypted differently, so leaves are named by the
+// hash of the key and hashed by the content hash of the plaintext: all copies
+// of the same version of a file then have equal leaves. Tombstones hash to a
+// marker of their own rather than to the content of an empty file.
+func treeLeaf(meta ObjectMeta) (string, []byte) {
+	name := meta.Key
+	if !meta.Replica {
+		name = hashKey(meta.Key)
+	}
+	if meta.Deleted {
+		hash := sha256.Sum256([]byte("tombstone"))
+		return name, hash[:]
+	}
+	hash, err := hex.DecodeString(meta.ContentHash)
+	if err != nil {
+		sum := sha256.Sum256([]byte(meta.ContentHash))
+		hash = sum[:]
+	}
+	return name, hash
+}
+
+// hashBlob returns the SHA-256 hash of the contents of the blob name.
+func (s *Store) hashBlob(name string) ([]byte, error) {
+	blob, err := s.Storage.Read(name)
+	if err != nil {
+		return nil, err
+	}
+	defer blob.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, blob); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+// openReaderAt opens a file with the given key in the store for random access.
+func (s *Store) openReaderAt(id string, key string) (int64, Blob, error) {
+	if err := s.checkKey(id, key); err != nil {
+		return 0, nil, err
+	}
+
+	blob, err := s.Storage.Read(s.objectName(id, key))
 	if err != nil {
 		return 0, nil, err
 	}
 
-	fi, err := file.Stat()
+	return blob.Size(), blob, nil
+}
+
+// ErrInvalidRange is returned when a range is read with a negative offset or
+// length.
+var ErrInvalidRange = errors.New("invalid range")
+
+// checkRange fails with ErrInvalidRange unless offset and length are both
+// zero or more.
+func checkRange(offset int64, length int64) error {
+	if offset < 0 || length < 0 {
+		return fmt.Errorf("%w: offset %d, length %d", ErrInvalidRange, offset, length)
+	}
+	return nil
+}
+
+// ReadRange reads length bytes starting at offset from a file with the given key
+// in the store. A length of zero reads to the end of the file, and a negative
+// offset or length fails with ErrInvalidRange. The range is clamped to the
+// size of the file and the returned size is that of the range. Unlike Read,
+// the data is not verified against the recorded checksum since only part of
+// the file is read.
+func (s *Store) ReadRange(id string, key string, offset int64, length int64) (int64, io.ReadCloser, error) {
+	if err := checkRange(offset, length); err != nil {
+		return 0, nil, err
+	}
+	size, file, err := s.openReaderAt(id, key)
 	if err != nil {
 		return 0, nil, err
 	}
 
-	return fi.Size(), file, nil
+	if offset > size {
+		offset = size
+	}
+	if length == 0 || length > size-offset {
+		length = size - offset
+	}
+
+	return length, readCloser{io.NewSectionReader(file, offset, length), file}, nil
+}
+
+// readCloser combines a reader with the closer of the resource it reads from.
+type readCloser struct {
+	io.Reader
+	io.Closer
 }
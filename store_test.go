@@ -2,8 +2,12 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
+	"math"
+	"os"
+	"path/filepath"
 	"testing"
 )
 
@@ -70,3 +74,193 @@ func teardown(t *testing.T, s *Store) {
 		t.Error(err)
 	}
 }
+
+func TestStoreDetectsCorruption(t *testing.T) {
+	s := newStore()
+	id := generateID()
+	defer teardown(t, s)
+
+	key := "corruptme"
+	if _, err := s.writeStream(id, key, bytes.NewReader([]byte("some jpg bytes"))); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Verify(id, key); err != nil {
+		t.Errorf("expected fresh object to verify, have %s", err)
+	}
+
+	path := fmt.Sprintf("%s/%s/%s", s.Root, id, s.PathTransformFunc(key).FullPath())
+	if err := os.WriteFile(path, []byte("some png bytes"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Verify(id, key); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected ErrCorrupt from Verify, have %v", err)
+	}
+
+	_, r, err := s.Read(id, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadAll(r); !errors.Is(err, ErrCorrupt) {
+		t.Errorf("expected ErrCorrupt from Read, have %v", err)
+	}
+}
+
+func TestStoreReadRange(t *testing.T) {
+	s := newStore()
+	id := generateID()
+	defer teardown(t, s)
+
+	key := "rangeme"
+	data := []byte("0123456789")
+	if _, err := s.writeStream(id, key, bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		offset, length int64
+		want           string
+	}{
+		{0, 0, "0123456789"},
+		{2, 3, "234"},
+		{7, 0, "789"},
+		{7, 100, "789"},
+		{2, math.MaxInt64, "23456789"},
+		{10, 1, ""},
+		{42, 1, ""},
+	}
+
+	for _, tt := range tests {
+		n, r, err := s.ReadRange(id, key, tt.offset, tt.length)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, _ := io.ReadAll(r)
+		r.Close()
+		if string(b) != tt.want || n != int64(len(tt.want)) {
+			t.Errorf("range (%d, %d): have %q (%d) want %q", tt.offset, tt.length, b, n, tt.want)
+		}
+	}
+
+	for _, tt := range [][2]int64{{-1, 1}, {0, -1}} {
+		if _, _, err := s.ReadRange(id, key, tt[0], tt[1]); !errors.Is(err, ErrInvalidRange) {
+			t.Errorf("range (%d, %d): expected %s, have %v", tt[0], tt[1], ErrInvalidRange, err)
+		}
+	}
+}
+
+// casPrefixCollision returns two keys whose CAS paths share their first
+// directory.
+func casPrefixCollision() (string, string) {
+	seen := make(map[string]string)
+	for i := 0; ; i++ {
+		key := fmt.Sprintf("key_%d", i)
+		first := CASPathTransformFunc(key).FirstPathName()
+		if other, ok := seen[first]; ok {
+			return other, key
+		}
+		seen[first] = key
+	}
+}
+
+func TestStoreDeleteSharedPrefix(t *testing.T) {
+	a, b := casPrefixCollision()
+
+	tests := []struct {
+		name   string
+		opts   StoreOpts
+		target string
+		others []string
+	}{
+		{
+			name:   "cas",
+			opts:   StoreOpts{PathTransformFunc: CASPathTransformFunc},
+			target: a,
+			others: []string{b},
+		},
+		{
+			name:   "default nested",
+			opts:   StoreOpts{},
+			target: "photos",
+			others: []string{"photos/cat", "photos.jpg", "photosynthesis"},
+		},
+		{
+			name:   "default parent",
+			opts:   StoreOpts{},
+			target: "photos/cat",
+			others: []string{"photos", "photos/cat/small"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.opts.Root = t.TempDir()
+			s := NewStore(tt.opts)
+			id := generateID()
+
+			for _, key := range append([]string{tt.target}, tt.others...) {
+				for _, data := range []string{"v1", "v2"} {
+					if _, err := s.writeStream(id, key, bytes.NewReader([]byte(key+data))); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+
+			if err := s.Delete(id, tt.target); err != nil {
+				t.Fatal(err)
+			}
+			if s.Has(id, tt.target) {
+				t.Errorf("expected %s to be deleted", tt.target)
+			}
+			if versions, _ := s.ListVersions(id, tt.target); len(versions) != 0 {
+				t.Errorf("expected history of %s to be deleted, have %d versions", tt.target, len(versions))
+			}
+
+			for _, key := range tt.others {
+				_, r, err := s.Read(id, key)
+				if err != nil {
+					t.Fatalf("expected %s to survive deleting %s: %s", key, tt.target, err)
+				}
+				if b, _ := io.ReadAll(r); string(b) != key+"v2" {
+					t.Errorf("expected %s to hold %sv2, have %s", key, key, b)
+				}
+				if versions, _ := s.ListVersions(id, key); len(versions) != 2 {
+					t.Errorf("expected %s to keep 2 versions, have %d", key, len(versions))
+				}
+			}
+		})
+	}
+}
+
+func TestStoreDeletePrunesEmptyDirs(t *testing.T) {
+	a, b := casPrefixCollision()
+	s := NewStore(StoreOpts{Root: t.TempDir(), PathTransformFunc: CASPathTransformFunc})
+	id := generateID()
+
+	for _, key := range []string{a, b} {
+		if _, err := s.writeStream(id, key, bytes.NewReader([]byte(key))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first := filepath.Join(s.Root, id, CASPathTransformFunc(a).FirstPathName())
+
+	if err := s.Delete(id, a); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(s.Root, id, filepath.FromSlash(CASPathTransformFunc(a).PathName))); !os.IsNotExist(err) {
+		t.Errorf("expected the directory of %s to be removed, have %v", a, err)
+	}
+	if _, err := os.Stat(first); err != nil {
+		t.Errorf("expected the shared directory to be kept, have %v", err)
+	}
+
+	if err := s.Delete(id, b); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(s.Root, id)); !os.IsNotExist(err) {
+		t.Errorf("expected the emptied namespace directory to be removed, have %v", err)
+	}
+	if _, err := os.Stat(s.Root); err != nil {
+		t.Errorf("expected the root to be kept, have %v", err)
+	}
+}
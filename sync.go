@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sort"
+)
+
+// MessageMerkleNodes asks a peer for the hashes of the given Merkle tree nodes
+// of a namespace.
+type MessageMerkleNodes struct {
+	Namespace string
+	Prefixes  []string
+}
+
+// MessageMerkleNodesResponse carries the hashes requested by
+// MessageMerkleNodes, keyed by prefix. Empty subtrees are omitted. A peer that
+// cannot answer says why in Err.
+type MessageMerkleNodesResponse struct {
+	Hashes map[string][]byte
+	Err    string
+}
+
+// MessageMerkleLeaves asks a peer for the leaves of the given bottom level
+// buckets of a namespace.
+type MessageMerkleLeaves struct {
+	Namespace string
+	Prefixes  []string
+}
+
+// MessageMerkleLeavesResponse carries the leaves requested by
+// MessageMerkleLeaves, keyed by bucket prefix and then by object name. A peer
+// that cannot answer says why in Err.
+type MessageMerkleLeavesResponse struct {
+	Leaves map[string]map[string][]byte
+	Err    string
+}
+
+// SyncNamespace compares the objects stored under the namespace id with the
+// ones held by the peer at addr and returns the hashed keys of the objects
+// that differ, including objects that only one of the two nodes has. A local
+// copy and a replica of the same version of a file do not differ. Only subtrees
+// whose hashes differ are descended into, so finding a handful of differences
+// takes merkleDepth+1 round trips no matter how many objects there are.
+func (s *FileServer) SyncNamespace(addr string, id string) ([]string, error) {
+	s.peerLock.Lock()
+	peer, ok := s.peers[addr]
+	s.peerLock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("peer %s not in map", addr)
+	}
+
+	tree, err := s.store.Tree(id)
+	if err != nil {
+		return nil, err
+	}
+
+	prefixes := []string{""}
+	for depth := 0; depth <= merkleDepth && len(prefixes) > 0; depth++ {
+		resp, err := s.request(peer, MessageMerkleNodes{Namespace: id, Prefixes: prefixes})
+		if err != nil {
+			return nil, err
+		}
+		nodes, ok := resp.(MessageMerkleNodesResponse)
+		if !ok {
+			return nil, fmt.Errorf("unexpected response %T to merkle nodes request", resp)
+		}
+		if len(nodes.Err) > 0 {
+			return nil, fmt.Errorf("peer %s failed to hash namespace (%s): %s", addr, id, nodes.Err)
+		}
+
+		var differing []string
+		for _, prefix := range prefixes {
+			if !bytes.Equal(tree.Hash(prefix), nodes.Hashes[prefix]) {
+				differing = append(differing, prefix)
+			}
+		}
+		if depth == merkleDepth {
+			prefixes = differing
+			break
+		}
+		prefixes = merkleChildren(differing)
+	}
+
+	if len(prefixes) == 0 {
+		return nil, nil
+	}
+
+	resp, err := s.request(peer, MessageMerkleLeaves{Namespace: id, Prefixes: prefixes})
+	if err != nil {
+		return nil, err
+	}
+	leaves, ok := resp.(MessageMerkleLeavesResponse)
+	if !ok {
+		return nil, fmt.Errorf("unexpected response %T to merkle leaves request", resp)
+	}
+	if len(leaves.Err) > 0 {
+		return nil, fmt.Errorf("peer %s failed to list namespace (%s): %s", addr, id, leaves.Err)
+	}
+
+	var names []string
+	for _, prefix := range prefixes {
+		names = append(names, diffLeaves(tree.Leaves(prefix), leaves.Leaves[prefix])...)
+	}
+	sort.Strings(names)
+
+	fmt.Printf("[%s] namespace (%s) differs from %s in %d objects\n", s.Transport.Addr(), id, addr, len(names))
+
+	return names, nil
+}
+
+// handleMessageMerkleNodes answers a request for Merkle tree node hashes.
+func (s *FileServer) handleMessageMerkleNodes(from string, requestID string, msg MessageMerkleNodes) error {
+	tree, err := s.store.Tree(msg.Namespace)
+	if err != nil {
+		if replyErr := s.reply(from, requestID, MessageMerkleNodesResponse{Err: err.Error()}); replyErr != nil {
+			log.Println("merkle nodes reply error: ", replyErr)
+		}
+		return err
+	}
+
+	hashes := make(map[string][]byte, len(msg.Prefixes))
+	for _, prefix := range msg.Prefixes {
+		if hash := tree.Hash(prefix); hash != nil {
+			hashes[prefix] = hash
+		}
+	}
+
+	return s.reply(from, requestID, MessageMerkleNodesResponse{Hashes: hashes})
+}
+
+// handleMessageMerkleLeaves answers a request for the leaves of Merkle tree buckets.
+func (s *FileServer) handleMessageMerkleLeaves(from string, requestID string, msg MessageMerkleLeaves) error {
+	tree, err := s.store.Tree(msg.Namespace)
+	if err != nil {
+		if replyErr := s.reply(from, requestID, MessageMerkleLeavesResponse{Err: err.Error()}); replyErr != nil {
+			log.Println("merkle leaves reply error: ", replyErr)
+		}
+		return err
+	}
+
+	leaves := make(map[string]map[string][]byte, len(msg.Prefixes))
+	for _, prefix := range msg.Prefixes {
+		leaves[prefix] = tree.Leaves(prefix)
+	}
+
+	return s.reply(from, requestID, MessageMerkleLeavesResponse{Leaves: leaves})
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/Dhruv-mak/godiststore/p2p"
+)
+
+// ErrDeleted is returned when reading a file whose newest version is a
+// tombstone or has expired.
+var ErrDeleted = errors.New("file deleted")
+
+// defaultTombstoneGracePeriod is how long tombstones are kept by default.
+const defaultTombstoneGracePeriod = 7 * 24 * time.Hour
+
+// Tombstone records the deletion of the object with the given key by the
+// write with the given version. The tombstone takes the place of the object
+// like any newer version would, so the object is kept in the history and
+// copies older than the deletion that arrive afterwards go straight into the
+// history as well. A tombstone of a replica is marked as one too.
+//
+// The data of the object stays on disk until PurgeTombstones removes the
+// tombstone after the grace period, so a deletion can be recovered from by
+// an operator until then. FileServer.GetVersion refuses to serve it.
+func (s *Store) Tombstone(id string, key string, version Version) error {
+	current, _ := s.head(id, key)
+	return s.tombstone(id, key, ObjectMeta{Version: version, Deleted: true, Replica: current.Replica})
+}
+
+// tombstone commits the tombstone described by meta.
+func (s *Store) tombstone(id string, key string, meta ObjectMeta) error {
+	_, err := s.commitObject(id, key, meta, func(io.Writer) (int64, error) {
+		return 0, nil
+	})
+	return err
+}
+
+// PurgeTombstones removes every tombstone written before the given time,
+// together with the history of the object it belongs to, and returns the keys
+// that were removed.
+func (s *Store) PurgeTombstones(before time.Time) ([]string, error) {
+	ids, err := s.Namespaces()
+	if err != nil {
+		return nil, err
+	}
+
+	var purged []string
+	for _, id := range ids {
+		err := s.walk(id, func(name string, base string) error {
+			meta, err := s.readMetaBlob(name + metaSuffix)
+			if err != nil || !meta.Deleted || meta.Version.WallTime >= before.UnixNano() {
+				return nil
+			}
+
+			defer s.markBusy(name)()
+
+			if err := s.removeObject(name); err != nil {
+				return err
+			}
+			if tree := s.loadedTree(id); tree != nil {
+				leaf, _ := treeLeaf(meta)
+				tree.Remove(leaf)
+			}
+
+			purged = append(purged, meta.Key)
+			return nil
+		})
+		if err != nil {
+			return purged, err
+		}
+	}
+
+	return purged, nil
+}
+
+// MessageDeleteFile asks a peer to replace its replica of a file with a
+// tombstone at the given version. It is answered with a MessageStoreAck.
+type MessageDeleteFile struct {
+	Namespace string
+	Key       string
+	Version   Version
+}
+
+// Delete deletes a file in namespace ns from the local store and the network,
+// using the write consistency level of the namespace.
+func (s *FileServer) Delete(ns string, key string) error {
+	namespace, err := s.namespace(ns)
+	if err != nil {
+		return err
+	}
+	_, err = s.DeleteWithOptions(ns, key, WriteOptions{Consistency: namespace.WriteConsistency})
+	return err
+}
+
+// DeleteWithOptions deletes a file by writing a tombstone for it, locally and
+// on every peer. Like a write, it returns once enough replicas to satisfy
+// opts.Consistency have acknowledged the tombstone, and peers that miss it
+// get it when they reconnect or when a read finds their copy to be stale.
+// Preconditions and the namespace are checked as for StoreWithOptions.
+func (s *FileServer) DeleteWithOptions(ns string, key string, opts WriteOptions) (StoreResult, error) {
+	result := StoreResult{
+		Replicas: []ReplicaResult{{Addr: s.Transport.Addr()}},
+	}
+
+	if err := s.authorize(opts.Token, ns, PermDelete); err != nil {
+		return result, err
+	}
+	namespace, err := s.writable(ns)
+	if err != nil {
+		return result, err
+	}
+
+	unlock := s.keyLocks.lock(ns + "/" + key)
+	if err := s.checkPreconditions(namespace, key, opts); err != nil {
+		unlock()
+		return result, err
+	}
+
+	version := s.clock.Now()
+	err = s.store.Tombstone(ns, key, version)
+	unlock()
+	if err != nil {
+		result.Replicas[0].Err = err
+		return result, err
+	}
+	result.Version = version
+	result.Replicas[0].Acked = true
+
+	fmt.Printf("[%s] deleted file (%s) at version %s\n", s.Transport.Addr(), key, version)
+
+	return s.replicate(result, key, opts.Consistency, s.peerList(), func(peer p2p.Peer) error {
+		err := s.sendTombstone(peer, ns, key, version)
+		if err != nil {
+			log.Printf("[%s] deleting (%s) on %s failed, will retry on reconnect: %s", s.Transport.Addr(), key, peer.RemoteAddr(), err)
+			s.deferDelete(peer.RemoteAddr().String(), MessageDeleteFile{Namespace: ns, Key: hashKey(key), Version: version})
+		}
+		return err
+	})
+}
+
+// sendTombstone sends the tombstone of a file in namespace ns to a single peer
+// and waits for it to be acknowledged.
+func (s *FileServer) sendTombstone(peer p2p.Peer, ns string, key string, version Version) error {
+	return s.sendDelete(peer, MessageDeleteFile{Namespace: ns, Key: hashKey(key), Version: version})
+}
+
+// sendDelete sends a MessageDeleteFile to a single peer and waits for it to
+// be acknowledged.
+func (s *FileServer) sendDelete(peer p2p.Peer, msg MessageDeleteFile) error {
+	resp, err := s.request(peer, msg)
+	if err != nil {
+		return err
+	}
+	ack, ok := resp.(MessageStoreAck)
+	if !ok {
+		return fmt.Errorf("unexpected response %T to delete request", resp)
+	}
+	if len(ack.Err) > 0 {
+		return fmt.Errorf("peer %s failed to delete (%s): %s", peer.RemoteAddr(), msg.Key, ack.Err)
+	}
+
+	return nil
+}
+
+// deferDelete remembers a tombstone that could not be delivered so it can be
+// sent again when the peer at addr connects again.
+func (s *FileServer) deferDelete(addr string, msg MessageDeleteFile) {
+	s.deleteLock.Lock()
+	defer s.deleteLock.Unlock()
+
+	s.deletes[addr] = append(s.deletes[addr], msg)
+}
+
+// resumeDeletes sends the tombstones the peer missed while it was away.
+func (s *FileServer) resumeDeletes(peer p2p.Peer) {
+	addr := peer.RemoteAddr().String()
+
+	s.deleteLock.Lock()
+	deletes := s.deletes[addr]
+	delete(s.deletes, addr)
+	s.deleteLock.Unlock()
+
+	for _, msg := range deletes {
+		if err := s.sendDelete(peer, msg); err != nil {
+			log.Printf("[%s] resending tombstone of (%s) to %s failed: %s", s.Transport.Addr(), msg.Key, addr, err)
+			s.deferDelete(addr, msg)
+		}
+	}
+}
+
+// handleMessageDeleteFile handles a request to delete a file.
+func (s *FileServer) handleMessageDeleteFile(from string, requestID string, msg MessageDeleteFile) error {
+	s.clock.Update(msg.Version)
+
+	err := s.store.tombstone(msg.Namespace, msg.Key, ObjectMeta{Version: msg.Version, Deleted: true, Replica: true})
+	// The history of an object that expired goes with it, as when it is
+	// reaped locally, unless a newer write has taken its place.
+	if head, _ := s.store.head(msg.Namespace, msg.Key); err == nil && isExpiryVersion(msg.Version) && head.Version == msg.Version {
+		err = s.store.purgeHistory(msg.Namespace, msg.Key)
+	}
+
+	var ack MessageStoreAck
+	if err != nil {
+		ack.Err = err.Error()
+	}
+	if replyErr := s.reply(from, requestID, ack); replyErr != nil {
+		log.Println("delete ack error: ", replyErr)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("[%s] recorded tombstone of (%s) at version %s\n", s.Transport.Addr(), msg.Key, msg.Version)
+
+	return nil
+}
+
+// checkDeleted fails with ErrDeleted if the local copy of the file with the
+// given key in namespace ns is a tombstone or has expired.
+func (s *FileServer) checkDeleted(ns string, key string) error {
+	meta, ok := s.store.head(ns, key)
+	switch {
+	case !ok:
+		return nil
+	case meta.Deleted:
+		return fmt.Errorf("%w: (%s) at version %s", ErrDeleted, key, meta.Version)
+	case meta.Expired(time.Now()):
+		return fmt.Errorf("%w: (%s) expired at %s", ErrDeleted, key, meta.ExpiresAt)
+	}
+	return nil
+}
+
+// collectTombstones garbage collects tombstones older than the grace period
+// until the server is stopped.
+func (s *FileServer) collectTombstones() {
+	ticker := time.NewTicker(min(s.TombstoneGracePeriod, time.Hour))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			purged, err := s.store.PurgeTombstones(time.Now().Add(-s.TombstoneGracePeriod))
+			if err != nil {
+				log.Println("tombstone gc error: ", err)
+			}
+			if len(purged) > 0 {
+				fmt.Printf("[%s] garbage collected %d tombstones\n", s.Transport.Addr(), len(purged))
+			}
+
+		case <-s.quitch:
+			return
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestStoreTombstone(t *testing.T) {
+	s := newStore()
+	id := generateID()
+	defer teardown(t, s)
+
+	key := "deleted"
+	version := func(wall int64) ObjectMeta {
+		return ObjectMeta{Version: Version{WallTime: wall, NodeID: "a"}}
+	}
+
+	if _, err := s.WriteWithMeta(id, key, bytes.NewReader([]byte("v1")), version(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Tombstone(id, key, version(2).Version); err != nil {
+		t.Fatal(err)
+	}
+	if s.Has(id, key) {
+		t.Errorf("expected deleted key to be gone")
+	}
+
+	// A replica written before the deletion arriving late must not bring it back.
+	if _, err := s.WriteWithMeta(id, key, bytes.NewReader([]byte("v1")), version(1)); err != nil {
+		t.Fatal(err)
+	}
+	if s.Has(id, key) {
+		t.Errorf("expected late older write to leave the key deleted")
+	}
+	head, ok := s.head(id, key)
+	if !ok || !head.Deleted || head.Version != version(2).Version {
+		t.Errorf("expected tombstone at head, have %+v", head)
+	}
+
+	// A purge before the tombstone's time keeps it.
+	if purged, err := s.PurgeTombstones(time.Unix(0, 2)); err != nil || len(purged) != 0 {
+		t.Fatalf("expected nothing purged, have %v %v", purged, err)
+	}
+
+	if _, err := s.WriteWithMeta(id, key, bytes.NewReader([]byte("v3")), version(3)); err != nil {
+		t.Fatal(err)
+	}
+	if !s.Has(id, key) {
+		t.Errorf("expected newer write to bring the key back")
+	}
+
+	if err := s.Tombstone(id, key, version(4).Version); err != nil {
+		t.Fatal(err)
+	}
+	purged, err := s.PurgeTombstones(time.Unix(0, 5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(purged) != 1 || purged[0] != key {
+		t.Errorf("expected (%s) to be purged, have %v", key, purged)
+	}
+	if versions, err := s.ListVersions(id, key); err != nil || len(versions) != 0 {
+		t.Errorf("expected purge to drop the history, have %v %v", versions, err)
+	}
+}
+
+func TestFileServerDelete(t *testing.T) {
+	s := newTestServer(t)
+	key := "temporary"
+
+	if err := s.Store(testNamespace, key, bytes.NewReader([]byte("some bytes"))); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Delete(testNamespace, key); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.Get(testNamespace, key); !errors.Is(err, ErrDeleted) {
+		t.Errorf("expected get of deleted file to fail with %s, have %v", ErrDeleted, err)
+	}
+	if _, err := s.GetRange(testNamespace, key, 0, 4); !errors.Is(err, ErrDeleted) {
+		t.Errorf("expected range get of deleted file to fail with %s, have %v", ErrDeleted, err)
+	}
+
+	// The version kept in the history is not served either.
+	versions, err := s.ListVersions(testNamespace, key)
+	if err != nil || len(versions) != 2 {
+		t.Fatalf("expected the deleted version to be kept in the history, have %v %v", versions, err)
+	}
+	if _, err := s.GetVersion(testNamespace, key, versions[1].Version); !errors.Is(err, ErrDeleted) {
+		t.Errorf("expected get of a version of a deleted file to fail with %s, have %v", ErrDeleted, err)
+	}
+
+	// Deleted files can be created again.
+	if _, err := s.StoreWithOptions(testNamespace, key, bytes.NewReader([]byte("new bytes")), WriteOptions{IfNoneMatch: true}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get(testNamespace, key); err != nil {
+		t.Errorf("expected recreated file to be readable: %s", err)
+	}
+}
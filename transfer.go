@@ -0,0 +1,610 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/Dhruv-mak/godiststore/p2p"
+)
+
+const (
+	// transferSegmentSize is how many bytes are written between two
+	// checkpoints of a transfer, and held in memory while they are.
+	transferSegmentSize = 1 << 20
+	// transfersDirName is the prefix partial transfers are kept under
+	// until they complete.
+	transfersDirName = ".transfers"
+)
+
+// TransferState is the checkpoint of a partially received file.
+type TransferState struct {
+	// ID identifies the transfer across reconnects.
+	ID string
+	// Namespace and Key identify the object being transferred.
+	Namespace string
+	Key       string
+	// Total is the size of the complete file and ContentHash the hash of
+	// its plaintext, as announced by the sender.
+	Total       int64
+	ContentHash string
+	// Version is the version of the object being transferred.
+	Version Version
+	// Offset is the number of bytes durably written so far.
+	Offset int64
+	// UpdatedAt is when the transfer was last checkpointed.
+	UpdatedAt time.Time
+}
+
+// Transfer is a partially received file that is written in checkpointed
+// segments, so it can be resumed from the last checkpoint after the
+// connection it was arriving on is lost. Every segment is kept as a blob of
+// its own until the transfer is committed.
+type Transfer struct {
+	TransferState
+
+	store *Store
+}
+
+// transferName returns the name the checkpoint of a transfer is kept under.
+// Its segments are kept under the same name without the suffix.
+func (s *Store) transferName(transferID string) string {
+	return transfersDirName + "/" + transferID + metaSuffix
+}
+
+// segmentName returns the name of the segment of a transfer starting at
+// offset. Names sort in the order of the segments.
+func (s *Store) segmentName(transferID string, offset int64) string {
+	return fmt.Sprintf("%s/%s/%016x", transfersDirName, transferID, offset)
+}
+
+// segments returns the names of the segments of a transfer, in order.
+func (s *Store) segments(transferID string) ([]string, error) {
+	return s.Storage.List(transfersDirName + "/" + transferID)
+}
+
+// OpenTransfer opens the transfer with the ID of state, creating it if it does
+// not exist yet. An existing transfer for a different file is discarded and
+// started over. Bytes written after the last checkpoint are dropped.
+func (s *Store) OpenTransfer(state TransferState) (*Transfer, error) {
+	if err := checkComponent("transfer", state.ID); err != nil {
+		return nil, err
+	}
+	if err := s.checkKey(state.Namespace, state.Key); err != nil {
+		return nil, err
+	}
+
+	if saved, err := s.TransferStatus(state.ID); err == nil {
+		sameFile := saved.Namespace == state.Namespace &&
+			saved.Key == state.Key &&
+			(state.Total == 0 || saved.Total == state.Total) &&
+			(len(state.ContentHash) == 0 || saved.ContentHash == state.ContentHash) &&
+			(state.Version.IsZero() || saved.Version == state.Version)
+		if sameFile {
+			state = saved
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	// Segments are checkpointed once they are written, so only those
+	// starting at or past the checkpoint can hold unrecorded bytes.
+	segments, err := s.segments(state.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range segments {
+		if name >= s.segmentName(state.ID, state.Offset) {
+			if err := s.Storage.Delete(name); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	t := &Transfer{
+		TransferState: state,
+		store:         s,
+	}
+
+	return t, t.checkpoint()
+}
+
+// TransferStatus returns the last checkpoint of the transfer with the given ID.
+func (s *Store) TransferStatus(transferID string) (TransferState, error) {
+	var state TransferState
+	if err := checkComponent("transfer", transferID); err != nil {
+		return state, err
+	}
+
+	b, err := s.readBlob(s.transferName(transferID))
+	if err != nil {
+		return state, err
+	}
+	err = json.Unmarshal(b, &state)
+
+	return state, err
+}
+
+// checkpoint records the offset up to which bytes have been written.
+func (t *Transfer) checkpoint() error {
+	t.UpdatedAt = time.Now()
+	b, err := json.Marshal(t.TransferState)
+	if err != nil {
+		return err
+	}
+	_, err = t.store.Storage.Write(t.store.transferName(t.ID), bytes.NewReader(b))
+	return err
+}
+
+// Write copies r into the transfer, checkpointing after every segment and
+// after whatever part of a segment was received before an error.
+func (t *Transfer) Write(r io.Reader) (int64, error) {
+	var (
+		written int64
+		segment bytes.Buffer
+	)
+	for {
+		segment.Reset()
+		n, err := io.CopyN(&segment, r, transferSegmentSize)
+		written += n
+		if n > 0 {
+			if _, err := t.store.Storage.Write(t.store.segmentName(t.ID, t.Offset), &segment); err != nil {
+				return written, err
+			}
+			t.Offset += n
+			if err := t.checkpoint(); err != nil {
+				return written, err
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// Complete reports whether all bytes of the file have been received.
+func (t *Transfer) Complete() bool {
+	return t.Total > 0 && t.Offset >= t.Total
+}
+
+// Close releases the transfer, keeping its data for a later resume.
+func (t *Transfer) Close() error {
+	return nil
+}
+
+// Reader opens the received bytes for reading.
+func (t *Transfer) Reader() (io.ReadCloser, error) {
+	segments, err := t.store.segments(t.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &segmentReader{storage: t.store.Storage, segments: segments}, nil
+}
+
+// Remove deletes the partial data and checkpoint of the transfer.
+func (t *Transfer) Remove() error {
+	segments, err := t.store.segments(t.ID)
+	if err != nil {
+		return err
+	}
+	for _, name := range segments {
+		if err := t.store.Storage.Delete(name); err != nil {
+			return err
+		}
+	}
+	return t.store.Storage.Delete(t.store.transferName(t.ID))
+}
+
+// segmentReader reads the segments of a transfer one after the other,
+// opening each only once the previous one has been read.
+type segmentReader struct {
+	storage  Storage
+	segments []string
+	current  Blob
+}
+
+// Read implements io.Reader.
+func (r *segmentReader) Read(b []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.segments) == 0 {
+				return 0, io.EOF
+			}
+			blob, err := r.storage.Read(r.segments[0])
+			if err != nil {
+				return 0, err
+			}
+			r.current, r.segments = blob, r.segments[1:]
+		}
+
+		n, err := r.current.Read(b)
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// Close implements io.Closer.
+func (r *segmentReader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+	err := r.current.Close()
+	r.current = nil
+	return err
+}
+
+// Commit moves a complete transfer into the store under its namespace and key.
+func (t *Transfer) Commit(meta ObjectMeta) (int64, error) {
+	if !t.Complete() {
+		return 0, fmt.Errorf("transfer (%s) is incomplete: %d of %d bytes", t.ID, t.Offset, t.Total)
+	}
+
+	r, err := t.Reader()
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+
+	meta.ContentHash = t.ContentHash
+	meta.Version = t.Version
+	n, err := t.store.WriteWithMeta(t.Namespace, t.Key, r, meta)
+	if err != nil {
+		return n, err
+	}
+
+	return n, t.Remove()
+}
+
+// MessageTransferStatus asks a peer how much of a transfer it has durably
+// written, and whether it has room for the Size bytes of it in Namespace.
+type MessageTransferStatus struct {
+	TransferID string
+	Namespace  string
+	Size       int64
+}
+
+// MessageTransferStatusResponse answers MessageTransferStatus with the offset
+// the sender should resume from. A peer that will not take the transfer says
+// why in Err, and the sender does not stream it.
+type MessageTransferStatusResponse struct {
+	Offset            int64
+	Free              int64
+	InsufficientSpace bool
+	Err               string
+}
+
+// handleMessageTransferStatus answers a request for the checkpoint of a
+// transfer, refusing it up front if this node is draining or cannot fit it.
+func (s *FileServer) handleMessageTransferStatus(from string, requestID string, msg MessageTransferStatus) error {
+	resp := MessageTransferStatusResponse{}
+	if state, err := s.store.TransferStatus(msg.TransferID); err == nil {
+		resp.Offset = state.Offset
+	}
+	if free, err := s.store.free(); err == nil {
+		resp.Free = free
+	}
+
+	if s.draining.Load() {
+		resp.Err = errDraining.Error()
+	} else if release, err := s.store.Reserve(msg.Namespace, msg.Size); err != nil {
+		resp.Err = err.Error()
+		resp.InsufficientSpace = errors.Is(err, ErrInsufficientSpace)
+	} else {
+		// receiveUpload reserves the space again once the stream arrives.
+		release()
+	}
+
+	return s.reply(from, requestID, resp)
+}
+
+// errUploadSuperseded is returned when the local copy an upload reads from
+// has been overwritten since the upload started.
+var errUploadSuperseded = errors.New("upload superseded by a newer write")
+
+// upload is an encrypted replica being sent to peers. The plaintext is read
+// back from the local copy under localKey for every attempt and encrypted
+// with dataKey, so only a small buffer is held in memory however large the
+// file is. A raw upload copies a replica as it is, since it is encrypted
+// already.
+type upload struct {
+	TransferID  string
+	Namespace   string
+	Key         string
+	ContentHash string
+	Version     Version
+	ExpiresAt   time.Time
+	IV          []byte
+	KeyID       string
+	WrappedKey  []byte
+
+	localKey string
+	dataKey  []byte
+	size     int64
+	raw      bool
+	// bytesPerSecond limits how fast the upload is sent, if set.
+	bytesPerSecond int64
+}
+
+// Total returns the size of the encrypted replica, including the IV.
+func (u *upload) Total() int64 {
+	if u.raw {
+		return u.size
+	}
+	return aesBlockSize + u.size
+}
+
+// ackTimeout is how long sendUpload waits for a peer to acknowledge a file
+// once it has been sent, which includes the time it takes to commit it.
+const ackTimeout = time.Minute
+
+// sendUpload streams an upload to a single peer, resuming from whatever the
+// peer has checkpointed of it already, and waits for the peer to acknowledge
+// that the file is durably stored.
+func (s *FileServer) sendUpload(peer p2p.Peer, u *upload) error {
+	resp, err := s.request(peer, MessageTransferStatus{
+		TransferID: u.TransferID,
+		Namespace:  u.Namespace,
+		Size:       u.Total(),
+	})
+	if err != nil {
+		return err
+	}
+	status, ok := resp.(MessageTransferStatusResponse)
+	if !ok {
+		return fmt.Errorf("unexpected response %T to transfer status request", resp)
+	}
+	s.setPeerFree(peer, status.Free)
+	if status.InsufficientSpace {
+		return fmt.Errorf("%w: peer %s refused transfer (%s): %s", ErrInsufficientSpace, peer.RemoteAddr(), u.TransferID, status.Err)
+	}
+	if len(status.Err) > 0 {
+		return fmt.Errorf("peer %s refused transfer (%s): %s", peer.RemoteAddr(), u.TransferID, status.Err)
+	}
+
+	meta, err := s.store.Stat(u.Namespace, u.localKey)
+	if err != nil {
+		return err
+	}
+	if meta.ContentHash != u.ContentHash || meta.Version != u.Version {
+		return errUploadSuperseded
+	}
+
+	_, src, err := s.store.openReaderAt(u.Namespace, u.localKey)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	offset := status.Offset
+	var r io.Reader = io.NewSectionReader(src, offset, u.size-offset)
+	if !u.raw {
+		r, err = newEncryptReaderAt(u.dataKey, u.IV, src, u.size, offset)
+		if err != nil {
+			return err
+		}
+	}
+	r = newThrottledReader(r, u.bytesPerSecond)
+
+	id, ch := s.expect()
+	defer s.forget(id)
+
+	msg := Message{
+		RequestID: id,
+		Payload: MessageStoreFile{
+			TransferID:  u.TransferID,
+			Namespace:   u.Namespace,
+			Key:         u.Key,
+			Size:        u.Total(),
+			Offset:      offset,
+			ContentHash: u.ContentHash,
+			Version:     u.Version,
+			ExpiresAt:   u.ExpiresAt,
+			KeyID:       u.KeyID,
+			WrappedKey:  u.WrappedKey,
+		},
+	}
+	n, err := s.writeStream(peer, &msg, r)
+	if err != nil {
+		return err
+	}
+
+	resp, err = s.await(peer, ch, ackTimeout)
+	if err != nil {
+		return err
+	}
+	ack, ok := resp.(MessageStoreAck)
+	if !ok {
+		return fmt.Errorf("unexpected response %T to store request", resp)
+	}
+	s.setPeerFree(peer, ack.Free)
+	if ack.InsufficientSpace {
+		return fmt.Errorf("%w: peer %s refused transfer (%s): %s", ErrInsufficientSpace, peer.RemoteAddr(), u.TransferID, ack.Err)
+	}
+	if len(ack.Err) > 0 {
+		return fmt.Errorf("peer %s failed to store transfer (%s): %s", peer.RemoteAddr(), u.TransferID, ack.Err)
+	}
+
+	if offset > 0 {
+		fmt.Printf("[%s] resumed transfer (%s) to %s at offset %d\n", s.Transport.Addr(), u.TransferID, peer.RemoteAddr(), offset)
+	}
+	fmt.Printf("[%s] written (%d) bytes over the network to %s\n", s.Transport.Addr(), n, peer.RemoteAddr())
+
+	return nil
+}
+
+// writeStream writes msg to peer followed by a stream of the bytes of r,
+// holding the stream lock of the peer throughout.
+func (s *FileServer) writeStream(peer p2p.Peer, msg *Message, r io.Reader) (int64, error) {
+	defer s.lockStream(peer)()
+
+	if err := s.writeMessage(peer, msg); err != nil {
+		return 0, err
+	}
+	if err := peer.Send([]byte{p2p.IncomingStream}); err != nil {
+		return 0, err
+	}
+	return io.Copy(peer, r)
+}
+
+// deferUpload remembers an upload that failed so it can be resumed when the
+// peer at addr connects again.
+func (s *FileServer) deferUpload(addr string, u *upload) {
+	s.uploadLock.Lock()
+	defer s.uploadLock.Unlock()
+
+	s.uploads[addr] = append(s.uploads[addr], u)
+}
+
+// resumeUploads resumes the uploads to the peer at addr that were interrupted.
+func (s *FileServer) resumeUploads(peer p2p.Peer) {
+	addr := peer.RemoteAddr().String()
+
+	s.uploadLock.Lock()
+	uploads := s.uploads[addr]
+	delete(s.uploads, addr)
+	s.uploadLock.Unlock()
+
+	for _, u := range uploads {
+		err := s.sendUpload(peer, u)
+		if errors.Is(err, errUploadSuperseded) {
+			log.Printf("[%s] dropping transfer (%s) to %s: %s", s.Transport.Addr(), u.TransferID, addr, err)
+			continue
+		}
+		if err != nil {
+			log.Printf("[%s] resuming transfer (%s) to %s failed: %s", s.Transport.Addr(), u.TransferID, addr, err)
+			s.deferUpload(addr, u)
+		}
+	}
+}
+
+// newUpload prepares an encrypted replica of the local copy of the file with
+// the given key in namespace ns, under a new data key wrapped with the master
+// key of the namespace. Namespaces with a Convergent policy derive the data
+// key and IV from the content of the file instead.
+func (s *FileServer) newUpload(ns namespace, key string) (*upload, error) {
+	meta, err := s.store.Stat(ns.name, key)
+	if err != nil {
+		return nil, err
+	}
+
+	var dataKey, iv []byte
+	if ns.Convergent {
+		dataKey, iv, err = convergentKey(s.ConvergenceSecret, ns.name, meta.ContentHash)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		iv = make([]byte, aesBlockSize)
+		if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+			return nil, err
+		}
+		dataKey = newEncryptionKey()
+	}
+	keyID, wrapped, err := ns.wrapKey(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	return &upload{
+		TransferID:  generateID(),
+		Namespace:   ns.name,
+		Key:         hashKey(key),
+		ContentHash: meta.ContentHash,
+		Version:     meta.Version,
+		ExpiresAt:   meta.ExpiresAt,
+		IV:          iv,
+		KeyID:       keyID,
+		WrappedKey:  wrapped,
+		localKey:    key,
+		dataKey:     dataKey,
+		size:        meta.Size,
+	}, nil
+}
+
+// newReplicaUpload prepares a raw copy of the replica described by meta that
+// this node holds in namespace id.
+func (s *FileServer) newReplicaUpload(id string, meta ObjectMeta) *upload {
+	return &upload{
+		TransferID:  generateID(),
+		Namespace:   id,
+		Key:         meta.Key,
+		ContentHash: meta.ContentHash,
+		Version:     meta.Version,
+		ExpiresAt:   meta.ExpiresAt,
+		KeyID:       meta.KeyID,
+		WrappedKey:  meta.WrappedKey,
+		localKey:    meta.Key,
+		size:        meta.Size,
+		raw:         true,
+	}
+}
+
+// receiveUpload writes a stream announced by a MessageStoreFile into its
+// transfer and commits it once it is complete. Senders ask before streaming,
+// but a file that stopped fitting since is still refused with
+// ErrInsufficientSpace before anything is written.
+func (s *FileServer) receiveUpload(r io.Reader, msg MessageStoreFile) (int64, error) {
+	if s.draining.Load() {
+		io.Copy(io.Discard, r)
+		return 0, errDraining
+	}
+	// The whole file is reserved, since bytes staged by an earlier attempt
+	// are only counted once the transfer is committed.
+	release, err := s.store.Reserve(msg.Namespace, msg.Size)
+	if err != nil {
+		io.Copy(io.Discard, r)
+		return 0, err
+	}
+	defer release()
+
+	t, err := s.store.OpenTransfer(TransferState{
+		ID:          msg.TransferID,
+		Namespace:   msg.Namespace,
+		Key:         msg.Key,
+		Total:       msg.Size,
+		ContentHash: msg.ContentHash,
+		Version:     msg.Version,
+	})
+	if err != nil {
+		io.Copy(io.Discard, r)
+		return 0, err
+	}
+	defer t.Close()
+
+	// The sender resumes from the offset it was last told about, which can
+	// be behind what has been checkpointed since. Skip what we already have.
+	if msg.Offset > t.Offset {
+		io.Copy(io.Discard, r)
+		return 0, fmt.Errorf("transfer (%s) resumed at %d but only %d bytes were received", t.ID, msg.Offset, t.Offset)
+	}
+	if _, err := io.CopyN(io.Discard, r, t.Offset-msg.Offset); err != nil {
+		return 0, err
+	}
+
+	n, err := t.Write(r)
+	if err != nil {
+		return n, err
+	}
+	if !t.Complete() {
+		return n, fmt.Errorf("transfer (%s) ended at %d of %d bytes", t.ID, t.Offset, t.Total)
+	}
+
+	release()
+	return t.Commit(ObjectMeta{ExpiresAt: msg.ExpiresAt, Replica: true, KeyID: msg.KeyID, WrappedKey: msg.WrappedKey})
+}
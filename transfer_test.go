@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// failingReader returns err once n bytes have been read from r.
+type failingReader struct {
+	r   io.Reader
+	n   int
+	err error
+}
+
+func (f *failingReader) Read(b []byte) (int, error) {
+	if f.n <= 0 {
+		return 0, f.err
+	}
+	if len(b) > f.n {
+		b = b[:f.n]
+	}
+	n, err := f.r.Read(b)
+	f.n -= n
+	return n, err
+}
+
+func TestTransferResume(t *testing.T) {
+	s := newStore()
+	id := generateID()
+	defer teardown(t, s)
+
+	data := bytes.Repeat([]byte("x"), 3*transferSegmentSize+42)
+	state := TransferState{
+		ID:          generateID(),
+		Namespace:   id,
+		Key:         "bigfile",
+		Total:       int64(len(data)),
+		ContentHash: "somehash",
+	}
+
+	tr, err := s.OpenTransfer(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Drop the connection halfway through the second segment.
+	lost := errors.New("connection lost")
+	cut := transferSegmentSize + transferSegmentSize/2
+	if _, err := tr.Write(&failingReader{r: bytes.NewReader(data), n: cut, err: lost}); !errors.Is(err, lost) {
+		t.Fatalf("expected write to fail with %s, have %v", lost, err)
+	}
+	tr.Close()
+
+	status, err := s.TransferStatus(state.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.Offset != int64(cut) {
+		t.Errorf("expected checkpoint at %d, have %d", cut, status.Offset)
+	}
+
+	tr, err = s.OpenTransfer(state)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tr.Offset != int64(cut) {
+		t.Fatalf("expected transfer to resume at %d, have %d", cut, tr.Offset)
+	}
+	if _, err := tr.Write(bytes.NewReader(data[tr.Offset:])); err != nil {
+		t.Fatal(err)
+	}
+	if !tr.Complete() {
+		t.Fatalf("expected transfer to be complete at %d of %d", tr.Offset, tr.Total)
+	}
+	if _, err := tr.Commit(ObjectMeta{}); err != nil {
+		t.Fatal(err)
+	}
+
+	_, r, err := s.Read(id, "bigfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, data) {
+		t.Errorf("resumed transfer does not match the original data")
+	}
+
+	if _, err := s.TransferStatus(state.ID); err == nil {
+		t.Errorf("expected committed transfer to be removed")
+	}
+}
+
+func TestSendUploadRefusedBeforeStreaming(t *testing.T) {
+	servers := newTestCluster(t, 2)
+	a, b := servers[0], servers[1]
+
+	if _, err := a.store.Write(testNamespace, "key", bytes.NewReader(make([]byte, 1000))); err != nil {
+		t.Fatal(err)
+	}
+	ns, _ := a.namespace(testNamespace)
+	u, err := a.newUpload(ns, "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b.store.reserveLock.Lock()
+	b.store.StoreOpts.Capacity = 100
+	b.store.reserveLock.Unlock()
+
+	// The local copy is only read once the peer has agreed to take the
+	// upload, so a refusal that came after streaming would not be reported
+	// as one.
+	if err := a.store.Delete(testNamespace, "key"); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.sendUpload(a.peerList()[0], u); !errors.Is(err, ErrInsufficientSpace) {
+		t.Errorf("expected upload to be refused with %s, have %v", ErrInsufficientSpace, err)
+	}
+	if _, err := b.store.TransferStatus(u.TransferID); err == nil {
+		t.Errorf("expected nothing of the refused upload to be staged")
+	}
+}
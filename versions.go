@@ -0,0 +1,208 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// versionsDirSuffix is appended to the name of an object to get the prefix
+// its older versions are kept under.
+const versionsDirSuffix = ".versions"
+
+// ErrVersionNotFound is returned when a requested version of an object is
+// not in its history.
+var ErrVersionNotFound = errors.New("version not found")
+
+// isVersionsDir reports whether name is the version history prefix of an object.
+func isVersionsDir(name string) bool {
+	return strings.HasSuffix(name, versionsDirSuffix)
+}
+
+// versionsDir returns the prefix the history of the given key is kept under.
+func (s *Store) versionsDir(id string, key string) string {
+	return s.objectName(id, key) + versionsDirSuffix
+}
+
+// versionName returns the name the given version of a key is kept under once
+// it is no longer the head.
+func (s *Store) versionName(id string, key string, version Version) string {
+	return s.versionsDir(id, key) + "/" + version.String()
+}
+
+// archive moves the current head of an object into its history.
+func (s *Store) archive(id string, key string, current ObjectMeta) error {
+	if s.MaxVersions < 0 {
+		return nil
+	}
+
+	name := s.versionName(id, key, current.Version)
+	if err := s.Storage.Rename(s.objectName(id, key), name); err != nil {
+		return err
+	}
+	return s.Storage.Rename(s.metaName(id, key), name+metaSuffix)
+}
+
+// unarchive moves a version archived by archive back to the head, undoing a
+// write that failed before it could replace it.
+func (s *Store) unarchive(id string, key string, current ObjectMeta) error {
+	if s.MaxVersions < 0 {
+		return nil
+	}
+
+	name := s.versionName(id, key, current.Version)
+	if err := s.Storage.Rename(name, s.objectName(id, key)); err != nil {
+		return err
+	}
+	return s.Storage.Rename(name+metaSuffix, s.metaName(id, key))
+}
+
+// pruneVersions drops the oldest versions of a key beyond MaxVersions.
+func (s *Store) pruneVersions(id string, key string) error {
+	history, err := s.history(id, key)
+	if err != nil {
+		return err
+	}
+
+	keep := s.MaxVersions
+	if keep < 0 {
+		keep = 0
+	}
+	for _, meta := range history[min(keep, len(history)):] {
+		name := s.versionName(id, key, meta.Version)
+		if err := s.Storage.Delete(name + metaSuffix); err != nil {
+			return err
+		}
+		if err := s.Storage.Delete(name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// purgeHistory drops every older version of a key, leaving the head alone.
+func (s *Store) purgeHistory(id string, key string) error {
+	names, err := s.Storage.List(s.versionsDir(id, key))
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if err := s.Storage.Delete(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// history returns the metadata of the older versions of a key, newest first.
+func (s *Store) history(id string, key string) ([]ObjectMeta, error) {
+	names, err := s.Storage.List(s.versionsDir(id, key))
+	if err != nil {
+		return nil, err
+	}
+
+	var history []ObjectMeta
+	for _, name := range names {
+		if !isMetaFile(name) {
+			continue
+		}
+		meta, err := s.readMetaBlob(name)
+		if errors.Is(err, os.ErrNotExist) {
+			// Pruned since it was listed.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, meta)
+	}
+
+	sort.Slice(history, func(i, j int) bool {
+		return history[i].Version.After(history[j].Version)
+	})
+
+	return history, nil
+}
+
+// ListVersions returns the metadata of every version of a key the store
+// holds, newest first. The first entry is the current version, which is a
+// tombstone if the key has been deleted.
+func (s *Store) ListVersions(id string, key string) ([]ObjectMeta, error) {
+	if err := s.checkKey(id, key); err != nil {
+		return nil, err
+	}
+
+	var versions []ObjectMeta
+	if head, ok := s.head(id, key); ok {
+		versions = append(versions, head)
+	}
+
+	history, err := s.history(id, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(versions, history...), nil
+}
+
+// ReadVersion reads the given version of a key. Like Read, reading it to the
+// end verifies it against its recorded checksum.
+func (s *Store) ReadVersion(id string, key string, version Version) (int64, io.Reader, error) {
+	if err := s.checkKey(id, key); err != nil {
+		return 0, nil, err
+	}
+
+	if head, err := s.Stat(id, key); err == nil && head.Version == version {
+		return s.Read(id, key)
+	}
+
+	name := s.versionName(id, key, version)
+	meta, err := s.readMetaBlob(name + metaSuffix)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil, fmt.Errorf("%w: %s of (%s)", ErrVersionNotFound, version, key)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+
+	blob, err := s.Storage.Read(name)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	return meta.Size, newVerifyingReader(blob, meta.Checksum), nil
+}
+
+// ListVersions returns the metadata of every version of a file in namespace
+// ns held on this node, newest first, as allowed by the Token of the server.
+func (s *FileServer) ListVersions(ns string, key string) ([]ObjectMeta, error) {
+	if err := s.authorize("", ns, PermRead); err != nil {
+		return nil, err
+	}
+	if _, err := s.namespace(ns); err != nil {
+		return nil, err
+	}
+	return s.store.ListVersions(ns, key)
+}
+
+// GetVersion retrieves the given version of a file in namespace ns from this
+// node's history, as allowed by the Token of the server. The history of a
+// deleted file is not served, even though it is kept until its tombstone is
+// purged.
+func (s *FileServer) GetVersion(ns string, key string, version Version) (io.Reader, error) {
+	if err := s.authorize("", ns, PermRead); err != nil {
+		return nil, err
+	}
+	if _, err := s.namespace(ns); err != nil {
+		return nil, err
+	}
+	if head, ok := s.store.head(ns, key); ok && head.Deleted {
+		return nil, fmt.Errorf("%w: (%s) at version %s", ErrDeleted, key, head.Version)
+	}
+	_, r, err := s.store.ReadVersion(ns, key, version)
+	return r, err
+}
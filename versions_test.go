@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestStoreVersionHistory(t *testing.T) {
+	s := NewStore(StoreOpts{
+		PathTransformFunc: CASPathTransformFunc,
+		MaxVersions:       2,
+	})
+	id := generateID()
+	defer teardown(t, s)
+
+	key := "versioned"
+	for i := 1; i <= 4; i++ {
+		meta := ObjectMeta{Version: Version{WallTime: int64(i), NodeID: "a"}}
+		data := fmt.Sprintf("version %d", i)
+		if _, err := s.WriteWithMeta(id, key, bytes.NewReader([]byte(data)), meta); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	versions, err := s.ListVersions(id, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 3 {
+		t.Fatalf("expected head and 2 old versions, have %d", len(versions))
+	}
+	for i, want := range []int64{4, 3, 2} {
+		if versions[i].Version.WallTime != want {
+			t.Errorf("version %d: have %s want wall time %d", i, versions[i].Version, want)
+		}
+	}
+
+	_, r, err := s.ReadVersion(id, key, versions[1].Version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(r); string(b) != "version 3" {
+		t.Errorf("have %s want version 3", b)
+	}
+
+	_, _, err = s.ReadVersion(id, key, Version{WallTime: 1, NodeID: "a"})
+	if !errors.Is(err, ErrVersionNotFound) {
+		t.Errorf("expected pruned version to be gone, have %v", err)
+	}
+}
+
+func TestStoreKeepsNewestVersionAsHead(t *testing.T) {
+	s := newStore()
+	id := generateID()
+	defer teardown(t, s)
+
+	key := "conflict"
+	newest := ObjectMeta{Version: Version{WallTime: 10, NodeID: "b"}}
+	older := ObjectMeta{Version: Version{WallTime: 10, NodeID: "a"}}
+
+	if _, err := s.WriteWithMeta(id, key, bytes.NewReader([]byte("from b")), newest); err != nil {
+		t.Fatal(err)
+	}
+	// A concurrent write that loses the tie arrives late.
+	if _, err := s.WriteWithMeta(id, key, bytes.NewReader([]byte("from a")), older); err != nil {
+		t.Fatal(err)
+	}
+
+	_, r, err := s.Read(id, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, _ := io.ReadAll(r); string(b) != "from b" {
+		t.Errorf("expected newest write to stay the head, have %s", b)
+	}
+
+	versions, err := s.ListVersions(id, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[1].Version != older.Version {
+		t.Errorf("expected late write in history, have %+v", versions)
+	}
+}